@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mattn/go-shellwords"
+)
+
+// JSONAmount is an amount in one commodity, rounded to the commodity's
+// precision, with its display form.
+type JSONAmount struct {
+	Commodity string  `json:"commodity"`
+	Amount    float64 `json:"amount"`
+	Formatted string  `json:"formatted"`
+}
+
+// JSONBalanceNode is an account in a balance tree. Name is relative to the
+// parent node and may span several levels, as in the text report.
+type JSONBalanceNode struct {
+	Account  string             `json:"account"`
+	Name     string             `json:"name"`
+	Depth    int                `json:"depth"`
+	Amounts  []JSONAmount       `json:"amounts"`
+	Children []*JSONBalanceNode `json:"children"`
+}
+
+// JSONRegisterRow is one posting of a register report.
+type JSONRegisterRow struct {
+	Date    string       `json:"date"`
+	Payee   string       `json:"payee"`
+	Account string       `json:"account"`
+	Amount  JSONAmount   `json:"amount"`
+	Total   []JSONAmount `json:"total"`
+	Line    int          `json:"line"`
+}
+
+// JSONQueryResult is the response of /{ledger}/query_json. Only the field
+// matching the command is set.
+type JSONQueryResult struct {
+	Command  string             `json:"command"`
+	Query    string             `json:"query"`
+	Accounts []*JSONBalanceNode `json:"accounts,omitempty"`
+	Total    []JSONAmount       `json:"total,omitempty"`
+	Register []JSONRegisterRow  `json:"register,omitempty"`
+	Error    string             `json:"error,omitempty"`
+}
+
+func jsonAmount(journal *Journal, a Amount) JSONAmount {
+	scale := math.Pow(10, float64(journal.Precision(a.Currency)))
+	return JSONAmount{
+		Commodity: a.Currency,
+		Amount:    math.Round(a.Value*scale) / scale,
+		Formatted: journal.FormatAmount(a),
+	}
+}
+
+func jsonBalance(journal *Journal, b Balance) []JSONAmount {
+	amounts := []JSONAmount{}
+	for _, c := range b.Commodities() {
+		if math.Abs(b[c]) > journal.tolerance(c) {
+			amounts = append(amounts, jsonAmount(journal, Amount{Currency: c, Value: b[c]}))
+		}
+	}
+	return amounts
+}
+
+// JSONBalanceTree nests the rows of a balance report by depth.
+func JSONBalanceTree(journal *Journal, report *BalanceReport) []*JSONBalanceNode {
+	roots := []*JSONBalanceNode{}
+	stack := []*JSONBalanceNode{}
+	for _, row := range report.Rows {
+		node := &JSONBalanceNode{
+			Account:  row.Account,
+			Name:     row.Name,
+			Depth:    row.Depth,
+			Amounts:  jsonBalance(journal, row.Total),
+			Children: []*JSONBalanceNode{},
+		}
+		if row.Depth > len(stack) {
+			row.Depth = len(stack)
+		}
+		stack = stack[:row.Depth]
+		if row.Depth == 0 {
+			roots = append(roots, node)
+		} else {
+			parent := stack[row.Depth-1]
+			parent.Children = append(parent.Children, node)
+		}
+		stack = append(stack, node)
+	}
+	return roots
+}
+
+// JSONQuery runs a "bal" or "reg" query and returns it as structured data.
+func JSONQuery(journal *Journal, query string) (*JSONQueryResult, error) {
+	args, err := shellwords.Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	command, opts, err := ParseReportCommand(args, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	result := &JSONQueryResult{Command: command, Query: query}
+	switch command {
+	case "bal", "balance", "b":
+		report := BalanceReportFor(journal, opts)
+		result.Command = "bal"
+		result.Accounts = JSONBalanceTree(journal, report)
+		result.Total = jsonBalance(journal, report.Total)
+	case "reg", "register", "r":
+		result.Command = "reg"
+		result.Register = []JSONRegisterRow{}
+		for _, row := range RegisterReportFor(journal, opts) {
+			result.Register = append(result.Register, JSONRegisterRow{
+				Date:    row.Date.Format("2006-01-02"),
+				Payee:   row.Payee,
+				Account: row.Account,
+				Amount:  jsonAmount(journal, row.Amount),
+				Total:   jsonBalance(journal, row.Total),
+				Line:    row.Posting.Line,
+			})
+		}
+	default:
+		return nil, fmt.Errorf("only bal and reg queries are supported")
+	}
+	return result, nil
+}
+
+func handleQueryJSON(w http.ResponseWriter, r *http.Request) {
+	ledger := mux.Vars(r)["ledger"]
+	query := r.FormValue("query")
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	encoder := json.NewEncoder(w)
+
+	result, err := JSONQuery(LedgerJournal(ledger), query)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(&JSONQueryResult{Query: query, Error: err.Error()})
+		return
+	}
+	encoder.Encode(result)
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// AuthProvider authenticates users for handleLogin. Login starts the flow
+// (a redirect to an identity provider or a login form) carrying state,
+// which comes back as the "state" parameter of the request given to
+// Callback.
+type AuthProvider interface {
+	Login(w http.ResponseWriter, r *http.Request, state string)
+	Callback(r *http.Request) (email string, token oauth2.Token, err error)
+	// Refresh is called on every request with the session's token and
+	// returns it renewed if needed. An error ends the session.
+	Refresh(token oauth2.Token) (oauth2.Token, error)
+	// LoginFailed answers a request for which Callback returned err.
+	LoginFailed(w http.ResponseWriter, r *http.Request, err error)
+}
+
+// AuthConfig is read from auth.json. Without it, Google is used.
+type AuthConfig struct {
+	Provider string // "google", "oidc", "static", "dev" or "header"
+	OIDC     OIDCConfig
+	Users    map[string]string // email to password hash, for "static"
+	Header   string            // trusted header with the email, for "header"
+}
+
+// OIDCConfig configures a generic OpenID Connect provider.
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+}
+
+var authProvider AuthProvider
+
+// BaseURL is the external URL of the server, used for OAuth redirects.
+var BaseURL string
+
+const googleUserInfoURL = "https://www.googleapis.com/oauth2/v2/userinfo"
+
+// InitAuth selects the authentication provider from auth.json, or the
+// WEBLEDGER_AUTH environment variable for the provider name.
+func InitAuth() {
+	config := AuthConfig{Provider: "google"}
+	if file, err := os.Open("auth.json"); err == nil {
+		if err := json.NewDecoder(file).Decode(&config); err != nil {
+			Log("Error reading auth.json: %v", err)
+		}
+		file.Close()
+	}
+	if env := os.Getenv("WEBLEDGER_AUTH"); env != "" {
+		config.Provider = env
+	}
+	provider, err := NewAuthProvider(config)
+	if err != nil {
+		Log("Error configuring %v authentication: %v", config.Provider, err)
+		os.Exit(1)
+	}
+	authProvider = provider
+	Log("Using %v authentication", config.Provider)
+}
+
+// NewAuthProvider builds the provider named in the config. The dev and
+// header providers trust whatever the client says, so they only work with
+// WEBLEDGER_ENV=local.
+func NewAuthProvider(config AuthConfig) (AuthProvider, error) {
+	redirectURL := BaseURL + "/oauthcallback"
+	switch config.Provider {
+	case "", "google":
+		return &oauthProvider{
+			config: &oauth2.Config{
+				ClientID:     ClientId,
+				ClientSecret: ClientSecret,
+				Scopes:       []string{"https://www.googleapis.com/auth/userinfo.email"},
+				Endpoint:     google.Endpoint,
+				RedirectURL:  redirectURL,
+			},
+			userInfoURL: googleUserInfoURL,
+			// Google only returns a refresh token with these.
+			options: []oauth2.AuthCodeOption{oauth2.AccessTypeOffline, oauth2.ApprovalForce},
+		}, nil
+	case "oidc":
+		return newOIDCProvider(config.OIDC, redirectURL)
+	case "static":
+		if len(config.Users) == 0 {
+			return nil, fmt.Errorf("no users configured")
+		}
+		return &staticProvider{users: config.Users}, nil
+	case "dev", "header":
+		if env := os.Getenv("WEBLEDGER_ENV"); env != "local" && env != "development" {
+			return nil, fmt.Errorf("the %v provider requires WEBLEDGER_ENV=local", config.Provider)
+		}
+		if config.Provider == "dev" {
+			return &devProvider{}, nil
+		}
+		if config.Header == "" {
+			config.Header = "X-Forwarded-Email"
+		}
+		return &headerProvider{header: config.Header}, nil
+	}
+	return nil, fmt.Errorf("unknown provider %q", config.Provider)
+}
+
+// oauthProvider logs in through an OAuth2 authorization server and reads
+// the email from its userinfo endpoint. It serves Google and generic OIDC.
+type oauthProvider struct {
+	config      *oauth2.Config
+	userInfoURL string
+	options     []oauth2.AuthCodeOption // extra parameters of the login redirect
+}
+
+func newOIDCProvider(config OIDCConfig, redirectURL string) (*oauthProvider, error) {
+	if config.Issuer == "" || config.ClientID == "" {
+		return nil, fmt.Errorf("Issuer and ClientID are required")
+	}
+	response, err := http.Get(strings.TrimSuffix(config.Issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	var discovery struct {
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&discovery); err != nil {
+		return nil, fmt.Errorf("invalid discovery document: %v", err)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.UserinfoEndpoint == "" {
+		return nil, fmt.Errorf("discovery document is missing endpoints")
+	}
+	scopes := config.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email"}
+	}
+	return &oauthProvider{
+		config: &oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			Scopes:       scopes,
+			Endpoint:     oauth2.Endpoint{AuthURL: discovery.AuthorizationEndpoint, TokenURL: discovery.TokenEndpoint},
+			RedirectURL:  redirectURL,
+		},
+		userInfoURL: discovery.UserinfoEndpoint,
+	}, nil
+}
+
+func (p *oauthProvider) Login(w http.ResponseWriter, r *http.Request, state string) {
+	http.Redirect(w, r, p.config.AuthCodeURL(state, p.options...), http.StatusFound)
+}
+
+func (p *oauthProvider) Callback(r *http.Request) (string, oauth2.Token, error) {
+	token, err := p.config.Exchange(context.Background(), r.FormValue("code"))
+	if err != nil {
+		return "", oauth2.Token{}, err
+	}
+	email, err := p.email(*token)
+	return email, *token, err
+}
+
+func (p *oauthProvider) Refresh(token oauth2.Token) (oauth2.Token, error) {
+	if token.Expiry.IsZero() || time.Until(token.Expiry) >= 5*time.Minute {
+		return token, nil
+	}
+	Log("Token expired or expiring soon, refreshing...")
+	newToken, err := p.config.TokenSource(context.Background(), &token).Token()
+	if err != nil {
+		return token, err
+	}
+	Log("Token refreshed successfully")
+	return *newToken, nil
+}
+
+func (p *oauthProvider) LoginFailed(w http.ResponseWriter, r *http.Request, err error) {
+	http.Error(w, "Login failed", http.StatusUnauthorized)
+}
+
+// email asks the userinfo endpoint who the token belongs to.
+func (p *oauthProvider) email(token oauth2.Token) (string, error) {
+	request, err := http.NewRequest("GET", p.userInfoURL, nil)
+	if err != nil {
+		return "", err
+	}
+	token.SetAuthHeader(request)
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	contents, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		Email         string `json:"email"`
+		EmailVerified *bool  `json:"email_verified"`
+		VerifiedEmail *bool  `json:"verified_email"`
+	}
+	json.Unmarshal(contents, &result)
+	if result.Email == "" {
+		return "", fmt.Errorf("no email in userinfo response")
+	}
+	if result.EmailVerified != nil && !*result.EmailVerified || result.VerifiedEmail != nil && !*result.VerifiedEmail {
+		return "", fmt.Errorf("email %v is not verified", result.Email)
+	}
+	return result.Email, nil
+}
+
+// renderLoginForm shows the login page for the form based providers.
+func renderLoginForm(w http.ResponseWriter, state string, password bool, message string) {
+	RenderTemplate(w, "login", map[string]interface{}{
+		"root":     RootPath,
+		"state":    state,
+		"csrf":     newLoginCSRFToken(w),
+		"password": password,
+		"message":  message,
+	})
+}
+
+// staticProvider checks email and password against hashes in auth.json.
+type staticProvider struct {
+	users map[string]string
+}
+
+func (p *staticProvider) Login(w http.ResponseWriter, r *http.Request, state string) {
+	renderLoginForm(w, state, true, "")
+}
+
+func (p *staticProvider) Callback(r *http.Request) (string, oauth2.Token, error) {
+	email := strings.TrimSpace(r.FormValue("email"))
+	hash, ok := p.users[email]
+	if !ok || !CheckPasswordHash(r.FormValue("password"), hash) {
+		return "", oauth2.Token{}, fmt.Errorf("invalid email or password")
+	}
+	return email, oauth2.Token{}, nil
+}
+
+func (p *staticProvider) Refresh(token oauth2.Token) (oauth2.Token, error) {
+	return token, nil
+}
+
+func (p *staticProvider) LoginFailed(w http.ResponseWriter, r *http.Request, err error) {
+	renderLoginForm(w, newLoginState(w), true, err.Error())
+}
+
+// devProvider logs in as any email typed in the login form. Local only.
+type devProvider struct{}
+
+func (p *devProvider) Login(w http.ResponseWriter, r *http.Request, state string) {
+	renderLoginForm(w, state, false, "Development login: any email is accepted.")
+}
+
+func (p *devProvider) Callback(r *http.Request) (string, oauth2.Token, error) {
+	email := strings.TrimSpace(r.FormValue("email"))
+	if email == "" {
+		return "", oauth2.Token{}, fmt.Errorf("email is required")
+	}
+	return email, oauth2.Token{}, nil
+}
+
+func (p *devProvider) Refresh(token oauth2.Token) (oauth2.Token, error) {
+	return token, nil
+}
+
+func (p *devProvider) LoginFailed(w http.ResponseWriter, r *http.Request, err error) {
+	renderLoginForm(w, newLoginState(w), false, err.Error())
+}
+
+// headerProvider trusts an email header set by a reverse proxy. Local only.
+type headerProvider struct {
+	header string
+}
+
+func (p *headerProvider) Login(w http.ResponseWriter, r *http.Request, state string) {
+	if r.Header.Get(p.header) == "" {
+		http.Error(w, "Missing "+p.header+" header", http.StatusUnauthorized)
+		return
+	}
+	http.Redirect(w, r, RootPath+"/oauthcallback?state="+state, http.StatusFound)
+}
+
+func (p *headerProvider) Callback(r *http.Request) (string, oauth2.Token, error) {
+	email := strings.TrimSpace(r.Header.Get(p.header))
+	if email == "" {
+		return "", oauth2.Token{}, fmt.Errorf("missing %v header", p.header)
+	}
+	return email, oauth2.Token{}, nil
+}
+
+func (p *headerProvider) Refresh(token oauth2.Token) (oauth2.Token, error) {
+	return token, nil
+}
+
+func (p *headerProvider) LoginFailed(w http.ResponseWriter, r *http.Request, err error) {
+	http.Error(w, "Login failed", http.StatusUnauthorized)
+}
+
+const passwordIterations = 210000
+
+// HashPassword returns a "pbkdf2-sha256$iterations$salt$hash" string for
+// the Users map of auth.json.
+func HashPassword(password string) string {
+	salt := randomToken()
+	key, err := pbkdf2.Key(sha256.New, password, []byte(salt), passwordIterations, 32)
+	if err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations, salt, base64.RawStdEncoding.EncodeToString(key))
+}
+
+// printPasswordHash reads a password line from input and prints its
+// HashPassword, for the -hash-password flag.
+func printPasswordHash(input io.Reader) error {
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := bufio.NewReader(input).ReadString('\n')
+	if err != nil && password == "" {
+		return err
+	}
+	fmt.Println(HashPassword(strings.TrimRight(password, "\r\n")))
+	return nil
+}
+
+// CheckPasswordHash verifies a password against a HashPassword result.
+func CheckPasswordHash(password string, hash string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return false
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	key, err := pbkdf2.Key(sha256.New, password, []byte(parts[2]), iterations, len(expected))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPasswordHash(t *testing.T) {
+	hash := HashPassword("s3cret")
+	if !CheckPasswordHash("s3cret", hash) {
+		t.Errorf("correct password rejected")
+	}
+	if CheckPasswordHash("wrong", hash) {
+		t.Errorf("wrong password accepted")
+	}
+}
+
+func TestDevLogin(t *testing.T) {
+	t.Setenv("WEBLEDGER_ENV", "local")
+	provider, err := NewAuthProvider(AuthConfig{Provider: "dev"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	authProvider = provider
+	sessions = NewSessionStore("", []byte("test key"))
+	InitTemplates()
+
+	protected := handleLogin(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + GetSession(r).Email))
+	})
+
+	// Without a session the login form is shown, with state and CSRF cookies.
+	w := httptest.NewRecorder()
+	protected(w, httptest.NewRequest("GET", "/", nil))
+	cookies := w.Result().Cookies()
+	if len(cookies) != 2 || cookies[0].Name != oauthStateCookieName || cookies[1].Name != loginCSRFCookieName {
+		t.Fatalf("expected state and CSRF cookies, got %v", cookies)
+	}
+	stateCookie, csrfCookie := cookies[0], cookies[1]
+
+	// A post from another site, without the form's CSRF token, is rejected.
+	form := url.Values{"email": {"dev@example.com"}, "state": {stateCookie.Value}}
+	r := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(stateCookie)
+	w = httptest.NewRecorder()
+	authCallback(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("login without CSRF token: %v %v", w.Code, w.Body.String())
+	}
+
+	form.Set(csrfFieldName, csrfCookie.Value)
+	r = httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(stateCookie)
+	r.AddCookie(csrfCookie)
+	w = httptest.NewRecorder()
+	authCallback(w, r)
+	if w.Code != http.StatusFound {
+		t.Fatalf("login failed: %v %v", w.Code, w.Body.String())
+	}
+	var sessionCookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == sessionCookieName {
+			sessionCookie = c
+		}
+	}
+	if sessionCookie == nil {
+		t.Fatal("no session cookie")
+	}
+
+	r = httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(sessionCookie)
+	w = httptest.NewRecorder()
+	protected(w, r)
+	if w.Body.String() != "hello dev@example.com" {
+		t.Errorf("unexpected response %q", w.Body.String())
+	}
+}
+
+func TestLedgerRole(t *testing.T) {
+	saved := ledgers
+	defer func() { ledgers = saved }()
+	ledgers = map[string]LedgerDef{
+		"casa": {
+			Users: []string{"owner@example.com"},
+			Roles: map[string]string{"viewer@example.com": "read", "partner@example.com": "append"},
+		},
+	}
+	cases := map[string]Role{
+		"owner@example.com":   RoleEdit,
+		"partner@example.com": RoleAppend,
+		"viewer@example.com":  RoleRead,
+		"other@example.com":   RoleNone,
+	}
+	for email, expected := range cases {
+		if role := LedgerRole("casa", email); role != expected {
+			t.Errorf("LedgerRole(%v) = %v, expected %v", email, role, expected)
+		}
+	}
+	if AuthLedger("casa", "other@example.com") {
+		t.Errorf("AuthLedger allowed a user without a role")
+	}
+}
+
+func TestOAuthLoginRedirect(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"authorization_endpoint": "https://idp.example.com/auth", "token_endpoint": "https://idp.example.com/token", "userinfo_endpoint": "https://idp.example.com/userinfo"}`))
+	}))
+	defer server.Close()
+
+	oidc, err := NewAuthProvider(AuthConfig{Provider: "oidc", OIDC: OIDCConfig{Issuer: server.URL, ClientID: "webledger"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	google, err := NewAuthProvider(AuthConfig{Provider: "google"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	login := func(provider AuthProvider) url.Values {
+		w := httptest.NewRecorder()
+		provider.Login(w, httptest.NewRequest("GET", "/", nil), "state")
+		location, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return location.Query()
+	}
+	// Only Google needs these to return a refresh token; they force the
+	// consent screen on other providers.
+	if query := login(oidc); query.Get("state") != "state" || query.Has("access_type") || query.Has("prompt") {
+		t.Errorf("unexpected OIDC login parameters %v", query)
+	}
+	if query := login(google); query.Get("access_type") != "offline" || query.Get("prompt") != "consent" {
+		t.Errorf("unexpected Google login parameters %v", query)
+	}
+}
@@ -10,7 +10,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/extrame/xls"
 	"github.com/ledongthuc/pdf"
 )
 
@@ -22,7 +21,7 @@ type BankTransaction struct {
 	Credit      float64
 	Balance     float64
 	Reference   string
-	Account     string // "Assets:Bank:BROU" or "Assets:Bank:Itau"
+	Account     string // ledger account, e.g. "Assets:Bank:BROU"
 	Currency    string // "$" for Pesos, "US$" for US Dollars
 }
 
@@ -35,6 +34,8 @@ type Amount struct {
 // BankStatement represents a complete bank statement
 type BankStatement struct {
 	Account      string
+	Bank         string // "BROU", "Itau", "VisaItau" or "OFX", for LedgerDef.BankAccounts
+	Number       string // account number, if the statement shows it
 	Currency     string // "$" for Pesos, "US$" for US Dollars
 	Transactions []BankTransaction
 	StartDate    time.Time
@@ -43,25 +44,19 @@ type BankStatement struct {
 	EndBalances   []Amount
 }
 
-// ParseBrouStatement parses a BROU bank statement XLS file
-func ParseBrouStatement(reader io.ReadSeeker) (*BankStatement, error) {
-	xlsFile, err := xls.OpenReader(reader, "utf-8")
+// ParseBrouStatement parses a BROU bank statement XLS or XLSX file
+func ParseBrouStatement(reader io.Reader) (*BankStatement, error) {
+	data, err := io.ReadAll(reader)
 	if err != nil {
-		return nil, fmt.Errorf("error opening XLS file: %v", err)
+		return nil, err
 	}
-
-	numSheets := xlsFile.NumSheets()
-	if numSheets == 0 {
-		return nil, fmt.Errorf("no sheets found in XLS file")
+	sheets, err := ReadSpreadsheet(data)
+	if err != nil {
+		return nil, err
 	}
 
 	// Try each sheet to find transaction data
-	for sheetIdx := 0; sheetIdx < numSheets; sheetIdx++ {
-		sheet := xlsFile.GetSheet(sheetIdx)
-		if sheet == nil {
-			continue
-		}
-		
+	for _, sheet := range sheets {
 		statement, err := parseBrouSheet(sheet)
 		if err == nil && len(statement.Transactions) > 0 {
 			return statement, nil
@@ -71,10 +66,11 @@ func ParseBrouStatement(reader io.ReadSeeker) (*BankStatement, error) {
 	return nil, fmt.Errorf("no transaction data found in any sheet")
 }
 
-func parseBrouSheet(sheet *xls.WorkSheet) (*BankStatement, error) {
+func parseBrouSheet(sheet Sheet) (*BankStatement, error) {
 
 	statement := &BankStatement{
 		Account:      "Assets:Bank:BROU",
+		Bank:         "BROU",
 		Currency:     "$", // Default to Pesos, will detect from sheet
 		Transactions: []BankTransaction{},
 	}
@@ -84,42 +80,14 @@ func parseBrouSheet(sheet *xls.WorkSheet) (*BankStatement, error) {
 	var dateCol, descCol, refCol, debitCol, creditCol int = -1, -1, -1, -1, -1
 
 	// First pass: find header row and column indices
-	maxRow := int(sheet.MaxRow)
-	for i := 0; i < maxRow && i < 100; i++ {
-		var row *xls.Row
-		func() {
-			defer func() {
-				if err := recover(); err != nil {
-					row = nil
-				}
-			}()
-			row = sheet.Row(i)
-		}()
-		
-		if row == nil {
-			continue
-		}
-		
-		// Safely get last column index
-		lastCol := 0
-		func() {
-			defer func() {
-				if recover() != nil {
-					lastCol = 0
-				}
-			}()
-			lastCol = row.LastCol()
-		}()
-		
-		if lastCol == 0 {
+	for i := 0; i < len(sheet) && i < 100; i++ {
+		row := sheet[i]
+		if len(row) == 0 {
 			continue
 		}
 
 		// Check if this is the header row
-		for colIdx := 0; colIdx < lastCol; colIdx++ {
-			cellValue := row.Col(colIdx)
-			cellStr := strings.TrimSpace(cellValue)
-			
+		for colIdx, cellStr := range row {
 			// Detect currency from "Moneda" field or currency indicators
 			cellLower := strings.ToLower(cellStr)
 			if strings.Contains(cellLower, "moneda") {
@@ -137,16 +105,19 @@ func parseBrouSheet(sheet *xls.WorkSheet) (*BankStatement, error) {
 			if strings.EqualFold(cellStr, "fecha") {
 				headerRow = i
 				dateCol = colIdx
-			} else if strings.Contains(strings.ToLower(cellStr), "descripci") {
+			} else if strings.Contains(cellLower, "descripci") {
 				descCol = colIdx
-			} else if strings.Contains(strings.ToLower(cellStr), "referencia") || strings.Contains(strings.ToLower(cellStr), "asunto") {
+			} else if strings.Contains(cellLower, "referencia") || strings.Contains(cellLower, "asunto") {
 				refCol = colIdx
-			} else if strings.Contains(strings.ToLower(cellStr), "débito") || strings.Contains(strings.ToLower(cellStr), "debito") {
+			} else if strings.Contains(cellLower, "débito") || strings.Contains(cellLower, "debito") {
 				debitCol = colIdx
-			} else if strings.Contains(strings.ToLower(cellStr), "crédito") || strings.Contains(strings.ToLower(cellStr), "credito") {
+			} else if strings.Contains(cellLower, "crédito") || strings.Contains(cellLower, "credito") {
 				creditCol = colIdx
 			}
 		}
+		if statement.Number == "" {
+			statement.Number = findAccountNumber(row)
+		}
 
 		if headerRow >= 0 {
 			break
@@ -158,40 +129,13 @@ func parseBrouSheet(sheet *xls.WorkSheet) (*BankStatement, error) {
 	}
 
 	// Second pass: parse transaction data
-	for i := headerRow + 1; i < maxRow; i++ {
-		var row *xls.Row
-		func() {
-			defer func() {
-				if err := recover(); err != nil {
-					row = nil
-				}
-			}()
-			row = sheet.Row(i)
-		}()
-		
-		if row == nil {
-			continue
-		}
-		
-		// Safely get last column index
-		lastCol := 0
-		func() {
-			defer func() {
-				if recover() != nil {
-					lastCol = 0
-				}
-			}()
-			lastCol = row.LastCol()
-		}()
-		
-		if lastCol == 0 {
+	for i := headerRow + 1; i < len(sheet); i++ {
+		row := sheet[i]
+		if len(row) == 0 {
 			continue
 		}
 
-		dateStr := ""
-		if dateCol >= 0 && dateCol < lastCol {
-			dateStr = strings.TrimSpace(row.Col(dateCol))
-		}
+		dateStr := row.Cell(dateCol)
 
 		// Stop if we hit an empty date or summary section
 		if dateStr == "" || strings.Contains(strings.ToLower(dateStr), "total") {
@@ -205,35 +149,12 @@ func parseBrouSheet(sheet *xls.WorkSheet) (*BankStatement, error) {
 			continue
 		}
 
-		desc := ""
-		if descCol >= 0 && descCol < lastCol {
-			desc = strings.TrimSpace(row.Col(descCol))
-		}
-
-		ref := ""
-		if refCol >= 0 && refCol < lastCol {
-			ref = strings.TrimSpace(row.Col(refCol))
-		}
-
-		debitStr := ""
-		if debitCol >= 0 && debitCol < lastCol {
-			debitStr = strings.TrimSpace(row.Col(debitCol))
-		}
-
-		creditStr := ""
-		if creditCol >= 0 && creditCol < lastCol {
-			creditStr = strings.TrimSpace(row.Col(creditCol))
-		}
-
-		debit := parseAmount(debitStr)
-		credit := parseAmount(creditStr)
-
 		transaction := BankTransaction{
 			Date:        date,
-			Description: desc,
-			Debit:       debit,
-			Credit:      credit,
-			Reference:   ref,
+			Description: row.Cell(descCol),
+			Debit:       parseAmount(row.Cell(debitCol)),
+			Credit:      parseAmount(row.Cell(creditCol)),
+			Reference:   row.Cell(refCol),
 			Account:     "Assets:Bank:BROU",
 			Currency:    statement.Currency,
 		}
@@ -251,24 +172,23 @@ func parseBrouSheet(sheet *xls.WorkSheet) (*BankStatement, error) {
 	return statement, nil
 }
 
-// ParseItauStatement parses an Itau bank statement XLS file
-func ParseItauStatement(reader io.ReadSeeker) (*BankStatement, error) {
-	xlsFile, err := xls.OpenReader(reader, "utf-8")
+// ParseItauStatement parses an Itau bank statement XLS or XLSX file
+func ParseItauStatement(reader io.Reader) (*BankStatement, error) {
+	data, err := io.ReadAll(reader)
 	if err != nil {
-		return nil, fmt.Errorf("error opening XLS file: %v", err)
-	}
-
-	if xlsFile.NumSheets() == 0 {
-		return nil, fmt.Errorf("no sheets found in XLS file")
+		return nil, err
 	}
-
-	sheet := xlsFile.GetSheet(0)
-	if sheet == nil {
-		return nil, fmt.Errorf("could not get first sheet")
+	sheets, err := ReadSpreadsheet(data)
+	if err != nil {
+		return nil, err
 	}
+	return parseItauSheet(sheets[0])
+}
 
+func parseItauSheet(sheet Sheet) (*BankStatement, error) {
 	statement := &BankStatement{
 		Account:      "Assets:Bank:Itau",
+		Bank:         "Itau",
 		Currency:     "$", // Default to Pesos, will detect from sheet
 		Transactions: []BankTransaction{},
 	}
@@ -277,41 +197,13 @@ func ParseItauStatement(reader io.ReadSeeker) (*BankStatement, error) {
 	var dateCol, conceptCol, debitCol, creditCol, balanceCol, refCol int = -1, -1, -1, -1, -1, -1
 	var monedaCol int = -1 // Track the "Moneda" column to get currency from next row
 
-	maxRow := int(sheet.MaxRow)
-	
-	for i := 0; i < maxRow && i < 100; i++ {
-		var row *xls.Row
-		func() {
-			defer func() {
-				if err := recover(); err != nil {
-					row = nil
-				}
-			}()
-			row = sheet.Row(i)
-		}()
-		
-		if row == nil {
-			continue
-		}
-		
-		// Safely get last column index
-		lastCol := 0
-		func() {
-			defer func() {
-				if recover() != nil {
-					lastCol = 0
-				}
-			}()
-			lastCol = row.LastCol()
-		}()
-		
-		if lastCol == 0 {
+	for i := 0; i < len(sheet) && i < 100; i++ {
+		row := sheet[i]
+		if len(row) == 0 {
 			continue
 		}
 
-		for colIdx := 0; colIdx < lastCol; colIdx++ {
-			cellValue := row.Col(colIdx)
-			cellRaw := strings.TrimSpace(cellValue)
+		for colIdx, cellRaw := range row {
 			cellStr := strings.ToLower(cellRaw)
 			
 			// Detect if this is the header row with "Moneda" - remember the column
@@ -346,6 +238,9 @@ func ParseItauStatement(reader io.ReadSeeker) (*BankStatement, error) {
 				refCol = colIdx
 			}
 		}
+		if statement.Number == "" {
+			statement.Number = findAccountNumber(row)
+		}
 
 		if headerRow >= 0 {
 			break
@@ -356,40 +251,13 @@ func ParseItauStatement(reader io.ReadSeeker) (*BankStatement, error) {
 		return nil, fmt.Errorf("could not find header row in Itau statement")
 	}
 
-	for i := headerRow + 1; i < maxRow; i++ {
-		var row *xls.Row
-		func() {
-			defer func() {
-				if err := recover(); err != nil {
-					row = nil
-				}
-			}()
-			row = sheet.Row(i)
-		}()
-		
-		if row == nil {
-			continue
-		}
-		
-		// Safely get last column index
-		lastCol := 0
-		func() {
-			defer func() {
-				if recover() != nil {
-					lastCol = 0
-				}
-			}()
-			lastCol = row.LastCol()
-		}()
-		
-		if lastCol == 0 {
+	for i := headerRow + 1; i < len(sheet); i++ {
+		row := sheet[i]
+		if len(row) == 0 {
 			continue
 		}
 
-		dateStr := ""
-		if dateCol >= 0 && dateCol < lastCol {
-			dateStr = strings.TrimSpace(row.Col(dateCol))
-		}
+		dateStr := row.Cell(dateCol)
 
 		// Stop at empty date or "SALDO FINAL"
 		if dateStr == "" || strings.Contains(strings.ToUpper(dateStr), "SALDO FINAL") {
@@ -402,51 +270,24 @@ func ParseItauStatement(reader io.ReadSeeker) (*BankStatement, error) {
 		}
 
 		// Skip "SALDO ANTERIOR"
-		concept := ""
-		if conceptCol >= 0 && conceptCol < lastCol {
-			concept = strings.TrimSpace(row.Col(conceptCol))
-		}
+		concept := row.Cell(conceptCol)
 		if strings.Contains(strings.ToUpper(concept), "SALDO ANTERIOR") {
 			continue
 		}
 
-		ref := ""
-		if refCol >= 0 && refCol < lastCol {
-			ref = strings.TrimSpace(row.Col(refCol))
-		}
-
-		debitStr := ""
-		if debitCol >= 0 && debitCol < lastCol {
-			debitStr = strings.TrimSpace(row.Col(debitCol))
-		}
-
-		creditStr := ""
-		if creditCol >= 0 && creditCol < lastCol {
-			creditStr = strings.TrimSpace(row.Col(creditCol))
-		}
-
-		balanceStr := ""
-		if balanceCol >= 0 && balanceCol < lastCol {
-			balanceStr = strings.TrimSpace(row.Col(balanceCol))
-		}
-
 		date, err := parseItauDate(dateStr)
 		if err != nil {
 			// Skip rows that don't have valid dates
 			continue
 		}
 
-		debit := parseAmount(debitStr)
-		credit := parseAmount(creditStr)
-		balance := parseAmount(balanceStr)
-
 		transaction := BankTransaction{
 			Date:        date,
 			Description: concept,
-			Debit:       debit,
-			Credit:      credit,
-			Balance:     balance,
-			Reference:   ref,
+			Debit:       parseAmount(row.Cell(debitCol)),
+			Credit:      parseAmount(row.Cell(creditCol)),
+			Balance:     parseAmount(row.Cell(balanceCol)),
+			Reference:   row.Cell(refCol),
 			Account:     "Assets:Bank:Itau",
 			Currency:    statement.Currency,
 		}
@@ -464,14 +305,34 @@ func ParseItauStatement(reader io.ReadSeeker) (*BankStatement, error) {
 	return statement, nil
 }
 
+var (
+	accountNumberRegex = regexp.MustCompile(`\d[\d\-. ]{4,}\d`)
+	numericDateRegex   = regexp.MustCompile(`^\d{1,2}[-./]\d{1,2}[-./]\d{2,4}$`)
+)
+
+// findAccountNumber returns the account number in the cells of a row, from
+// the cell labelled as the account ("Cuenta", "Número de cuenta"...) or the
+// cell after it.
+func findAccountNumber(cells []string) string {
+	for i, cell := range cells {
+		label := strings.ToLower(cell)
+		if !strings.Contains(label, "cuenta") && !strings.Contains(label, "nro") && !strings.Contains(label, "número") {
+			continue
+		}
+		for _, candidate := range cells[i:min(i+2, len(cells))] {
+			if number := accountNumberRegex.FindString(candidate); number != "" && !numericDateRegex.MatchString(number) {
+				return number
+			}
+		}
+	}
+	return ""
+}
+
 // parseBrouDate parses a date in DD/MM/YYYY format or Excel serial number
 func parseBrouDate(dateStr string) (time.Time, error) {
 	// First check if it's an Excel serial number (like 46048)
 	if serial, err := strconv.ParseFloat(dateStr, 64); err == nil {
-		// Excel epoch is December 30, 1899
-		excelEpoch := time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
-		days := int(serial)
-		return excelEpoch.AddDate(0, 0, days), nil
+		return excelDate(serial), nil
 	}
 	
 	// Try DD/MM/YYYY format
@@ -648,26 +509,6 @@ func ParseBankStatementCSV(reader io.Reader, account string) (*BankStatement, er
 	return statement, nil
 }
 
-// DetectBankFromFilename attempts to detect which bank from the filename
-func DetectBankFromFilename(filename string) string {
-	filenameLower := strings.ToLower(filename)
-	
-	if strings.Contains(filenameLower, "brou") || strings.Contains(filenameLower, "detalle_movimiento") {
-		return "Assets:Bank:BROU"
-	}
-	
-	if strings.Contains(filenameLower, "itau") || strings.Contains(filenameLower, "estado_de_cuenta") {
-		return "Assets:Bank:Itau"
-	}
-	
-	// Visa Itau statements are PDF files with numeric names like 0399723.pdf
-	if strings.HasSuffix(filenameLower, ".pdf") {
-		return "Assets:VisaItau"
-	}
-	
-	return ""
-}
-
 // FormatCurrency formats an amount as currency
 func FormatCurrency(amount float64) string {
 	return FormatCurrencyWithSymbol(amount, "$")
@@ -694,12 +535,14 @@ func ParseVisaItauStatement(reader io.ReaderAt, size int64) ([]*BankStatement, e
 
 	pesoStatement := &BankStatement{
 		Account:      "Assets:VisaItau",
+		Bank:         "VisaItau",
 		Currency:     "$",
 		Transactions: []BankTransaction{},
 	}
 
 	dollarStatement := &BankStatement{
 		Account:      "Assets:VisaItau",
+		Bank:         "VisaItau",
 		Currency:     "US$",
 		Transactions: []BankTransaction{},
 	}
@@ -1124,10 +967,12 @@ func setPeriodFromTransactions(s *BankStatement) {
 func ParseVisaItauMovimientos(html string) ([]*BankStatement, error) {
 	pesoStatement := &BankStatement{
 		Account:  "Assets:VisaItau",
+		Bank:     "VisaItau",
 		Currency: "$",
 	}
 	dollarStatement := &BankStatement{
 		Account:  "Assets:VisaItau",
+		Bank:     "VisaItau",
 		Currency: "US$",
 	}
 
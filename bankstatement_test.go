@@ -1,7 +1,11 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"fmt"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -46,3 +50,283 @@ func TestParseVisaItauMovimientos(t *testing.T) {
 		t.Error("expected dollar transactions")
 	}
 }
+
+func TestParseStatement(t *testing.T) {
+	csv := "Fecha,Descripción,Débito,Crédito\n01/10/2026,UTE,1500,\n02/10/2026,Sueldo,,80000\n"
+	statements, format, err := ParseStatement([]byte(csv))
+	if err != nil || format != "CSV" || len(statements[0].Transactions) != 2 {
+		t.Fatalf("unexpected CSV result %v %v %v", statements, format, err)
+	}
+
+	html := "<table><tr><td>1234</td><td>CULTOCAFE</td><td>Compra</td><td>03/10/26</td><td>Pesos</td><td>250,00</td></tr>" +
+		"<tr><td>1234</td><td>SPOTIFY</td><td>Compra</td><td>04/10/26</td><td>Dólares</td><td>10,00</td></tr></table>"
+	statements, format, err = ParseStatement([]byte(html))
+	if err != nil || format != "Visa Itau Movimientos" || len(statements) != 2 || statements[0].Account != "Assets:VisaItau" {
+		t.Fatalf("unexpected HTML result %v %v %v", statements, format, err)
+	}
+
+	for _, parser := range statementParsers {
+		if confidence := parser.Sniff([]byte("%PDF-1.4\n")); (parser.Name() == "Visa Itau PDF") != (confidence > 0) {
+			t.Errorf("%v sniffed a PDF with confidence %v", parser.Name(), confidence)
+		}
+	}
+	if _, _, err := ParseStatement([]byte("\x00\x01binary")); err == nil {
+		t.Errorf("expected an error for an unknown format")
+	}
+}
+
+func TestStatementAccount(t *testing.T) {
+	accounts := []BankAccount{
+		{Bank: "BROU", Currency: "$", Account: "Assets:BROU:Pesos"},
+		{Bank: "BROU", Currency: "US$", Account: "Assets:BROU:Dolares"},
+		{Bank: "brou", Number: "4567", Currency: "US$", Account: "Assets:BROU:Ahorro"},
+		{Bank: "Itau", Account: "Assets:Itau"},
+	}
+	tests := []struct {
+		statement BankStatement
+		account   string
+	}{
+		{BankStatement{Bank: "BROU", Currency: "$", Account: "Assets:Bank:BROU"}, "Assets:BROU:Pesos"},
+		{BankStatement{Bank: "BROU", Currency: "US$", Account: "Assets:Bank:BROU"}, "Assets:BROU:Dolares"},
+		{BankStatement{Bank: "BROU", Number: "001-234567", Currency: "US$", Account: "Assets:Bank:BROU"}, "Assets:BROU:Ahorro"},
+		{BankStatement{Bank: "BROU", Number: "001-234568", Currency: "US$", Account: "Assets:Bank:BROU"}, "Assets:BROU:Dolares"},
+		{BankStatement{Bank: "Itau", Currency: "US$", Account: "Assets:Bank:Itau"}, "Assets:Itau"},
+		{BankStatement{Bank: "VisaItau", Currency: "$", Account: "Assets:VisaItau"}, "Assets:VisaItau"},
+	}
+	for _, test := range tests {
+		if account := StatementAccount(accounts, &test.statement); account != test.account {
+			t.Errorf("%v %v %v: expected %v, got %v", test.statement.Bank, test.statement.Number, test.statement.Currency, test.account, account)
+		}
+	}
+	if number := findAccountNumber([]string{"Fecha", "01/10/2026", "Nro. de cuenta:", "001-234567"}); number != "001-234567" {
+		t.Errorf("expected account number 001-234567, got %q", number)
+	}
+}
+
+func TestParseOFX(t *testing.T) {
+	sgml := `OFXHEADER:100
+DATA:OFXSGML
+VERSION:102
+CHARSET:1252
+
+<OFX>
+<SIGNONMSGSRSV1><SONRS><STATUS><CODE>0<SEVERITY>INFO</STATUS><DTSERVER>20261016</SONRS></SIGNONMSGSRSV1>
+<BANKMSGSRSV1><STMTTRNRS><TRNUID>1<STMTRS>
+<CURDEF>UYU
+<BANKACCTFROM><BANKID>001<ACCTID>001-234567<ACCTTYPE>CHECKING</BANKACCTFROM>
+<BANKTRANLIST><DTSTART>20261001<DTEND>20261015
+<STMTTRN><TRNTYPE>DEBIT<DTPOSTED>20261003120000[-3:UYT]<TRNAMT>-1500,50<FITID>A1<NAME>UTE<MEMO>Factura &amp; cargo</STMTTRN>
+<STMTTRN><TRNTYPE>CREDIT<DTPOSTED>20261005<TRNAMT>80000.00<FITID>A2<NAME>Sueldo</STMTTRN>
+</BANKTRANLIST>
+<LEDGERBAL><BALAMT>98499.50<DTASOF>20261015</LEDGERBAL>
+</STMTRS></STMTTRNRS></BANKMSGSRSV1>
+</OFX>
+`
+	statements, format, err := ParseStatement([]byte(sgml))
+	if err != nil || format != "OFX" || len(statements) != 1 {
+		t.Fatalf("unexpected OFX 1 result %v %v %v", statements, format, err)
+	}
+	s := statements[0]
+	if s.Currency != "$" || s.Number != "001-234567" || s.Bank != "OFX" || len(s.Transactions) != 2 {
+		t.Fatalf("unexpected statement %+v", s)
+	}
+	if tx := s.Transactions[0]; tx.Debit != 1500.5 || tx.Reference != "A1" || tx.Description != "UTE Factura & cargo" || tx.Date.Format("2006-01-02") != "2026-10-03" {
+		t.Errorf("unexpected transaction %+v", tx)
+	}
+	if tx := s.Transactions[1]; tx.Credit != 80000 || tx.Currency != "$" {
+		t.Errorf("unexpected transaction %+v", tx)
+	}
+	if len(s.EndBalances) != 1 || s.EndBalances[0] != (Amount{Currency: "$", Value: 98499.5}) {
+		t.Errorf("unexpected end balances %v", s.EndBalances)
+	}
+	if s.StartDate.Format("2006-01-02") != "2026-10-01" || s.EndDate.Format("2006-01-02") != "2026-10-15" {
+		t.Errorf("unexpected period %v %v", s.StartDate, s.EndDate)
+	}
+
+	xml := `<?xml version="1.0" encoding="UTF-8"?>
+<?OFX OFXHEADER="200" VERSION="220" SECURITY="NONE" OLDFILEUID="NONE" NEWFILEUID="NONE"?>
+<OFX>
+  <CREDITCARDMSGSRSV1><CCSTMTTRNRS><CCSTMTRS>
+    <CURDEF>USD</CURDEF>
+    <CCACCTFROM><ACCTID>4111</ACCTID></CCACCTFROM>
+    <BANKTRANLIST>
+      <STMTTRN><TRNTYPE>DEBIT</TRNTYPE><DTPOSTED>20261004</DTPOSTED><TRNAMT>-10.99</TRNAMT><FITID>B1</FITID><NAME>SPOTIFY</NAME><MEMO></MEMO></STMTTRN>
+    </BANKTRANLIST>
+    <LEDGERBAL><BALAMT>-10.99</BALAMT><DTASOF>20261015</DTASOF></LEDGERBAL>
+  </CCSTMTRS></CCSTMTTRNRS></CREDITCARDMSGSRSV1>
+</OFX>
+`
+	statements, format, err = ParseStatement([]byte(xml))
+	if err != nil || format != "OFX" || len(statements) != 1 {
+		t.Fatalf("unexpected OFX 2 result %v %v %v", statements, format, err)
+	}
+	s = statements[0]
+	if s.Currency != "US$" || s.Number != "4111" || len(s.Transactions) != 1 || s.Transactions[0].Debit != 10.99 || s.Transactions[0].Description != "SPOTIFY" {
+		t.Errorf("unexpected statement %+v", s)
+	}
+	if len(s.EndBalances) != 1 || s.EndBalances[0].Value != -10.99 {
+		t.Errorf("unexpected end balances %v", s.EndBalances)
+	}
+}
+
+func TestCSVProfile(t *testing.T) {
+	profile := CSVProfile{
+		Name:       "Santander",
+		Delimiter:  ";",
+		Encoding:   "latin1",
+		SkipRows:   2,
+		Header:     true,
+		Columns:    CSVColumns{Date: "Fecha", Description: "Concepto", Amount: "Importe", Currency: "Moneda", Balance: "Saldo", Reference: "2"},
+		DateFormat: "DD/MM/YYYY",
+		Decimal:    ",",
+	}
+	// Latin-1, newest first.
+	data := []byte("Movimientos de cuenta\n\nFecha;Nro;Concepto;Moneda;Importe;Saldo\n" +
+		"05/10/2026;3;Compra D\xf3lares;USD;-10,50;89,50\n" +
+		"04/10/2026;2;Sueldo;UYU;80.000,00;81.500,00\n" +
+		"03/10/2026;1;UTE;UYU;-1.500,00;1.500,00\n" +
+		"Total;;;;;\n")
+	statements, err := profile.Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statements) != 2 || statements[0].Currency != "$" || statements[1].Currency != "US$" {
+		t.Fatalf("unexpected statements %+v", statements)
+	}
+	pesos := statements[0]
+	if len(pesos.Transactions) != 2 || pesos.Bank != "Santander" || pesos.Transactions[0].Debit != 1500 || pesos.Transactions[0].Reference != "1" || pesos.Transactions[1].Credit != 80000 {
+		t.Errorf("unexpected transactions %+v", pesos.Transactions)
+	}
+	if pesos.StartBalances[0].Value != 3000 || pesos.EndBalances[0].Value != 81500 {
+		t.Errorf("unexpected balances %v %v", pesos.StartBalances, pesos.EndBalances)
+	}
+	if tx := statements[1].Transactions[0]; tx.Description != "Compra Dólares" || tx.Debit != 10.5 || tx.Date.Format("2006-01-02") != "2026-10-05" {
+		t.Errorf("unexpected transaction %+v", tx)
+	}
+
+	profile = CSVProfile{Name: "Plain", Columns: CSVColumns{Date: "1", Description: "2", Debit: "3", Credit: "4"}, DateFormat: "YYYY-MM-DD", Currency: "US$"}
+	statements, err = profile.Parse([]byte("2026-10-01,Fee,-2.5,\n2026-10-02,Transfer,,\"1,000.00\"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txs := statements[0].Transactions; len(statements) != 1 || len(txs) != 2 || txs[0].Debit != 2.5 || txs[1].Credit != 1000 || txs[1].Currency != "US$" {
+		t.Errorf("unexpected statements %+v", statements[0])
+	}
+
+	profile.Columns.Date = "Fecha"
+	if _, err := profile.Parse([]byte("2026-10-01,Fee,1,\n")); err == nil {
+		t.Errorf("expected an error for a column name without a header")
+	}
+}
+
+// makeXLSX builds a one sheet workbook. Cells are strings, or numbers if
+// they start with "=", or dates if they start with "#".
+func makeXLSX(t *testing.T, rows [][]string) []byte {
+	var sheet strings.Builder
+	for i, row := range rows {
+		fmt.Fprintf(&sheet, `<row r="%d">`, i+1)
+		for j, cell := range row {
+			ref := fmt.Sprintf("%c%d", 'A'+j, i+1)
+			switch {
+			case cell == "":
+			case strings.HasPrefix(cell, "="):
+				fmt.Fprintf(&sheet, `<c r="%s"><v>%s</v></c>`, ref, cell[1:])
+			case strings.HasPrefix(cell, "#"):
+				fmt.Fprintf(&sheet, `<c r="%s" s="1"><v>%s</v></c>`, ref, cell[1:])
+			default:
+				fmt.Fprintf(&sheet, `<c r="%s" t="inlineStr"><is><t>%s</t></is></c>`, ref, cell)
+			}
+		}
+		sheet.WriteString(`</row>`)
+	}
+	return makeXLSXSheet(t, sheet.String())
+}
+
+// makeXLSXSheet builds a one sheet workbook with the given sheetData.
+func makeXLSXSheet(t *testing.T, sheetData string) []byte {
+	parts := map[string]string{
+		"xl/workbook.xml": `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+			`<sheets><sheet name="Hoja1" sheetId="1" r:id="rId1"/></sheets></workbook>`,
+		"xl/_rels/workbook.xml.rels": `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`,
+		"xl/styles.xml": `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><numFmts count="1"><numFmt numFmtId="164" formatCode="dd/mm/yyyy"/></numFmts>` +
+			`<cellXfs count="2"><xf numFmtId="0"/><xf numFmtId="164"/></cellXfs></styleSheet>`,
+		"xl/worksheets/sheet1.xml": `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>` + sheetData + `</sheetData></worksheet>`,
+	}
+	var b bytes.Buffer
+	archive := zip.NewWriter(&b)
+	for name, content := range parts {
+		w, err := archive.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestParseXLSXStatements(t *testing.T) {
+	brou := makeXLSX(t, [][]string{
+		{"Banco de la República Oriental del Uruguay"},
+		{"Cuenta", "001-234567"},
+		{"Moneda: U$S"},
+		{},
+		{"Fecha", "Descripción", "Asunto", "Débito", "Crédito"},
+		{"#46296", "COMPRA", "123", "=10.5", ""},
+		{"03/10/2026", "TRANSFERENCIA", "", "", "1.000,00"},
+		{"Total"},
+	})
+	statements, format, err := ParseStatement(brou)
+	if err != nil || format != "BROU" {
+		t.Fatalf("unexpected BROU result %v %v", format, err)
+	}
+	s := statements[0]
+	if s.Currency != "US$" || s.Number != "001-234567" || len(s.Transactions) != 2 {
+		t.Fatalf("unexpected statement %+v", s)
+	}
+	if tx := s.Transactions[0]; tx.Date.Format("2006-01-02") != "2026-10-01" || tx.Debit != 10.5 || tx.Reference != "123" {
+		t.Errorf("unexpected transaction %+v", tx)
+	}
+	if tx := s.Transactions[1]; tx.Credit != 1000 || tx.Description != "TRANSFERENCIA" {
+		t.Errorf("unexpected transaction %+v", tx)
+	}
+
+	itau := makeXLSX(t, [][]string{
+		{"Itaú"},
+		{"Moneda"},
+		{"Pesos"},
+		{"Fecha", "Concepto", "Débito", "Crédito", "Saldo"},
+		{"01/10/2026", "SALDO ANTERIOR", "", "", "=100"},
+		{"#46298", "UTE", "=40", "", "=60"},
+		{"SALDO FINAL"},
+	})
+	statements, format, err = ParseStatement(itau)
+	if err != nil || format != "Itau" {
+		t.Fatalf("unexpected Itau result %v %v", format, err)
+	}
+	if s := statements[0]; s.Currency != "$" || len(s.Transactions) != 1 || s.Transactions[0].Debit != 40 || s.Transactions[0].Balance != 60 || s.Transactions[0].Date.Format("2006-01-02") != "2026-10-03" {
+		t.Errorf("unexpected statement %+v", s)
+	}
+}
+
+func TestReadXLSXOversized(t *testing.T) {
+	for _, sheetData := range []string{
+		`<row r="2000000000"><c r="A2000000000" t="inlineStr"><is><t>x</t></is></c></row>`,
+		`<row r="1"><c r="ZZZZZZ1" t="inlineStr"><is><t>x</t></is></c></row>`,
+		`<row r="1"><c r="ZZZZZZZZZZZZZZZZZZZZ1"><v>1</v></c></row>`,
+	} {
+		if _, err := ReadSpreadsheet(makeXLSXSheet(t, sheetData)); err == nil {
+			t.Errorf("read oversized sheet %v", sheetData)
+		}
+	}
+	data := makeXLSXSheet(t, `<row r="1048576"><c r="XFD1048576"><v>1</v></c></row>`)
+	if sheets, err := ReadSpreadsheet(data); err != nil || len(sheets[0]) != xlsxMaxRows || len(sheets[0][xlsxMaxRows-1]) != xlsxMaxColumns {
+		t.Errorf("last cell of a sheet not read: %v", err)
+	}
+	if _, _, err := ParseStatement(makeXLSXSheet(t, `<row r="2000000000"><c r="A1"><v>1</v></c></row>`)); err == nil {
+		t.Errorf("oversized statement accepted")
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// budgetMonths is how many months the budget page shows by default,
+// including the current one.
+const budgetMonths = 3
+
+// budgetMaxMonths is the most months the budget page shows.
+const budgetMaxMonths = 36
+
+// periodsPerMonth converts the period of a periodic transaction to a
+// monthly factor, e.g. a weekly budget is spent 52/12 times a month.
+var periodsPerMonth = []struct {
+	prefix string
+	factor float64
+}{
+	{"daily", 365.0 / 12},
+	{"every day", 365.0 / 12},
+	{"weekly", 52.0 / 12},
+	{"every week", 52.0 / 12},
+	{"biweekly", 26.0 / 12},
+	{"every 2 weeks", 26.0 / 12},
+	{"monthly", 1},
+	{"every month", 1},
+	{"bimonthly", 1.0 / 2},
+	{"every 2 months", 1.0 / 2},
+	{"quarterly", 1.0 / 3},
+	{"every quarter", 1.0 / 3},
+	{"yearly", 1.0 / 12},
+	{"annually", 1.0 / 12},
+	{"every year", 1.0 / 12},
+}
+
+// Budgets returns the monthly budget of each account. They are read from
+// the periodic transactions of the journal ("~ Monthly"), whose postings
+// with an amount are the budgets, and from the Budget of the ledger
+// definition, which takes precedence.
+func Budgets(journal *Journal, def LedgerDef) map[string]Amount {
+	budgets := map[string]Amount{}
+	add := func(account string, amount Amount) {
+		if current, ok := budgets[account]; ok && current.Currency != amount.Currency {
+			Log("Budget of %v mixes %v and %v, ignoring the %v", account, current.Currency, amount.Currency, amount.Currency)
+			return
+		}
+		current := budgets[account]
+		budgets[account] = Amount{Currency: amount.Currency, Value: current.Value + amount.Value}
+	}
+	for _, periodic := range journal.Periodic {
+		factor, ok := monthlyFactor(periodic.Period)
+		if !ok {
+			Log("Unsupported budget period %q", periodic.Period)
+			continue
+		}
+		for _, p := range periodic.Postings {
+			if p.Amount == nil || p.Inferred {
+				continue
+			}
+			add(p.Account, Amount{Currency: p.Amount.Currency, Value: p.Amount.Value * factor})
+		}
+	}
+	for account, text := range def.Budget {
+		amount, err := ParseAmount(text)
+		if err != nil {
+			Log("Invalid budget for %v: %v", account, err)
+			continue
+		}
+		budgets[account] = amount
+	}
+	return budgets
+}
+
+func monthlyFactor(period string) (float64, bool) {
+	period = strings.ToLower(strings.Join(strings.Fields(period), " "))
+	for _, p := range periodsPerMonth {
+		if strings.HasPrefix(period, p.prefix) {
+			return p.factor, true
+		}
+	}
+	return 0, false
+}
+
+// BudgetRow compares the budget of an account with what was spent in it
+// and its subaccounts during a month. Amounts in other commodities are
+// converted to the commodity of the budget at the price of their date.
+type BudgetRow struct {
+	Account   string
+	Budget    Amount
+	Actual    Amount
+	Remaining Amount
+	Percent   float64 // of the budget used
+	Over      bool
+}
+
+// BudgetMonth is the budget report of one month.
+type BudgetMonth struct {
+	Month time.Time
+	Rows  []BudgetRow
+}
+
+// accountTreeQuery matches the postings of an account and its subaccounts.
+type accountTreeQuery string
+
+func (q accountTreeQuery) Match(tx *Transaction, p *Posting) bool {
+	return p.Account == string(q) || strings.HasPrefix(p.Account, string(q)+":")
+}
+
+// BudgetReport compares the budgets with the actual amounts of the month
+// starting at month.
+func BudgetReport(journal *Journal, budgets map[string]Amount, month time.Time) BudgetMonth {
+	prices := NewPriceHistory(journal)
+	report := BudgetMonth{Month: month}
+	accounts := []string{}
+	for account := range budgets {
+		accounts = append(accounts, account)
+	}
+	sort.Strings(accounts)
+	for _, account := range accounts {
+		budget := budgets[account]
+		actual := Amount{Currency: budget.Currency}
+		opts := ReportOptions{Query: accountTreeQuery(account), Begin: month, End: month.AddDate(0, 1, 0)}
+		forEachReportPosting(journal, opts, func(tx *Transaction, p *Posting) {
+			if amount := prices.Convert(*p.Amount, budget.Currency, tx.Date); amount.Currency == budget.Currency {
+				actual.Value += amount.Value
+			}
+		})
+		row := BudgetRow{
+			Account:   account,
+			Budget:    budget,
+			Actual:    actual,
+			Remaining: Amount{Currency: budget.Currency, Value: budget.Value - actual.Value},
+			Over:      actual.Value > budget.Value+journal.tolerance(budget.Currency),
+		}
+		if budget.Value != 0 {
+			row.Percent = actual.Value / budget.Value * 100
+		}
+		report.Rows = append(report.Rows, row)
+	}
+	return report
+}
+
+// BudgetRowView is a BudgetRow with its amounts formatted for the page.
+type BudgetRowView struct {
+	Account   string
+	Budget    string
+	Actual    string
+	Remaining string
+	Percent   float64
+	Over      bool
+}
+
+// BudgetMonthView is a BudgetMonth formatted for the page.
+type BudgetMonthView struct {
+	Label string // e.g. "October 2026"
+	Rows  []BudgetRowView
+}
+
+// budgetData fills the budget page with the current month and the months
+// before it, newest first.
+func budgetData(months int) func(data map[string]interface{}) {
+	return func(data map[string]interface{}) {
+		ledger := data["ledger"].(string)
+		journal := LedgerJournal(ledger)
+		budgets := Budgets(journal, ledgers[ledger])
+		now := time.Now()
+		month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		views := []BudgetMonthView{}
+		for i := 0; i < months && len(budgets) > 0; i++ {
+			report := BudgetReport(journal, budgets, month.AddDate(0, -i, 0))
+			view := BudgetMonthView{Label: report.Month.Format("January 2006")}
+			for _, row := range report.Rows {
+				view.Rows = append(view.Rows, BudgetRowView{
+					Account:   row.Account,
+					Budget:    journal.FormatAmount(row.Budget),
+					Actual:    journal.FormatAmount(row.Actual),
+					Remaining: journal.FormatAmount(row.Remaining),
+					Percent:   row.Percent,
+					Over:      row.Over,
+				})
+			}
+			views = append(views, view)
+		}
+		data["months"] = views
+		data["monthCount"] = months
+		data["moreMonths"] = months < budgetMaxMonths
+	}
+}
+
+func handleBudget(w http.ResponseWriter, r *http.Request) {
+	months, err := strconv.Atoi(r.FormValue("months"))
+	if err != nil || months < 1 {
+		months = budgetMonths
+	}
+	months = min(months, budgetMaxMonths)
+	handleWithTemplateAndData("budget", budgetData(months))(w, r)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// TransactionChange is a transaction added, removed or edited between two
+// versions of a journal. Old is nil for additions and New for removals.
+type TransactionChange struct {
+	Kind string // "add", "remove" or "edit"
+	Old  *Transaction
+	New  *Transaction
+}
+
+// Transaction returns the current version of the changed transaction, or
+// the removed one.
+func (c TransactionChange) Transaction() *Transaction {
+	if c.New != nil {
+		return c.New
+	}
+	return c.Old
+}
+
+// DiffJournals compares the transactions written in the main file of two
+// versions of a journal. Transactions whose text is unchanged are the same
+// even if they moved; a removed and an added transaction with the same date
+// and payee, or else the same date, are an edit.
+func DiffJournals(old *Journal, new *Journal) []TransactionChange {
+	oldText := transactionTexts(old)
+	newText := transactionTexts(new)
+
+	unmatched := map[string]int{}
+	for _, t := range oldText {
+		unmatched[t.text]++
+	}
+	added := []*Transaction{}
+	for _, t := range newText {
+		if unmatched[t.text] > 0 {
+			unmatched[t.text]--
+		} else {
+			added = append(added, t.tx)
+		}
+	}
+	removed := []*Transaction{}
+	for _, t := range oldText {
+		if unmatched[t.text] > 0 {
+			unmatched[t.text]--
+			removed = append(removed, t.tx)
+		}
+	}
+
+	changes := []TransactionChange{}
+	paired := map[*Transaction]bool{}
+	for _, same := range []func(a, b *Transaction) bool{
+		func(a, b *Transaction) bool { return a.Date.Equal(b.Date) && a.Payee == b.Payee },
+		func(a, b *Transaction) bool { return a.Date.Equal(b.Date) },
+	} {
+		for _, a := range added {
+			if paired[a] {
+				continue
+			}
+			for _, r := range removed {
+				if !paired[r] && same(r, a) {
+					paired[a], paired[r] = true, true
+					changes = append(changes, TransactionChange{Kind: "edit", Old: r, New: a})
+					break
+				}
+			}
+		}
+	}
+	for _, a := range added {
+		if !paired[a] {
+			changes = append(changes, TransactionChange{Kind: "add", New: a})
+		}
+	}
+	for _, r := range removed {
+		if !paired[r] {
+			changes = append(changes, TransactionChange{Kind: "remove", Old: r})
+		}
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Transaction().Date.Before(changes[j].Transaction().Date)
+	})
+	return changes
+}
+
+type transactionText struct {
+	tx   *Transaction
+	text string
+}
+
+func transactionTexts(journal *Journal) []transactionText {
+	texts := []transactionText{}
+	if journal == nil || len(journal.Files) == 0 {
+		return texts
+	}
+	for _, tx := range journal.Transactions {
+		if tx.Span.File != journal.Files[0] {
+			continue
+		}
+		lines := strings.Split(strings.TrimSpace(journal.Text(tx.Span)), "\n")
+		for i, line := range lines {
+			lines[i] = strings.Join(strings.Fields(line), " ")
+		}
+		texts = append(texts, transactionText{tx, strings.Join(lines, "\n")})
+	}
+	return texts
+}
+
+// ChangeSummary describes transaction changes in one line, e.g. "Add 3
+// transactions (2026-10-01..2026-10-05): UTE, Antel, Spotify" or "Edit
+// transaction 2026-09-12 Cultocafe".
+func ChangeSummary(changes []TransactionChange) string {
+	parts := []string{}
+	for _, kind := range []string{"add", "edit", "remove"} {
+		txs := []*Transaction{}
+		for _, change := range changes {
+			if change.Kind == kind {
+				txs = append(txs, change.Transaction())
+			}
+		}
+		if len(txs) == 1 {
+			parts = append(parts, fmt.Sprintf("%v transaction %v %v", kind, txs[0].Date.Format("2006-01-02"), txs[0].Payee))
+		} else if len(txs) > 1 {
+			parts = append(parts, fmt.Sprintf("%v %d transactions (%v): %v", kind, len(txs), dateRange(txs), payeeList(txs)))
+		}
+	}
+	if len(parts) == 0 {
+		return "Edit comments and directives"
+	}
+	summary := strings.Join(parts, "; ")
+	return strings.ToUpper(summary[:1]) + summary[1:]
+}
+
+func dateRange(txs []*Transaction) string {
+	first, last := txs[0].Date, txs[0].Date
+	for _, tx := range txs {
+		if tx.Date.Before(first) {
+			first = tx.Date
+		}
+		if tx.Date.After(last) {
+			last = tx.Date
+		}
+	}
+	if first.Equal(last) {
+		return first.Format("2006-01-02")
+	}
+	return first.Format("2006-01-02") + ".." + last.Format("2006-01-02")
+}
+
+// payeeList lists the distinct payees, up to five.
+func payeeList(txs []*Transaction) string {
+	payees := []string{}
+	seen := map[string]bool{}
+	for _, tx := range txs {
+		if !seen[tx.Payee] {
+			seen[tx.Payee] = true
+			payees = append(payees, tx.Payee)
+		}
+	}
+	if len(payees) > 5 {
+		return strings.Join(payees[:5], ", ") + fmt.Sprintf(" and %d more", len(payees)-5)
+	}
+	return strings.Join(payees, ", ")
+}
+
+// CommitMessage is the message for a change to a ledger file: the user's
+// message, if any, followed by the generated summary.
+func CommitMessage(message string, changes []TransactionChange) string {
+	summary := ChangeSummary(changes)
+	message = strings.TrimSpace(message)
+	if message == "" {
+		return summary
+	}
+	return message + "\n\n" + summary
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"html/template"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// chartMonths is how many months the charts cover by default, including
+// the current one.
+const chartMonths = 12
+
+// ChartSeries is one line of a chart: a value per month in one commodity.
+type ChartSeries struct {
+	Name      string    `json:"name"`
+	Commodity string    `json:"commodity"`
+	Values    []float64 `json:"values"`
+}
+
+// Chart is a set of monthly series.
+type Chart struct {
+	Name   string        `json:"name"`
+	Title  string        `json:"title"`
+	Months []string      `json:"months"` // "2026-10"
+	Series []ChartSeries `json:"series"`
+}
+
+// SeriesOptions selects the postings of a monthly series and how they are
+// added up.
+type SeriesOptions struct {
+	Query      PostingQuery
+	Group      func(p *Posting) string // name of the series of a posting
+	Exchange   string                  // commodity to convert to, at the posting date
+	Cumulative bool                    // running balance instead of monthly change
+	Scale      float64                 // multiplies every amount, 0 means 1
+}
+
+// MonthlySeries adds up the postings selected by the options per month,
+// starting with the month of first, and per series name and commodity.
+func MonthlySeries(journal *Journal, first time.Time, months int, opts SeriesOptions) []ChartSeries {
+	first = time.Date(first.Year(), first.Month(), 1, 0, 0, 0, 0, time.UTC)
+	end := first.AddDate(0, months, 0)
+	scale := opts.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	prices := NewPriceHistory(journal)
+
+	series := map[[2]string]*ChartSeries{}
+	report := ReportOptions{Query: opts.Query, End: end}
+	if !opts.Cumulative {
+		report.Begin = first
+	}
+	forEachReportPosting(journal, report, func(tx *Transaction, p *Posting) {
+		amount := *p.Amount
+		if opts.Exchange != "" {
+			amount = prices.Convert(amount, opts.Exchange, tx.Date)
+		}
+		key := [2]string{opts.Group(p), amount.Currency}
+		s, ok := series[key]
+		if !ok {
+			s = &ChartSeries{Name: key[0], Commodity: key[1], Values: make([]float64, months)}
+			series[key] = s
+		}
+		i := 0
+		if !tx.Date.Before(first) {
+			i = (tx.Date.Year()-first.Year())*12 + int(tx.Date.Month()-first.Month())
+		}
+		s.Values[i] += amount.Value * scale
+	})
+
+	list := []ChartSeries{}
+	for _, s := range series {
+		for i := range s.Values {
+			if opts.Cumulative && i > 0 {
+				s.Values[i] += s.Values[i-1]
+			}
+		}
+		p := math.Pow(10, float64(journal.Precision(s.Commodity)))
+		for i := range s.Values {
+			s.Values[i] = math.Round(s.Values[i]*p) / p
+		}
+		list = append(list, *s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].Commodity < list[j].Commodity
+	})
+	return list
+}
+
+// Charts computes the standard charts of a journal for the months ending
+// with the month of last: income, expenses per top-level category, both
+// converted to exchange if set, and net worth per commodity.
+func Charts(journal *Journal, last time.Time, months int, exchange string) []Chart {
+	first := time.Date(last.Year(), last.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, 1-months, 0)
+	labels := []string{}
+	for i := 0; i < months; i++ {
+		labels = append(labels, first.AddDate(0, i, 0).Format("2006-01"))
+	}
+	query := func(terms ...string) PostingQuery {
+		q, _ := CompilePostingQuery(terms)
+		return q
+	}
+	charts := []Chart{
+		{Name: "income", Title: "Income", Series: MonthlySeries(journal, first, months, SeriesOptions{
+			Query:    query("^income"),
+			Group:    func(p *Posting) string { return "Income" },
+			Exchange: exchange,
+			Scale:    -1,
+		})},
+		{Name: "expenses", Title: "Expenses", Series: MonthlySeries(journal, first, months, SeriesOptions{
+			Query:    query("^expenses"),
+			Group:    func(p *Posting) string { return truncateAccount(p.Account, 2) },
+			Exchange: exchange,
+		})},
+		{Name: "networth", Title: "Net worth", Series: MonthlySeries(journal, first, months, SeriesOptions{
+			Query:      query("^assets", "^liabilities"),
+			Group:      func(p *Posting) string { return "Net worth" },
+			Cumulative: true,
+		})},
+	}
+	for i := range charts {
+		charts[i].Months = labels
+	}
+	return charts
+}
+
+// chartParams reads the months and exchange parameters of a chart request.
+func chartParams(r *http.Request) (int, string) {
+	months, err := strconv.Atoi(r.FormValue("months"))
+	if err != nil || months < 1 || months > 120 {
+		months = chartMonths
+	}
+	return months, r.FormValue("exchange")
+}
+
+func handleReportsJSON(w http.ResponseWriter, r *http.Request) {
+	ledger := mux.Vars(r)["ledger"]
+	months, exchange := chartParams(r)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(Charts(LedgerJournal(ledger), time.Now(), months, exchange))
+}
+
+// chartColors are the colors of the series of a chart, in order.
+var chartColors = []string{"#1f77b4", "#ff7f0e", "#2ca02c", "#d62728", "#9467bd", "#8c564b", "#e377c2", "#7f7f7f", "#bcbd22", "#17becf"}
+
+// ChartView is a chart drawn for one commodity, as its series do not share
+// a scale otherwise.
+type ChartView struct {
+	Title  string
+	SVG    template.HTML
+	Legend []LegendEntry
+}
+
+// LegendEntry names the series drawn in a color.
+type LegendEntry struct {
+	Name  string
+	Color string
+}
+
+const (
+	chartWidth  = 720
+	chartHeight = 240
+	chartLeft   = 100 // room for the axis labels
+	chartBottom = 24
+	chartTop    = 10
+	chartRight  = 10
+)
+
+// ChartViews draws a chart as line charts, one per commodity.
+func ChartViews(chart Chart) []ChartView {
+	commodities := []string{}
+	byCommodity := map[string][]ChartSeries{}
+	for _, s := range chart.Series {
+		if _, ok := byCommodity[s.Commodity]; !ok {
+			commodities = append(commodities, s.Commodity)
+		}
+		byCommodity[s.Commodity] = append(byCommodity[s.Commodity], s)
+	}
+	sort.Strings(commodities)
+	views := []ChartView{}
+	for _, commodity := range commodities {
+		series := byCommodity[commodity]
+		view := ChartView{Title: chart.Title, SVG: drawLineChart(chart.Months, series)}
+		if len(commodities) > 1 {
+			view.Title += " (" + commodity + ")"
+		}
+		for i, s := range series {
+			view.Legend = append(view.Legend, LegendEntry{Name: s.Name, Color: chartColors[i%len(chartColors)]})
+		}
+		views = append(views, view)
+	}
+	return views
+}
+
+// drawLineChart draws series sharing a commodity as an SVG line chart.
+func drawLineChart(months []string, series []ChartSeries) template.HTML {
+	low, high := 0.0, 0.0
+	for _, s := range series {
+		for _, v := range s.Values {
+			low, high = math.Min(low, v), math.Max(high, v)
+		}
+	}
+	step := niceStep((high - low) / 4)
+	low, high = math.Floor(low/step)*step, math.Ceil(high/step)*step
+	if high == low {
+		high = low + step
+	}
+
+	plotWidth := float64(chartWidth - chartLeft - chartRight)
+	plotHeight := float64(chartHeight - chartTop - chartBottom)
+	x := func(i int) float64 {
+		if len(months) < 2 {
+			return chartLeft + plotWidth/2
+		}
+		return chartLeft + plotWidth*float64(i)/float64(len(months)-1)
+	}
+	y := func(v float64) float64 {
+		return chartTop + plotHeight*(high-v)/(high-low)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg class="chart" viewBox="0 0 %d %d" width="100%%" xmlns="http://www.w3.org/2000/svg">`, chartWidth, chartHeight)
+	commodity := series[0].Commodity
+	for v := low; v <= high+step/2; v += step {
+		fmt.Fprintf(&b, `<line class="grid" x1="%d" y1="%.1f" x2="%d" y2="%.1f"/>`, chartLeft, y(v), chartWidth-chartRight, y(v))
+		fmt.Fprintf(&b, `<text class="axis" x="%d" y="%.1f" text-anchor="end">%s</text>`, chartLeft-6, y(v)+4, html.EscapeString(formatTick(commodity, v)))
+	}
+	every := (len(months) + 11) / 12
+	for i, month := range months {
+		if i%every != 0 {
+			continue
+		}
+		if date, err := time.Parse("2006-01", month); err == nil {
+			month = date.Format("Jan 06")
+		}
+		fmt.Fprintf(&b, `<text class="axis" x="%.1f" y="%d" text-anchor="middle">%s</text>`, x(i), chartHeight-6, month)
+	}
+	for i, s := range series {
+		points := []string{}
+		for j, v := range s.Values {
+			points = append(points, fmt.Sprintf("%.1f,%.1f", x(j), y(v)))
+		}
+		color := chartColors[i%len(chartColors)]
+		fmt.Fprintf(&b, `<polyline fill="none" stroke="%s" stroke-width="2" points="%s"><title>%s</title></polyline>`, color, strings.Join(points, " "), html.EscapeString(s.Name))
+		for j, v := range s.Values {
+			fmt.Fprintf(&b, `<circle cx="%.1f" cy="%.1f" r="3" fill="%s"><title>%s %s: %s</title></circle>`, x(j), y(v), color, html.EscapeString(s.Name), months[j], html.EscapeString(formatTick(commodity, v)))
+		}
+	}
+	b.WriteString(`</svg>`)
+	return template.HTML(b.String())
+}
+
+// niceStep rounds a step between axis ticks up to 1, 2 or 5 times a power
+// of ten.
+func niceStep(step float64) float64 {
+	if step <= 0 {
+		return 1
+	}
+	power := math.Pow(10, math.Floor(math.Log10(step)))
+	for _, m := range []float64{1, 2, 5} {
+		if step <= m*power {
+			return m * power
+		}
+	}
+	return 10 * power
+}
+
+// formatTick prints an axis value without decimals, e.g. "$ -12,000".
+func formatTick(commodity string, v float64) string {
+	sign := ""
+	if v < 0 {
+		sign = "-"
+	}
+	return commodity + " " + sign + groupThousands(strconv.FormatFloat(math.Abs(math.Round(v)), 'f', 0, 64))
+}
+
+func handleReports(w http.ResponseWriter, r *http.Request) {
+	months, exchange := chartParams(r)
+	handleWithTemplateAndData("reports", func(data map[string]interface{}) {
+		views := []ChartView{}
+		for _, chart := range Charts(LedgerJournal(data["ledger"].(string)), time.Now(), months, exchange) {
+			views = append(views, ChartViews(chart)...)
+		}
+		data["charts"] = views
+		data["months"] = months
+		data["exchange"] = exchange
+	})(w, r)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+const oauthStateCookieName = "oauth_state"
+const loginCSRFCookieName = "login_csrf"
+const csrfFieldName = "csrf_token"
+const csrfHeaderName = "X-CSRF-Token"
+
+// redirectToLogin starts the login flow of the auth provider.
+func redirectToLogin(w http.ResponseWriter, r *http.Request) {
+	authProvider.Login(w, r, newLoginState(w))
+}
+
+// newLoginState returns a fresh random state for a login attempt. It is
+// also kept in a short-lived cookie so authCallback can check it.
+func newLoginState(w http.ResponseWriter) string {
+	state := randomToken()
+	c := http.Cookie{
+		Name:     oauthStateCookieName,
+		Value:    state,
+		Path:     sessionCookiePath(),
+		MaxAge:   10 * 60,
+		HttpOnly: true,
+		Secure:   !isLocalEnvironment(),
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(w, &c)
+	return state
+}
+
+// validOAuthState reports whether the callback's state matches the one the
+// login started with, and forgets it.
+func validOAuthState(w http.ResponseWriter, r *http.Request) bool {
+	cookie, err := r.Cookie(oauthStateCookieName)
+	http.SetCookie(w, &http.Cookie{Name: oauthStateCookieName, Value: "", Path: sessionCookiePath(), MaxAge: -1})
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(r.FormValue("state"))) == 1
+}
+
+// newLoginCSRFToken returns a CSRF token for a login form, before there is
+// a session to keep it in. It is kept in a cookie and checked by
+// validLoginCSRF, so other sites cannot log users in as someone else.
+func newLoginCSRFToken(w http.ResponseWriter) string {
+	token := randomToken()
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCSRFCookieName,
+		Value:    token,
+		Path:     sessionCookiePath(),
+		MaxAge:   10 * 60,
+		HttpOnly: true,
+		Secure:   !isLocalEnvironment(),
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token
+}
+
+// validLoginCSRF reports whether a login form post carries the token of
+// its form, and forgets it.
+func validLoginCSRF(w http.ResponseWriter, r *http.Request) bool {
+	cookie, err := r.Cookie(loginCSRFCookieName)
+	http.SetCookie(w, &http.Cookie{Name: loginCSRFCookieName, Value: "", Path: sessionCookiePath(), MaxAge: -1})
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(r.FormValue(csrfFieldName))) == 1
+}
+
+// checkCSRF rejects a mutating request unless it carries the session's CSRF
+// token, either as the csrf_token form field or the X-CSRF-Token header.
+func checkCSRF(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		expected := GetSession(r).CSRFToken
+		token := r.Header.Get(csrfHeaderName)
+		if token == "" {
+			token = r.FormValue(csrfFieldName)
+		}
+		if expected == "" || subtle.ConstantTimeCompare([]byte(token), []byte(expected)) != 1 {
+			Log("CSRF token mismatch on %v %v", r.Method, r.URL.Path)
+			http.Error(w, "Invalid or missing CSRF token", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
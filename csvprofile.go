@@ -0,0 +1,538 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// CSVProfile describes the CSV statements of a bank, e.g.
+//
+//	{"Name": "Santander", "Delimiter": ";", "SkipRows": 3, "Header": true,
+//	 "Columns": {"Date": "Fecha", "Description": "Concepto", "Amount": "Importe",
+//	 "Currency": "Moneda", "Balance": "Saldo"}, "DateFormat": "DD/MM/YYYY",
+//	 "Decimal": ","}
+//
+// The statements read with a profile have the profile name as their Bank,
+// to map them with LedgerDef.BankAccounts.
+type CSVProfile struct {
+	Name       string
+	Delimiter  string // ",", ";", "\t" or "|"; empty to detect it
+	Encoding   string // "utf-8", the default, or "latin1"
+	SkipRows   int    // lines before the header or the first row
+	Header     bool   // whether the first row names the columns
+	Columns    CSVColumns
+	DateFormat string // e.g. "DD/MM/YYYY" or "YYYY-MM-DD"; empty to detect it
+	Decimal    string // "." or ","; empty to detect it
+	Currency   string // currency of the rows, if there is no Currency column; "$" by default
+}
+
+// CSVColumns are the columns of a CSV profile, each by its 1-based index or
+// its name in the header. Either Amount, signed and positive for credits, or
+// Debit and Credit are required.
+type CSVColumns struct {
+	Date        string
+	Description string
+	Amount      string
+	Debit       string
+	Credit      string
+	Currency    string // currency of each row
+	Balance     string // balance after each row
+	Reference   string
+}
+
+// csvProfilesFile holds the profiles created from the reconcile page. It is
+// read from the directory of the ledger file, like dashboard.json.
+const csvProfilesFile = "csv_profiles.json"
+
+// CSVProfiles returns the CSV profiles of a ledger: those of ledgers.json
+// and those of its csv_profiles.json, which win if the names clash.
+func CSVProfiles(ledger string) []CSVProfile {
+	profiles := []CSVProfile{}
+	saved := readCSVProfiles(filepath.Join(LedgerRepo(ledger).dir, csvProfilesFile))
+	for _, p := range ledgers[ledger].CSVProfiles {
+		if findCSVProfile(saved, p.Name) == nil {
+			profiles = append(profiles, p)
+		}
+	}
+	return append(profiles, saved...)
+}
+
+func readCSVProfiles(file string) []CSVProfile {
+	profiles := []CSVProfile{}
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return profiles
+	}
+	if err := json.Unmarshal(content, &profiles); err != nil {
+		Log("Error reading %v: %v", file, err)
+	}
+	return profiles
+}
+
+// findCSVProfile returns the profile with a name, ignoring case, or nil.
+func findCSVProfile(profiles []CSVProfile, name string) *CSVProfile {
+	for i := range profiles {
+		if strings.EqualFold(profiles[i].Name, name) {
+			return &profiles[i]
+		}
+	}
+	return nil
+}
+
+// SaveCSVProfile adds a profile to the csv_profiles.json of a ledger,
+// replacing the one with the same name, and commits it.
+func SaveCSVProfile(ledger string, profile CSVProfile, author string) error {
+	if err := profile.Validate(); err != nil {
+		return err
+	}
+	repo := LedgerRepo(ledger)
+	return repo.Do(func() error {
+		if err := repo.Pull(); err != nil {
+			return err
+		}
+		profiles := readCSVProfiles(filepath.Join(repo.dir, csvProfilesFile))
+		if existing := findCSVProfile(profiles, profile.Name); existing != nil {
+			*existing = profile
+		} else {
+			profiles = append(profiles, profile)
+		}
+		content, err := json.MarshalIndent(profiles, "", "  ")
+		if err != nil {
+			return err
+		}
+		head := repo.Revision()
+		err = repo.WriteFile(csvProfilesFile, string(content)+"\n")
+		if err == nil {
+			_, err = repo.Commit("Save CSV profile "+profile.Name, author, csvProfilesFile)
+		}
+		if err == nil {
+			err = repo.Push()
+		}
+		if err != nil {
+			repo.Restore(head, csvProfilesFile)
+		}
+		return err
+	})
+}
+
+// Validate checks the settings of a profile that do not depend on a file.
+func (p *CSVProfile) Validate() error {
+	switch {
+	case strings.TrimSpace(p.Name) == "":
+		return entryErrorf("the profile needs a name")
+	case len([]rune(p.Delimiter)) > 1:
+		return entryErrorf("the delimiter must be a single character")
+	case p.Decimal != "" && p.Decimal != "." && p.Decimal != ",":
+		return entryErrorf("the decimal separator must be . or ,")
+	case p.SkipRows < 0:
+		return entryErrorf("the rows to skip cannot be negative")
+	case p.Columns.Date == "":
+		return entryErrorf("the date column is required")
+	case p.Columns.Amount == "" && p.Columns.Debit == "" && p.Columns.Credit == "":
+		return entryErrorf("either the amount column or the debit and credit columns are required")
+	}
+	if _, err := p.decode(nil); err != nil {
+		return err
+	}
+	return nil
+}
+
+// decode converts the content of a file to UTF-8.
+func (p *CSVProfile) decode(data []byte) ([]byte, error) {
+	switch strings.ToLower(strings.ReplaceAll(p.Encoding, "-", "")) {
+	case "", "utf8":
+		return bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")), nil
+	case "latin1", "iso88591", "windows1252", "cp1252":
+		return latin1ToUTF8(data), nil
+	}
+	return nil, entryErrorf("unknown encoding %q", p.Encoding)
+}
+
+// latin1ToUTF8 converts Latin-1 text to UTF-8. Windows-1252, which most
+// banks mean by Latin-1, only differs in symbols we do not care about.
+func latin1ToUTF8(data []byte) []byte {
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return []byte(string(runes))
+}
+
+// Records returns the rows of a file, after the skipped ones and including
+// the header if any.
+func (p *CSVProfile) Records(data []byte) ([][]string, error) {
+	data, err := p.decode(data)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < p.SkipRows && len(data) > 0; i++ {
+		if end := bytes.IndexByte(data, '\n'); end >= 0 {
+			data = data[end+1:]
+		} else {
+			data = nil
+		}
+	}
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	if p.Delimiter != "" {
+		reader.Comma, _ = utf8.DecodeRuneInString(p.Delimiter)
+	} else {
+		reader.Comma = sniffCSVDelimiter(string(data[:min(len(data), 1024)]))
+	}
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, entryErrorf("error reading CSV: %v", err)
+	}
+	for _, record := range records {
+		for i := range record {
+			record[i] = strings.TrimSpace(record[i])
+		}
+	}
+	return records, nil
+}
+
+// column returns the 0-based index of a column of the profile, or -1 if it
+// is not set.
+func (p *CSVProfile) column(name string, header []string) (int, error) {
+	if name == "" {
+		return -1, nil
+	}
+	if n, err := strconv.Atoi(name); err == nil {
+		if n < 1 {
+			return 0, entryErrorf("invalid column %v, the first column is 1", n)
+		}
+		return n - 1, nil
+	}
+	for i, h := range header {
+		if strings.EqualFold(h, name) {
+			return i, nil
+		}
+	}
+	if !p.Header {
+		return 0, entryErrorf("column %q must be a number, as the file has no header", name)
+	}
+	return 0, entryErrorf("column %q not found in the header", name)
+}
+
+// Parse reads the statements of a file, one per currency.
+func (p *CSVProfile) Parse(data []byte) ([]*BankStatement, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	records, err := p.Records(data)
+	if err != nil {
+		return nil, err
+	}
+	header := []string{}
+	if p.Header && len(records) > 0 {
+		header, records = records[0], records[1:]
+	}
+	columns := map[string]int{}
+	for name, column := range map[string]string{
+		"date": p.Columns.Date, "description": p.Columns.Description, "amount": p.Columns.Amount,
+		"debit": p.Columns.Debit, "credit": p.Columns.Credit, "currency": p.Columns.Currency,
+		"balance": p.Columns.Balance, "reference": p.Columns.Reference,
+	} {
+		if columns[name], err = p.column(column, header); err != nil {
+			return nil, err
+		}
+	}
+	field := func(record []string, name string) string {
+		if i := columns[name]; i >= 0 && i < len(record) {
+			return record[i]
+		}
+		return ""
+	}
+	number := func(record []string, name string) (float64, error) {
+		s := field(record, name)
+		value, err := parseProfileNumber(s, p.Decimal)
+		if err != nil {
+			return 0, entryErrorf("invalid %v %q on %v", name, s, field(record, "date"))
+		}
+		return value, nil
+	}
+
+	type row struct {
+		tx         BankTransaction
+		balance    float64
+		hasBalance bool
+	}
+	rows := []row{}
+	for _, record := range records {
+		date, ok := p.parseDate(field(record, "date"))
+		if !ok {
+			continue // titles, blank lines and totals
+		}
+		r := row{tx: BankTransaction{
+			Date:        date,
+			Description: field(record, "description"),
+			Reference:   field(record, "reference"),
+			Currency:    p.rowCurrency(field(record, "currency")),
+		}}
+		if columns["amount"] >= 0 {
+			amount, err := number(record, "amount")
+			if err != nil {
+				return nil, err
+			}
+			if amount < 0 {
+				r.tx.Debit = -amount
+			} else {
+				r.tx.Credit = amount
+			}
+		} else {
+			debit, err := number(record, "debit")
+			if err != nil {
+				return nil, err
+			}
+			credit, err := number(record, "credit")
+			if err != nil {
+				return nil, err
+			}
+			// Some banks write debits as negative numbers.
+			r.tx.Debit, r.tx.Credit = math.Abs(debit), math.Abs(credit)
+		}
+		if columns["balance"] >= 0 && field(record, "balance") != "" {
+			if r.balance, err = number(record, "balance"); err != nil {
+				return nil, err
+			}
+			r.hasBalance = true
+		}
+		rows = append(rows, r)
+	}
+	if len(rows) == 0 {
+		return nil, entryErrorf("no rows with a valid date found, check the date column and format")
+	}
+	if rows[0].tx.Date.After(rows[len(rows)-1].tx.Date) {
+		// Newest first: the balances are computed in date order.
+		for i, j := 0, len(rows)-1; i < j; i, j = i+1, j-1 {
+			rows[i], rows[j] = rows[j], rows[i]
+		}
+	}
+
+	statements := []*BankStatement{}
+	byCurrency := map[string]*BankStatement{}
+	for _, r := range rows {
+		s, ok := byCurrency[r.tx.Currency]
+		if !ok {
+			s = &BankStatement{Bank: p.Name, Currency: r.tx.Currency, Transactions: []BankTransaction{}}
+			byCurrency[r.tx.Currency] = s
+			statements = append(statements, s)
+		}
+		s.Transactions = append(s.Transactions, r.tx)
+		if s.StartDate.IsZero() || r.tx.Date.Before(s.StartDate) {
+			s.StartDate = r.tx.Date
+		}
+		if r.tx.Date.After(s.EndDate) {
+			s.EndDate = r.tx.Date
+		}
+		if r.hasBalance {
+			if len(s.StartBalances) == 0 {
+				s.StartBalances = []Amount{{Currency: s.Currency, Value: r.balance - r.tx.Credit + r.tx.Debit}}
+			}
+			s.EndBalances = []Amount{{Currency: s.Currency, Value: r.balance}}
+		}
+	}
+	return statements, nil
+}
+
+// parseDate parses a date with the format of the profile, or else with the
+// usual formats.
+func (p *CSVProfile) parseDate(s string) (time.Time, bool) {
+	if p.DateFormat == "" {
+		return parseCSVDate(s)
+	}
+	date, err := time.Parse(dateFormatLayout(p.DateFormat), s)
+	return date, err == nil
+}
+
+// dateFormatLayout converts a date format like "DD/MM/YYYY" to a Go layout.
+func dateFormatLayout(format string) string {
+	return strings.NewReplacer("YYYY", "2006", "YY", "06", "MM", "01", "DD", "02", "M", "1", "D", "2").Replace(strings.ToUpper(format))
+}
+
+// rowCurrency returns the ledger commodity of the currency of a row, e.g.
+// "$" for "UYU" or "Pesos", and "US$" for "USD" or "U$S".
+func (p *CSVProfile) rowCurrency(s string) string {
+	lower := strings.ToLower(s)
+	switch {
+	case s == "":
+		if p.Currency != "" {
+			return p.Currency
+		}
+		return "$"
+	case containsAny(lower, "usd", "us$", "u$s", "dolar", "dólar"):
+		return "US$"
+	case containsAny(lower, "uyu", "peso") || s == "$":
+		return "$"
+	}
+	return s
+}
+
+// parseProfileNumber parses an amount with a decimal separator, or if it is
+// empty the last separator. Currency symbols and spaces are ignored, and
+// parentheses mean a negative amount. An empty cell is zero.
+func parseProfileNumber(s string, decimal string) (float64, error) {
+	negative := strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")")
+	s = strings.Map(func(r rune) rune {
+		if (r >= '0' && r <= '9') || r == '.' || r == ',' || r == '-' {
+			return r
+		}
+		return -1
+	}, s)
+	if s == "" {
+		return 0, nil
+	}
+	if decimal == "" {
+		decimal = "."
+		if strings.LastIndex(s, ",") > strings.LastIndex(s, ".") {
+			decimal = ","
+		}
+	}
+	if decimal == "," {
+		s = strings.Replace(strings.ReplaceAll(s, ".", ""), ",", ".", 1)
+	} else {
+		s = strings.ReplaceAll(s, ",", "")
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if negative {
+		value = -value
+	}
+	return value, err
+}
+
+// csvPreviewRows is how many rows of a sample file are previewed.
+const csvPreviewRows = 15
+
+// handleCSVProfiles lists the CSV profiles, with the one named in the query
+// string in the form to edit it.
+func handleCSVProfiles(w http.ResponseWriter, r *http.Request) {
+	handleWithTemplateAndData("csv_profiles", func(data map[string]interface{}) {
+		profiles := CSVProfiles(data["ledger"].(string))
+		data["profiles"] = profiles
+		profile := CSVProfile{Header: true}
+		if p := findCSVProfile(profiles, r.FormValue("profile")); p != nil {
+			profile = *p
+		}
+		data["profile"] = profile
+	})(w, r)
+}
+
+// handleCSVProfile previews a sample file with the profile in the form, or
+// saves the profile.
+func handleCSVProfile(w http.ResponseWriter, r *http.Request) {
+	ledger := mux.Vars(r)["ledger"]
+	// Previews only need append access, like the reconcile page.
+	if r.FormValue("save") != "" && LedgerRole(ledger, GetSession(r).Email) < RoleEdit {
+		http.Error(w, "Forbidden: requires "+RoleEdit.String()+" access", http.StatusForbidden)
+		return
+	}
+	profile, sample, err := csvProfileFromForm(r)
+	saved := false
+	if err == nil && r.FormValue("save") != "" {
+		if len(sample) > 0 {
+			_, err = profile.Parse(sample)
+		}
+		if err == nil {
+			err = SaveCSVProfile(ledger, profile, "webledger <"+GetSession(r).Email+">")
+			saved = err == nil
+		}
+	}
+	if err != nil {
+		Log("Error with CSV profile of %v: %v", ledger, err)
+		if _, ok := err.(*EntryError); ok {
+			w.WriteHeader(http.StatusBadRequest)
+		} else {
+			w.WriteHeader(gitErrorStatus(err))
+		}
+	}
+	handleWithTemplateAndData("csv_profiles", func(data map[string]interface{}) {
+		data["profiles"] = CSVProfiles(ledger)
+		data["profile"] = profile
+		if err != nil {
+			data["error"] = err.Error()
+		}
+		if saved {
+			data["saved"] = profile.Name
+		}
+		if len(sample) == 0 {
+			return
+		}
+		data["sample"] = base64.StdEncoding.EncodeToString(sample)
+		if records, err := profile.Records(sample); err == nil {
+			data["previewRows"] = records[:min(len(records), csvPreviewRows)]
+			width := 0
+			for _, record := range records {
+				width = max(width, len(record))
+			}
+			columns := []int{}
+			for i := 1; i <= width; i++ {
+				columns = append(columns, i)
+			}
+			data["previewColumns"] = columns
+		}
+		if statements, err := profile.Parse(sample); err != nil {
+			data["parseError"] = err.Error()
+		} else {
+			data["statements"] = statements
+		}
+	})(w, r)
+}
+
+// csvProfileFromForm reads a profile and the sample file it is tried on,
+// either uploaded or, once previewed, kept in the form.
+func csvProfileFromForm(r *http.Request) (CSVProfile, []byte, error) {
+	if err := r.ParseMultipartForm(10 << 20); err != nil && err != http.ErrNotMultipart {
+		return CSVProfile{}, nil, entryErrorf("%v", err)
+	}
+	skip, _ := strconv.Atoi(r.FormValue("skip_rows"))
+	delimiter := r.FormValue("delimiter")
+	if delimiter == `\t` {
+		delimiter = "\t"
+	}
+	profile := CSVProfile{
+		Name:      strings.TrimSpace(r.FormValue("name")),
+		Delimiter: delimiter,
+		Encoding:  r.FormValue("encoding"),
+		SkipRows:  skip,
+		Header:    r.FormValue("header") != "",
+		Columns: CSVColumns{
+			Date:        strings.TrimSpace(r.FormValue("date")),
+			Description: strings.TrimSpace(r.FormValue("description")),
+			Amount:      strings.TrimSpace(r.FormValue("amount")),
+			Debit:       strings.TrimSpace(r.FormValue("debit")),
+			Credit:      strings.TrimSpace(r.FormValue("credit")),
+			Currency:    strings.TrimSpace(r.FormValue("currency_column")),
+			Balance:     strings.TrimSpace(r.FormValue("balance")),
+			Reference:   strings.TrimSpace(r.FormValue("reference")),
+		},
+		DateFormat: strings.TrimSpace(r.FormValue("date_format")),
+		Decimal:    r.FormValue("decimal"),
+		Currency:   strings.TrimSpace(r.FormValue("currency")),
+	}
+	if file, _, err := r.FormFile("file"); err == nil {
+		defer file.Close()
+		var b bytes.Buffer
+		if _, err := b.ReadFrom(file); err != nil {
+			return profile, nil, err
+		}
+		return profile, b.Bytes(), nil
+	}
+	sample, err := base64.StdEncoding.DecodeString(r.FormValue("sample"))
+	if err != nil {
+		return profile, nil, entryErrorf("invalid sample: %v", err)
+	}
+	return profile, sample, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DashboardWidget is a total shown on the dashboard of a ledger, e.g.
+//
+//	{"Label": "Income in {period}", "Query": "^income", "Period": "last month",
+//	 "Exchange": "US$", "Scale": -1}
+type DashboardWidget struct {
+	Label    string  // "{period}" is replaced by the dates of Period
+	Query    string  // ledger query, e.g. "expenses and not retiro"
+	Period   string  // period expression, e.g. "last 12 months"; empty for all
+	Exchange string  // commodity to convert to, at the price of each posting's date
+	Scale    float64 // multiplies the total, e.g. -1 for income; 0 means 1
+}
+
+// defaultDashboard is shown for ledgers that do not declare widgets.
+var defaultDashboard = []DashboardWidget{
+	{Label: "Expenses in the last 12 months", Query: "^expenses", Period: "last 12 months"},
+	{Label: "Average monthly expenses", Query: "^expenses", Period: "last 12 months", Scale: 1.0 / 12},
+	{Label: "Income in {period}", Query: "^income", Period: "last month", Scale: -1},
+	{Label: "Income in {period}", Query: "^income", Period: "2 months ago", Scale: -1},
+	{Label: "Assets", Query: "^assets"},
+}
+
+// dashboardFile is read from the directory of the ledger file when the
+// ledger definition has no Dashboard, so it can be versioned with the
+// ledger.
+const dashboardFile = "dashboard.json"
+
+// DashboardWidgets returns the widgets of a ledger: those of ledgers.json,
+// else those of its dashboard.json, else the default ones.
+func DashboardWidgets(ledger string) []DashboardWidget {
+	if widgets := ledgers[ledger].Dashboard; len(widgets) > 0 {
+		return widgets
+	}
+	content, err := os.ReadFile(filepath.Join(filepath.Dir(LedgerPath(ledger)), dashboardFile))
+	if err != nil {
+		return defaultDashboard
+	}
+	widgets := []DashboardWidget{}
+	if err := json.Unmarshal(content, &widgets); err != nil {
+		Log("Error reading %v of %v: %v", dashboardFile, ledger, err)
+		return defaultDashboard
+	}
+	return widgets
+}
+
+// WidgetView is a widget with its value computed.
+type WidgetView struct {
+	Label string
+	Value string
+	Error string
+}
+
+// EvalWidget computes the total of a widget.
+func EvalWidget(journal *Journal, widget DashboardWidget, now time.Time) WidgetView {
+	view := WidgetView{Label: widget.Label}
+	query, err := ParsePostingQuery(widget.Query)
+	if err != nil {
+		view.Error = err.Error()
+		return view
+	}
+	opts := ReportOptions{Query: query, Exchange: widget.Exchange, Historical: true}
+	if widget.Period != "" {
+		if opts.Begin, opts.End, err = ParsePeriod(widget.Period, now); err != nil {
+			view.Error = err.Error()
+			return view
+		}
+	}
+	view.Label = strings.ReplaceAll(widget.Label, "{period}", describePeriod(opts.Begin, opts.End))
+
+	scale := widget.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	total := Balance{}
+	for currency, value := range BalanceReportFor(journal, opts).Total {
+		total[currency] = value * scale
+	}
+	view.Value = FormatBalance(journal, total)
+	return view
+}
+
+// describePeriod names the interval [begin, end), e.g. "Sep 2026".
+func describePeriod(begin time.Time, end time.Time) string {
+	switch {
+	case begin.IsZero() && end.IsZero():
+		return "all time"
+	case begin.IsZero():
+		return "until " + end.AddDate(0, 0, -1).Format("2006-01-02")
+	case end.IsZero():
+		return "since " + begin.Format("2006-01-02")
+	case begin.Day() == 1 && end.Equal(begin.AddDate(0, 1, 0)):
+		return begin.Format("Jan 2006")
+	case end.Equal(begin.AddDate(0, 0, 1)):
+		return begin.Format("2006-01-02")
+	}
+	return begin.Format("2006-01-02") + ".." + end.AddDate(0, 0, -1).Format("2006-01-02")
+}
+
+func dashboardData(data map[string]interface{}) {
+	ledger := data["ledger"].(string)
+	journal := LedgerJournal(ledger)
+	now := time.Now()
+	views := []WidgetView{}
+	for _, widget := range DashboardWidgets(ledger) {
+		views = append(views, EvalWidget(journal, widget, now))
+	}
+	data["widgets"] = views
+}
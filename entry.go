@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// NewTransaction is a transaction entered through the form or the API.
+type NewTransaction struct {
+	Date     string       `json:"date"` // 2006/01/02 or 2006-01-02
+	Payee    string       `json:"payee"`
+	Comment  string       `json:"comment"`
+	Postings []NewPosting `json:"postings"`
+	Order    string       `json:"order,omitempty"`   // "date" to insert in date order, else appended
+	Message  string       `json:"message,omitempty"` // for the commit
+}
+
+// NewPosting is a posting of a NewTransaction. At most one posting may leave
+// Amount empty, to be balanced by the others.
+type NewPosting struct {
+	Account string `json:"account"`
+	Amount  string `json:"amount"` // as written in a journal, e.g. "$ 1,500"
+	Comment string `json:"comment"`
+}
+
+// EntryError is a new transaction rejected by FormatEntry.
+type EntryError struct {
+	Message string
+}
+
+func (e *EntryError) Error() string {
+	return e.Message
+}
+
+func entryErrorf(format string, a ...interface{}) error {
+	return &EntryError{Message: fmt.Sprintf(format, a...)}
+}
+
+// ParseAmount parses an amount as written in a journal, e.g. "$ -12.50".
+func ParseAmount(text string) (Amount, error) {
+	p := &journalParser{journal: newJournal()}
+	return p.parseAmount("", text)
+}
+
+// FormatEntry checks a new transaction and prints it as a journal entry,
+// with amounts in the journal's commodity styles and aligned in a column.
+func FormatEntry(journal *Journal, tx NewTransaction) (string, error) {
+	date, err := parseEntryDate(tx.Date)
+	if err != nil {
+		return "", err
+	}
+	payee := strings.TrimSpace(tx.Payee)
+	if payee == "" {
+		return "", entryErrorf("the payee is required")
+	}
+	if strings.ContainsAny(payee+tx.Comment, "\r\n") {
+		return "", entryErrorf("the payee and comment must be a single line")
+	}
+	// These would be read as a comment, or as the state or code of the
+	// transaction.
+	if strings.Contains(payee, " ;") || strings.Contains(payee, "\t;") {
+		return "", entryErrorf("the payee cannot contain \" ;\", use the comment")
+	}
+	if strings.ContainsAny(payee[:1], "*!(;") {
+		return "", entryErrorf("the payee cannot start with *, !, ( or ;")
+	}
+
+	accounts := []string{}
+	amounts := []string{}
+	comments := []string{}
+	elided := 0
+	for i, posting := range tx.Postings {
+		account := strings.TrimSpace(posting.Account)
+		amount := strings.TrimSpace(posting.Amount)
+		comment := strings.TrimSpace(posting.Comment)
+		if account == "" && amount == "" && comment == "" {
+			continue
+		}
+		if account == "" {
+			return "", entryErrorf("posting %d: the account is required", i+1)
+		}
+		if strings.Contains(account, "  ") || strings.ContainsAny(account+comment, "\t\r\n;") {
+			return "", entryErrorf("posting %d: invalid account or comment", i+1)
+		}
+		if amount == "" {
+			elided++
+		} else {
+			p := &journalParser{journal: newJournal()}
+			parsed, err := p.parseAmount("", amount)
+			if err != nil {
+				return "", entryErrorf("posting %d: %v", i+1, err)
+			}
+			// Decimals beyond the commodity's precision are kept as typed.
+			amount = journal.formatAmount(parsed, p.journal.Commodities[parsed.Currency].Precision)
+		}
+		accounts = append(accounts, account)
+		amounts = append(amounts, amount)
+		comments = append(comments, comment)
+	}
+	if len(accounts) < 2 {
+		return "", entryErrorf("a transaction needs at least two postings")
+	}
+	if elided > 1 {
+		return "", entryErrorf("only one posting can be left without an amount")
+	}
+
+	accountWidth, amountWidth := 0, 0
+	for i := range accounts {
+		accountWidth = max(accountWidth, utf8.RuneCountInString(accounts[i]))
+		amountWidth = max(amountWidth, utf8.RuneCountInString(amounts[i]))
+	}
+	var b strings.Builder
+	b.WriteString(date.Format("2006/01/02") + " " + payee + "\n")
+	if comment := strings.TrimSpace(tx.Comment); comment != "" {
+		b.WriteString("    ; " + comment + "\n")
+	}
+	for i, account := range accounts {
+		line := "    " + account
+		if amounts[i] != "" {
+			padding := accountWidth - utf8.RuneCountInString(account) + 4 + amountWidth - utf8.RuneCountInString(amounts[i])
+			line += strings.Repeat(" ", padding) + amounts[i]
+		}
+		if comments[i] != "" {
+			line += "  ; " + comments[i]
+		}
+		b.WriteString(line + "\n")
+	}
+	entry := b.String()
+
+	// The parser does the balancing, with the same rules as for the file,
+	// and must read the payee back as it was given.
+	parsed := ParseJournal("entry", entry)
+	if len(parsed.Errors) > 0 {
+		return "", entryErrorf("%v", parsed.Errors[0].Message)
+	}
+	if len(parsed.Transactions) != 1 || parsed.Transactions[0].Payee != payee {
+		return "", entryErrorf("invalid payee %q", payee)
+	}
+	return entry, nil
+}
+
+func parseEntryDate(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range []string{"2006/01/02", "2006-01-02"} {
+		if date, err := time.Parse(layout, s); err == nil {
+			return date, nil
+		}
+	}
+	return time.Time{}, entryErrorf("invalid date %q", s)
+}
+
+var postingFieldRegex = regexp.MustCompile(`^postings\[(\d+)\]\[(account|amount|comment)\]$`)
+
+// newTransactionFromForm reads the transaction form. Posting rows are cloned
+// in the browser from a template, so their fields are named
+// postings[<n>][account] and so on, with n increasing down the form.
+func newTransactionFromForm(r *http.Request) NewTransaction {
+	r.ParseForm()
+	tx := NewTransaction{Date: r.FormValue("date"), Payee: r.FormValue("payee"), Comment: r.FormValue("comment"), Message: r.FormValue("message")}
+	rows := map[int]*NewPosting{}
+	for key, values := range r.PostForm {
+		m := postingFieldRegex.FindStringSubmatch(key)
+		if m == nil || len(values) == 0 {
+			continue
+		}
+		n, _ := strconv.Atoi(m[1])
+		if rows[n] == nil {
+			rows[n] = &NewPosting{}
+		}
+		switch m[2] {
+		case "account":
+			rows[n].Account = values[0]
+		case "amount":
+			rows[n].Amount = values[0]
+		case "comment":
+			rows[n].Comment = values[0]
+		}
+	}
+	keys := []int{}
+	for n := range rows {
+		keys = append(keys, n)
+	}
+	sort.Ints(keys)
+	for _, n := range keys {
+		tx.Postings = append(tx.Postings, *rows[n])
+	}
+	return tx
+}
+
+// InsertEntry returns file with a transaction entry inserted after the last
+// transaction dated on or before it, or before the first transaction if all
+// are later, separated by blank lines. Other lines are left untouched. If
+// the entry would be read differently at that position, e.g. inside an
+// "apply account" block, or is anything but a single transaction, like
+// several of them or directives, it is appended at the end instead.
+func InsertEntry(name string, file string, entry string) string {
+	appended := appendEntry(file, entry)
+	entry = strings.TrimSpace(strings.Replace(entry, "\r\n", "\n", -1))
+	parsedEntry := ParseJournal(name, entry)
+	parsed := parsedEntry.Transactions
+	if len(parsed) != 1 || len(parsedEntry.Errors) > 0 || parsed[0].Span.StartLine != 1 || parsed[0].Span.EndLine != strings.Count(entry, "\n")+1 {
+		return appended
+	}
+	date := parsed[0].Date
+
+	journal := ParseJournal(name, file)
+	name = journal.Files[0] // as spans name it
+	var first, last *Transaction
+	for _, tx := range journal.Transactions {
+		if tx.Span.File != name {
+			continue
+		}
+		if first == nil || tx.Span.StartLine < first.Span.StartLine {
+			first = tx
+		}
+		if !tx.Date.After(date) && (last == nil || tx.Span.EndLine > last.Span.EndLine) {
+			last = tx
+		}
+	}
+	if first == nil {
+		return appended
+	}
+
+	lines := strings.Split(file, "\n")
+	entryLines := strings.Split(strings.TrimRight(entry, "\n"), "\n")
+	var inserted []string
+	var at int
+	if last != nil {
+		at = last.Span.EndLine
+		inserted = append([]string{""}, entryLines...)
+		if at < len(lines)-1 && lines[at] != "" {
+			inserted = append(inserted, "")
+		}
+	} else {
+		// Keep the comments right above the first transaction with it.
+		at = first.Span.StartLine - 1
+		for at > 0 && isCommentLine(lines[at-1]) {
+			at--
+		}
+		inserted = append(entryLines, "")
+		if at > 0 && lines[at-1] != "" {
+			inserted = append([]string{""}, inserted...)
+		}
+	}
+	result := strings.Join(append(append(append([]string{}, lines[:at]...), inserted...), lines[at:]...), "\n")
+
+	headerLine := at + 1
+	if inserted[0] == "" {
+		headerLine++
+	}
+	for _, tx := range ParseJournal(name, result).Transactions {
+		if tx.Span.File == name && tx.Span.StartLine == headerLine {
+			if samePostings(tx, parsed[0]) {
+				return result
+			}
+			break
+		}
+	}
+	return appended
+}
+
+// appendEntry adds entry at the end of file after a blank line.
+func appendEntry(file string, entry string) string {
+	for len(file) < 2 || file[len(file)-1] != '\n' || file[len(file)-2] != '\n' {
+		file += "\n"
+	}
+	return file + strings.TrimSpace(entry) + "\n"
+}
+
+func isCommentLine(line string) bool {
+	return line != "" && strings.ContainsRune(";#%|*", rune(line[0]))
+}
+
+func samePostings(a *Transaction, b *Transaction) bool {
+	if a.Payee != b.Payee || len(a.Postings) != len(b.Postings) {
+		return false
+	}
+	for i := range a.Postings {
+		if a.Postings[i].Account != b.Postings[i].Account {
+			return false
+		}
+	}
+	return true
+}
+
+// addTransaction formats a new transaction and adds it to the ledger, in
+// date order or at the end.
+func addTransaction(ledger string, tx NewTransaction, dateOrder bool, email string) (string, error) {
+	entry, err := FormatEntry(LedgerJournal(ledger), tx)
+	if err != nil {
+		return "", err
+	}
+	author := "webledger <" + email + ">"
+	if dateOrder {
+		return entry, InsertLedger(ledger, entry, author, tx.Message)
+	}
+	return entry, AppendLedger(ledger, entry, author, tx.Message)
+}
+
+// newTransactionData fills the data of the new transaction form.
+func newTransactionData(data map[string]interface{}) {
+	data["today"] = time.Now().Format("2006-01-02")
+	data["dateOrder"] = true
+}
+
+func handleNewTransaction(w http.ResponseWriter, r *http.Request) {
+	ledger := mux.Vars(r)["ledger"]
+	tx := newTransactionFromForm(r)
+	dateOrder := r.FormValue("order") == "date"
+	entry, err := addTransaction(ledger, tx, dateOrder, GetSession(r).Email)
+	if err != nil {
+		Log("Error adding transaction to %v: %v", ledger, err)
+		w.WriteHeader(entryErrorStatus(err))
+	}
+	handleWithTemplateAndData("new", func(data map[string]interface{}) {
+		newTransactionData(data)
+		data["dateOrder"] = dateOrder
+		if err != nil {
+			data["error"] = err.Error()
+			data["transaction"] = tx
+		} else {
+			data["added"] = entry
+		}
+	})(w, r)
+}
+
+// JSONNewTransactionResult is the response of POST /{ledger}/transactions.
+type JSONNewTransactionResult struct {
+	Entry string `json:"entry,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+func handleNewTransactionJSON(w http.ResponseWriter, r *http.Request) {
+	ledger := mux.Vars(r)["ledger"]
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	encoder := json.NewEncoder(w)
+
+	var tx NewTransaction
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&tx); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		encoder.Encode(&JSONNewTransactionResult{Error: err.Error()})
+		return
+	}
+	entry, err := addTransaction(ledger, tx, tx.Order == "date", GetSession(r).Email)
+	if err != nil {
+		Log("Error adding transaction to %v: %v", ledger, err)
+		w.WriteHeader(entryErrorStatus(err))
+		encoder.Encode(&JSONNewTransactionResult{Error: err.Error()})
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	encoder.Encode(&JSONNewTransactionResult{Entry: entry})
+}
+
+// entryErrorStatus is the HTTP status for an error adding a transaction.
+func entryErrorStatus(err error) int {
+	if _, ok := err.(*EntryError); ok {
+		return http.StatusBadRequest
+	}
+	return gitErrorStatus(err)
+}
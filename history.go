@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+const historyLength = 100
+
+// ChangeView is a TransactionChange as shown in the commit page.
+type ChangeView struct {
+	Kind  string
+	Date  string
+	Payee string
+	Old   string
+	New   string
+}
+
+// CommitChanges lists the transactions a commit added, removed or changed
+// in the ledger file.
+func CommitChanges(repo *Repo, commit Commit) ([]ChangeView, error) {
+	after, err := repo.FileAt(commit.Hash)
+	if err != nil {
+		return nil, err
+	}
+	before, err := repo.FileAt(commit.Hash + "^")
+	if err != nil {
+		return nil, err
+	}
+	old := ParseJournal(repo.Path(), before)
+	new := ParseJournal(repo.Path(), after)
+	views := []ChangeView{}
+	for _, change := range DiffJournals(old, new) {
+		tx := change.Transaction()
+		view := ChangeView{Kind: change.Kind, Date: tx.Date.Format("2006-01-02"), Payee: tx.Payee}
+		if change.Old != nil {
+			view.Old = old.Text(change.Old.Span)
+		}
+		if change.New != nil {
+			view.New = new.Text(change.New.Span)
+		}
+		views = append(views, view)
+	}
+	return views, nil
+}
+
+func historyData(data map[string]interface{}) {
+	repo := LedgerRepo(data["ledger"].(string))
+	repo.Do(func() error {
+		commits, err := repo.History("", historyLength)
+		if err != nil {
+			Log("Error reading history: %v", err)
+			data["error"] = err.Error()
+		}
+		data["commits"] = commits
+		return nil
+	})
+}
+
+// findCommit returns the commit of the request if it changed the ledger.
+func findCommit(repo *Repo, r *http.Request) (Commit, bool) {
+	var commits []Commit
+	repo.Do(func() error {
+		commits, _ = repo.History(mux.Vars(r)["commit"], 1)
+		return nil
+	})
+	if len(commits) == 0 {
+		return Commit{}, false
+	}
+	return commits[0], true
+}
+
+func handleCommit(w http.ResponseWriter, r *http.Request) {
+	ledger := mux.Vars(r)["ledger"]
+	repo := LedgerRepo(ledger)
+	commit, ok := findCommit(repo, r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	var changes []ChangeView
+	var err error
+	repo.Do(func() error {
+		changes, err = CommitChanges(repo, commit)
+		return nil
+	})
+	handleWithTemplateAndData("commit", func(data map[string]interface{}) {
+		data["commit"] = commit
+		data["changes"] = changes
+		if err != nil {
+			data["error"] = err.Error()
+		}
+	})(w, r)
+}
+
+func handleRevert(w http.ResponseWriter, r *http.Request) {
+	ledger := mux.Vars(r)["ledger"]
+	commit, ok := findCommit(LedgerRepo(ledger), r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	err := RevertLedger(ledger, commit, "webledger <"+GetSession(r).Email+">")
+	if err == nil {
+		http.Redirect(w, r, RootPath+"/"+ledger+"/history", http.StatusSeeOther)
+		return
+	}
+	Log("Error reverting %v in %v: %v", commit.Hash, ledger, err)
+	status := gitErrorStatus(err)
+	if _, ok := err.(*ConflictError); ok {
+		status = http.StatusConflict
+	}
+	w.WriteHeader(status)
+	handleWithTemplateAndData("commit", func(data map[string]interface{}) {
+		data["commit"] = commit
+		data["error"] = "Could not revert: " + err.Error()
+		if conflict, ok := err.(*ConflictError); ok {
+			data["conflict"] = conflict.Diff
+		}
+	})(w, r)
+}
@@ -0,0 +1,1085 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Span locates a parsed item in the journal source. Lines are 1-based and
+// inclusive.
+type Span struct {
+	File      string
+	StartLine int
+	EndLine   int
+}
+
+// Posting is one account line of a transaction.
+type Posting struct {
+	Account   string
+	Amount    *Amount // nil only while an elided amount has not been inferred
+	Cost      *Amount // total cost, from "@", "@@" or a lot price
+	Assertion *Amount // balance assertion or assignment after "="
+	State     string  // "", "*" or "!"
+	Virtual   bool    // (Account) or [Account]
+	Balanced  bool    // [Account]: virtual, but must balance
+	Inferred  bool    // Amount was computed from the rest of the transaction
+	Generated bool    // added by an automated transaction
+	Comment   string
+	Tags      map[string]string
+	Line      int
+}
+
+// Transaction is a dated journal entry with its postings.
+type Transaction struct {
+	Date     time.Time
+	AuxDate  time.Time
+	State    string // "", "*" or "!"
+	Code     string
+	Payee    string
+	Note     string
+	Tags     map[string]string
+	Postings []*Posting
+	Span     Span
+}
+
+// AutomatedTransaction is an "= predicate" entry. Its postings are added to
+// every later transaction with a posting that matches the predicate.
+type AutomatedTransaction struct {
+	Predicate string
+	Query     PostingQuery
+	Postings  []*Posting
+	Span      Span
+}
+
+// PeriodicTransaction is a "~ period" entry, used by ledger for budgeting.
+type PeriodicTransaction struct {
+	Period   string
+	Postings []*Posting
+	Span     Span
+}
+
+// PriceDirective is a "P date commodity price" line.
+type PriceDirective struct {
+	Date      time.Time
+	Commodity string
+	Price     Amount
+	Span      Span
+}
+
+// CommodityStyle remembers how a commodity is written in the journal so that
+// amounts can be printed back the same way.
+type CommodityStyle struct {
+	Symbol    string
+	Prefix    bool
+	Spaced    bool
+	Thousands bool
+	Precision int
+}
+
+// ParseError is a problem found while parsing or balancing the journal.
+type ParseError struct {
+	File    string
+	Line    int
+	Message string
+}
+
+func (e *ParseError) Error() string {
+	if e.File == "" {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+	}
+	return fmt.Sprintf("%s:%d: %s", filepath.Base(e.File), e.Line, e.Message)
+}
+
+// Journal is the parsed content of a ledger file and the files it includes.
+type Journal struct {
+	Transactions        []*Transaction
+	Automated           []*AutomatedTransaction
+	Periodic            []*PeriodicTransaction
+	Prices              []*PriceDirective
+	Accounts            []string // declared or used, in order of appearance
+	DeclaredAccounts    map[string]bool
+	Commodities         map[string]*CommodityStyle
+	DeclaredCommodities map[string]bool
+	Files               []string
+	Includes            []string // include patterns, with their directory
+	Errors              []*ParseError
+
+	sources map[string][]string
+}
+
+// Balance is a sum of amounts keyed by commodity.
+type Balance map[string]float64
+
+// Add adds an amount to the balance.
+func (b Balance) Add(a Amount) {
+	b[a.Currency] += a.Value
+}
+
+// AddBalance adds every commodity of other to the balance.
+func (b Balance) AddBalance(other Balance) {
+	for c, v := range other {
+		b[c] += v
+	}
+}
+
+// Commodities returns the commodities in the balance, sorted.
+func (b Balance) Commodities() []string {
+	list := []string{}
+	for c := range b {
+		list = append(list, c)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// LoadJournal parses the journal file of a ledger.
+func LoadJournal(ledger string) *Journal {
+	return ParseJournalFile(LedgerPath(ledger))
+}
+
+// ParseJournalFile parses a journal file and everything it includes.
+func ParseJournalFile(name string) *Journal {
+	bytes, err := ioutil.ReadFile(name)
+	j := newJournal()
+	if err != nil {
+		Log("Error reading journal %v: %v", name, err)
+		j.Errors = append(j.Errors, &ParseError{File: name, Message: err.Error()})
+		return j
+	}
+	p := &journalParser{journal: j, year: time.Now().Year(), balances: map[string]Balance{}}
+	p.parse(name, string(bytes))
+	return j
+}
+
+// ParseJournal parses journal text. Includes are resolved relative to the
+// directory of name, which need not exist itself.
+func ParseJournal(name string, content string) *Journal {
+	return parseJournalWith(name, content, nil)
+}
+
+// parseJournalWith is ParseJournal, with the contents of included files
+// taken from files, by path, instead of the disk when they are there.
+func parseJournalWith(name string, content string, files map[string]string) *Journal {
+	j := newJournal()
+	p := &journalParser{journal: j, year: time.Now().Year(), balances: map[string]Balance{}, files: files}
+	p.parse(name, content)
+	return j
+}
+
+func newJournal() *Journal {
+	return &Journal{
+		DeclaredAccounts:    map[string]bool{},
+		Commodities:         map[string]*CommodityStyle{},
+		DeclaredCommodities: map[string]bool{},
+		sources:             map[string][]string{},
+	}
+}
+
+// Text returns the source lines covered by a span.
+func (j *Journal) Text(s Span) string {
+	lines := j.sources[s.File]
+	if s.StartLine < 1 || s.EndLine > len(lines) || s.StartLine > s.EndLine {
+		return ""
+	}
+	return strings.Join(lines[s.StartLine-1:s.EndLine], "\n") + "\n"
+}
+
+// Precision returns the number of decimals used for a commodity.
+func (j *Journal) Precision(commodity string) int {
+	if style, ok := j.Commodities[commodity]; ok {
+		return style.Precision
+	}
+	return 2
+}
+
+// FormatAmount prints an amount the way its commodity is written in the
+// journal, e.g. "$ -1,234.50" or "10 EUR".
+func (j *Journal) FormatAmount(a Amount) string {
+	return j.formatAmount(a, 0)
+}
+
+// formatAmount is FormatAmount with at least precision decimals.
+func (j *Journal) formatAmount(a Amount, precision int) string {
+	style, ok := j.Commodities[a.Currency]
+	if !ok {
+		style = &CommodityStyle{Symbol: a.Currency, Prefix: true, Spaced: len(a.Currency) > 1, Precision: 2}
+	}
+	precision = max(precision, style.Precision)
+	number := strconv.FormatFloat(math.Abs(a.Value), 'f', precision, 64)
+	if style.Thousands {
+		number = groupThousands(number)
+	}
+	if a.Value < 0 && number != strconv.FormatFloat(0, 'f', precision, 64) {
+		number = "-" + number
+	}
+	if a.Currency == "" {
+		return number
+	}
+	space := ""
+	if style.Spaced {
+		space = " "
+	}
+	if style.Prefix {
+		return a.Currency + space + number
+	}
+	return number + space + a.Currency
+}
+
+func groupThousands(number string) string {
+	integer, fraction := number, ""
+	if i := strings.Index(number, "."); i >= 0 {
+		integer, fraction = number[:i], number[i:]
+	}
+	var b strings.Builder
+	for i, c := range integer {
+		if i > 0 && (len(integer)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(c)
+	}
+	return b.String() + fraction
+}
+
+// tolerance is the largest residual still considered zero for a commodity.
+func (j *Journal) tolerance(commodity string) float64 {
+	return 0.5*math.Pow(10, -float64(j.Precision(commodity))) + 1e-9
+}
+
+// IsZero reports whether every commodity of the balance rounds to zero.
+func (j *Journal) IsZero(b Balance) bool {
+	for c, v := range b {
+		if math.Abs(v) > j.tolerance(c) {
+			return false
+		}
+	}
+	return true
+}
+
+type applyEntry struct {
+	kind     string
+	value    string
+	prevYear int // year to restore at the end of an "apply year"
+}
+
+type aliasEntry struct {
+	from string
+	to   string
+}
+
+type journalParser struct {
+	journal  *Journal
+	year     int
+	apply    []applyEntry
+	aliases  []aliasEntry // in the order they were defined
+	balances map[string]Balance
+	seen     map[string]bool
+	noStyle  bool // do not record the style amounts are written in
+	files    map[string]string
+}
+
+var (
+	journalDateRegex   = regexp.MustCompile(`^(\d{4}[/.-]\d{1,2}[/.-]\d{1,2}|\d{1,2}[/.-]\d{1,2})(?:=(\d{4}[/.-]\d{1,2}[/.-]\d{1,2}|\d{1,2}[/.-]\d{1,2}))?(?:\s+|$)`)
+	journalCodeRegex   = regexp.MustCompile(`^\(([^)]*)\)\s*`)
+	journalMetaRegex   = regexp.MustCompile(`^\s*([^\s:]+):\s+(.*?)\s*$`)
+	journalTagsRegex   = regexp.MustCompile(`:((?:[^:\s]+:)+)`)
+	journalLotRegex    = regexp.MustCompile(`\{\{?([^}]*)\}\}?|\[[^\]]*\]|\([^)]*\)`)
+	journalNumberRegex = regexp.MustCompile(`^[0-9][0-9,]*(\.[0-9]*)?|^\.[0-9]+`)
+)
+
+func (p *journalParser) errorf(file string, line int, format string, a ...interface{}) {
+	p.journal.Errors = append(p.journal.Errors, &ParseError{File: file, Line: line, Message: fmt.Sprintf(format, a...)})
+}
+
+// entry is the multi-line item being parsed: a transaction, an automated or
+// periodic transaction, or a directive with indented sub-directives.
+type entry struct {
+	tx        *Transaction
+	automated *AutomatedTransaction
+	periodic  *PeriodicTransaction
+	directive bool
+}
+
+func (p *journalParser) parse(name string, content string) {
+	if p.seen == nil {
+		p.seen = map[string]bool{}
+	}
+	if abs, err := filepath.Abs(name); err == nil && name != "" {
+		name = abs
+	}
+	if p.seen[name] {
+		p.errorf(name, 0, "file included more than once")
+		return
+	}
+	p.seen[name] = true
+	p.journal.Files = append(p.journal.Files, name)
+
+	content = strings.Replace(content, "\r\n", "\n", -1)
+	lines := strings.Split(content, "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	p.journal.sources[name] = lines
+
+	var current *entry
+	finish := func(endLine int) {
+		if current != nil {
+			p.finishEntry(name, current, endLine)
+			current = nil
+		}
+	}
+	lastContent := 0
+	blockEnd := ""
+
+	for i, line := range lines {
+		lineNo := i + 1
+		if blockEnd != "" {
+			if strings.HasPrefix(strings.TrimSpace(line), blockEnd) {
+				blockEnd = ""
+			}
+			continue
+		}
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			finish(lastContent)
+			continue
+		}
+
+		if line[0] == ' ' || line[0] == '\t' {
+			if current == nil {
+				if !strings.HasPrefix(trimmed, ";") {
+					p.errorf(name, lineNo, "unexpected indented line")
+				}
+				continue
+			}
+			lastContent = lineNo
+			if current.directive {
+				continue
+			}
+			p.parseEntryLine(name, lineNo, trimmed, current)
+			continue
+		}
+
+		finish(lastContent)
+		lastContent = lineNo
+
+		switch {
+		case strings.ContainsRune(";#%|*", rune(line[0])):
+			continue
+		case line[0] >= '0' && line[0] <= '9':
+			tx := p.parseTransactionHeader(name, lineNo, line)
+			if tx != nil {
+				current = &entry{tx: tx}
+			}
+			continue
+		case line[0] == '=':
+			predicate := strings.TrimSpace(line[1:])
+			query, err := ParsePostingQuery(predicate)
+			if err != nil {
+				p.errorf(name, lineNo, "invalid automated transaction predicate: %v", err)
+				query = queryNot{queryAll{}}
+			}
+			current = &entry{automated: &AutomatedTransaction{
+				Predicate: predicate,
+				Query:     query,
+				Span:      Span{name, lineNo, lineNo},
+			}}
+			continue
+		case line[0] == '~':
+			current = &entry{periodic: &PeriodicTransaction{
+				Period: strings.TrimSpace(line[1:]),
+				Span:   Span{name, lineNo, lineNo},
+			}}
+			continue
+		case line[0] == '-':
+			// Command line options embedded in the journal.
+			continue
+		}
+
+		word, rest := splitWord(trimmed)
+		switch word {
+		case "comment":
+			blockEnd = "end comment"
+		case "test":
+			blockEnd = "end test"
+		case "account":
+			account := p.applyAccount(stripComment(rest))
+			p.journal.DeclaredAccounts[account] = true
+			p.useAccount(account)
+			current = &entry{directive: true}
+		case "commodity":
+			symbol := strings.Trim(stripComment(rest), `"`)
+			p.journal.DeclaredCommodities[symbol] = true
+			current = &entry{directive: true}
+			for j := i + 1; j < len(lines) && strings.TrimSpace(lines[j]) != "" && (lines[j][0] == ' ' || lines[j][0] == '\t'); j++ {
+				sub, value := splitWord(strings.TrimSpace(lines[j]))
+				if sub == "format" {
+					if a, ok := p.parseAmountText(name, j+1, value); ok {
+						p.journal.DeclaredCommodities[a.Currency] = true
+					}
+				}
+			}
+		case "apply":
+			kind, value := splitWord(rest)
+			entry := applyEntry{kind: kind, value: strings.TrimSpace(value), prevYear: p.year}
+			if kind == "year" {
+				p.setYear(name, lineNo, value)
+			}
+			p.apply = append(p.apply, entry)
+		case "end":
+			kind, _ := splitWord(rest)
+			if kind == "aliases" {
+				p.aliases = nil
+			} else if len(p.apply) == 0 {
+				p.errorf(name, lineNo, "'end' without a matching 'apply'")
+			} else {
+				last := p.apply[len(p.apply)-1]
+				if last.kind == "year" {
+					p.year = last.prevYear
+				}
+				p.apply = p.apply[:len(p.apply)-1]
+			}
+		case "include", "!include":
+			p.include(name, lineNo, stripComment(rest))
+		case "alias":
+			if eq := strings.Index(rest, "="); eq >= 0 {
+				p.setAlias(strings.TrimSpace(rest[:eq]), strings.TrimSpace(rest[eq+1:]))
+			} else {
+				p.errorf(name, lineNo, "alias without '='")
+			}
+		case "year", "Y":
+			p.setYear(name, lineNo, rest)
+		case "P":
+			p.parsePrice(name, lineNo, rest)
+		case "D":
+			p.parseAmountText(name, lineNo, rest)
+		case "payee", "tag", "define", "bucket", "A", "N", "C", "I", "O", "i", "o", "b", "h", "def", "assert", "check", "expr", "value", "python", "import", "eval":
+			current = &entry{directive: true}
+		default:
+			if len(word) > 1 && word[0] == 'Y' {
+				p.setYear(name, lineNo, word[1:])
+				continue
+			}
+			p.errorf(name, lineNo, "unknown directive %q", word)
+		}
+	}
+	finish(lastContent)
+}
+
+func splitWord(s string) (string, string) {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexAny(s, " \t"); i >= 0 {
+		return s[:i], strings.TrimSpace(s[i+1:])
+	}
+	return s, ""
+}
+
+// stripComment removes a trailing "; comment" from a directive argument.
+func stripComment(s string) string {
+	if i := strings.Index(s, ";"); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+func (p *journalParser) setYear(name string, lineNo int, value string) {
+	year, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		p.errorf(name, lineNo, "invalid year %q", value)
+		return
+	}
+	p.year = year
+}
+
+func (p *journalParser) include(name string, lineNo int, pattern string) {
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(name), pattern)
+	}
+	p.journal.Includes = append(p.journal.Includes, pattern)
+	files, err := filepath.Glob(pattern)
+	if err != nil || len(files) == 0 {
+		p.errorf(name, lineNo, "included file not found: %v", pattern)
+		return
+	}
+	for _, file := range files {
+		content, ok := p.files[file]
+		if !ok {
+			bytes, err := ioutil.ReadFile(file)
+			if err != nil {
+				p.errorf(name, lineNo, "error reading included file: %v", err)
+				continue
+			}
+			content = string(bytes)
+		}
+		// The active apply directives also apply to the included file, as in
+		// ledger, but those the file leaves open do not leak out of it.
+		saved := p.apply
+		p.apply = append([]applyEntry{}, saved...)
+		p.parse(file, content)
+		p.apply = saved
+	}
+}
+
+func (p *journalParser) useAccount(account string) {
+	for _, a := range p.journal.Accounts {
+		if a == account {
+			return
+		}
+	}
+	p.journal.Accounts = append(p.journal.Accounts, account)
+}
+
+// setAlias defines an alias, replacing an earlier one of the same name.
+func (p *journalParser) setAlias(from string, to string) {
+	for i := range p.aliases {
+		if p.aliases[i].from == from {
+			p.aliases[i].to = to
+			return
+		}
+	}
+	p.aliases = append(p.aliases, aliasEntry{from, to})
+}
+
+// applyAccount prefixes an account with the active "apply account"
+// directives and resolves aliases. Aliases are tried in the order they were
+// defined, and chains of them are followed, each alias at most once.
+func (p *journalParser) applyAccount(account string) string {
+	used := make([]bool, len(p.aliases))
+	for resolved := true; resolved; {
+		resolved = false
+		for i, alias := range p.aliases {
+			if !used[i] && (account == alias.from || strings.HasPrefix(account, alias.from+":")) {
+				account = alias.to + account[len(alias.from):]
+				used[i], resolved = true, true
+				break
+			}
+		}
+	}
+	for i := len(p.apply) - 1; i >= 0; i-- {
+		if p.apply[i].kind == "account" {
+			account = p.apply[i].value + ":" + account
+		}
+	}
+	return account
+}
+
+func (p *journalParser) parseDate(s string) (time.Time, error) {
+	s = strings.NewReplacer("-", "/", ".", "/").Replace(s)
+	parts := strings.Split(s, "/")
+	if len(parts) == 2 {
+		parts = append([]string{strconv.Itoa(p.year)}, parts...)
+	}
+	if len(parts) != 3 {
+		return time.Time{}, fmt.Errorf("invalid date %q", s)
+	}
+	year, _ := strconv.Atoi(parts[0])
+	month, _ := strconv.Atoi(parts[1])
+	day, _ := strconv.Atoi(parts[2])
+	date := time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+	if date.Year() != year || int(date.Month()) != month || date.Day() != day {
+		return time.Time{}, fmt.Errorf("invalid date %q", s)
+	}
+	return date, nil
+}
+
+func (p *journalParser) parseTransactionHeader(name string, lineNo int, line string) *Transaction {
+	m := journalDateRegex.FindStringSubmatch(line)
+	if m == nil {
+		p.errorf(name, lineNo, "invalid transaction date")
+		return nil
+	}
+	tx := &Transaction{Span: Span{name, lineNo, lineNo}}
+	var err error
+	if tx.Date, err = p.parseDate(m[1]); err != nil {
+		p.errorf(name, lineNo, "%v", err)
+		return nil
+	}
+	if m[2] != "" {
+		if tx.AuxDate, err = p.parseDate(m[2]); err != nil {
+			p.errorf(name, lineNo, "%v", err)
+		}
+	}
+	rest := strings.TrimSpace(line[len(m[0]):])
+	if strings.HasPrefix(rest, "*") || strings.HasPrefix(rest, "!") {
+		tx.State = rest[:1]
+		rest = strings.TrimSpace(rest[1:])
+	}
+	if c := journalCodeRegex.FindStringSubmatch(rest); c != nil {
+		tx.Code = c[1]
+		rest = rest[len(c[0]):]
+	}
+	payee, note := splitNote(rest)
+	tx.Payee = payee
+	if note != "" {
+		tx.Note = note
+		tx.Tags = parseTags(note, tx.Tags)
+	}
+	return tx
+}
+
+// splitNote splits "text ; note" at the first semicolon that starts a
+// comment, i.e. one at the beginning or after whitespace.
+func splitNote(s string) (string, string) {
+	for i := 0; i < len(s); i++ {
+		if s[i] == ';' && (i == 0 || s[i-1] == ' ' || s[i-1] == '\t') {
+			return strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:])
+		}
+	}
+	return strings.TrimSpace(s), ""
+}
+
+// parseTags extracts ":tag1:tag2:" and "Key: value" metadata from a comment.
+func parseTags(comment string, tags map[string]string) map[string]string {
+	if m := journalMetaRegex.FindStringSubmatch(comment); m != nil && !strings.HasPrefix(comment, ":") {
+		if tags == nil {
+			tags = map[string]string{}
+		}
+		tags[m[1]] = m[2]
+		return tags
+	}
+	for _, m := range journalTagsRegex.FindAllStringSubmatch(comment, -1) {
+		if tags == nil {
+			tags = map[string]string{}
+		}
+		for _, tag := range strings.Split(strings.Trim(m[1], ":"), ":") {
+			tags[tag] = ""
+		}
+	}
+	return tags
+}
+
+func (p *journalParser) parseEntryLine(name string, lineNo int, text string, e *entry) {
+	var postings *[]*Posting
+	var span *Span
+	switch {
+	case e.tx != nil:
+		postings, span = &e.tx.Postings, &e.tx.Span
+	case e.automated != nil:
+		postings, span = &e.automated.Postings, &e.automated.Span
+	case e.periodic != nil:
+		postings, span = &e.periodic.Postings, &e.periodic.Span
+	}
+	span.EndLine = lineNo
+
+	if strings.HasPrefix(text, ";") {
+		comment := strings.TrimSpace(text[1:])
+		if n := len(*postings); n > 0 {
+			last := (*postings)[n-1]
+			last.Comment = strings.TrimSpace(last.Comment + "\n" + comment)
+			last.Tags = parseTags(comment, last.Tags)
+		} else if e.tx != nil {
+			e.tx.Note = strings.TrimSpace(e.tx.Note + "\n" + comment)
+			e.tx.Tags = parseTags(comment, e.tx.Tags)
+		}
+		return
+	}
+
+	posting, err := p.parsePosting(name, lineNo, text)
+	if err != nil {
+		p.errorf(name, lineNo, "%v", err)
+		return
+	}
+	if e.tx != nil {
+		p.useAccount(posting.Account)
+	}
+	*postings = append(*postings, posting)
+}
+
+func (p *journalParser) parsePosting(name string, lineNo int, text string) (*Posting, error) {
+	posting := &Posting{Line: lineNo}
+	if strings.HasPrefix(text, "* ") || strings.HasPrefix(text, "! ") {
+		posting.State = text[:1]
+		text = strings.TrimSpace(text[1:])
+	}
+
+	end := len(text)
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\t' || (text[i] == ' ' && i+1 < len(text) && text[i+1] == ' ') ||
+			(text[i] == ';' && i > 0 && text[i-1] == ' ') {
+			end = i
+			break
+		}
+	}
+	account := strings.TrimSpace(text[:end])
+	rest := strings.TrimSpace(text[end:])
+
+	if n := len(account); n >= 2 && (account[0] == '(' && account[n-1] == ')' || account[0] == '[' && account[n-1] == ']') {
+		posting.Virtual = true
+		posting.Balanced = account[0] == '['
+		account = strings.TrimSpace(account[1 : n-1])
+	}
+	if account == "" {
+		return nil, fmt.Errorf("missing account name")
+	}
+	posting.Account = p.applyAccount(account)
+
+	amountText, comment := splitNote(rest)
+	if comment != "" {
+		posting.Comment = comment
+		posting.Tags = parseTags(comment, nil)
+	}
+	if amountText == "" {
+		return posting, nil
+	}
+	if strings.HasPrefix(amountText, "(") {
+		return nil, fmt.Errorf("value expressions are not supported: %v", amountText)
+	}
+
+	if eq := strings.Index(amountText, "="); eq >= 0 {
+		a, err := p.parseAmount(name, strings.TrimSpace(amountText[eq+1:]))
+		if err != nil {
+			return nil, err
+		}
+		posting.Assertion = &a
+		amountText = strings.TrimSpace(amountText[:eq])
+		if amountText == "" {
+			return posting, nil
+		}
+	}
+
+	costText, totalCost := "", false
+	if at := strings.Index(amountText, "@"); at >= 0 {
+		costText = amountText[at+1:]
+		if strings.HasPrefix(costText, "@") {
+			costText, totalCost = costText[1:], true
+		}
+		amountText = strings.TrimSpace(amountText[:at])
+	}
+
+	// Lot annotations: {price}, {{total}}, [date] and (note).
+	for _, lot := range journalLotRegex.FindAllStringSubmatch(amountText, -1) {
+		if costText == "" && strings.HasPrefix(lot[0], "{") {
+			costText, totalCost = lot[1], strings.HasPrefix(lot[0], "{{")
+		}
+	}
+	amountText = strings.TrimSpace(journalLotRegex.ReplaceAllString(amountText, ""))
+
+	a, err := p.parseAmount(name, amountText)
+	if err != nil {
+		return nil, err
+	}
+	posting.Amount = &a
+
+	if costText = strings.TrimSpace(costText); costText != "" {
+		c, err := p.parseAmount(name, costText)
+		if err != nil {
+			return nil, err
+		}
+		if !totalCost {
+			c.Value *= math.Abs(a.Value)
+		}
+		if a.Value < 0 {
+			c.Value = -math.Abs(c.Value)
+		} else {
+			c.Value = math.Abs(c.Value)
+		}
+		posting.Cost = &c
+	}
+	return posting, nil
+}
+
+// parseAmountText parses an amount in a directive, logging errors.
+func (p *journalParser) parseAmountText(name string, lineNo int, text string) (Amount, bool) {
+	a, err := p.parseAmount(name, stripComment(text))
+	if err != nil {
+		p.errorf(name, lineNo, "%v", err)
+		return a, false
+	}
+	return a, true
+}
+
+// parseAmount parses "$ -1,234.56", "-$5", "10 EUR" or "\"Acme Inc\" 3" and
+// records the commodity style it was written in.
+func (p *journalParser) parseAmount(name string, text string) (Amount, error) {
+	s := strings.TrimSpace(text)
+	negative := false
+	readSign := func() {
+		if strings.HasPrefix(s, "-") {
+			negative = !negative
+			s = strings.TrimSpace(s[1:])
+		} else if strings.HasPrefix(s, "+") {
+			s = strings.TrimSpace(s[1:])
+		}
+	}
+	readSign()
+
+	style := &CommodityStyle{}
+	symbol, number := "", ""
+	if m := journalNumberRegex.FindString(s); m != "" {
+		number = m
+		rest := s[len(m):]
+		style.Spaced = strings.HasPrefix(rest, " ") || strings.HasPrefix(rest, "\t")
+		symbol = readCommodity(strings.TrimSpace(rest))
+		if strings.TrimSpace(rest) != symbol && strings.Trim(strings.TrimSpace(rest), `"`) != symbol {
+			return Amount{}, fmt.Errorf("invalid amount %q", text)
+		}
+	} else {
+		symbol = readCommodity(s)
+		if symbol == "" {
+			return Amount{}, fmt.Errorf("invalid amount %q", text)
+		}
+		s = s[len(symbol):]
+		if strings.HasPrefix(s, `"`) {
+			s = s[1:]
+		}
+		style.Spaced = strings.HasPrefix(s, " ") || strings.HasPrefix(s, "\t")
+		style.Prefix = true
+		s = strings.TrimSpace(s)
+		readSign()
+		number = journalNumberRegex.FindString(s)
+		if number == "" || number != s {
+			return Amount{}, fmt.Errorf("invalid amount %q", text)
+		}
+	}
+	symbol = strings.Trim(symbol, `"`)
+
+	style.Symbol = symbol
+	style.Thousands = strings.Contains(number, ",")
+	if dot := strings.Index(number, "."); dot >= 0 {
+		style.Precision = len(number) - dot - 1
+	}
+	value, err := strconv.ParseFloat(strings.Replace(number, ",", "", -1), 64)
+	if err != nil {
+		return Amount{}, fmt.Errorf("invalid amount %q", text)
+	}
+	if negative {
+		value = -value
+	}
+	p.registerStyle(style)
+	return Amount{Currency: symbol, Value: value}, nil
+}
+
+// readCommodity returns the commodity symbol at the start of s, including
+// quotes if it is quoted.
+func readCommodity(s string) string {
+	if strings.HasPrefix(s, `"`) {
+		if end := strings.Index(s[1:], `"`); end >= 0 {
+			return s[:end+2]
+		}
+		return ""
+	}
+	i := 0
+	for i < len(s) && !strings.ContainsRune("0123456789.,-+*/^&|=<>{}[]()@; \t\"", rune(s[i])) {
+		i++
+	}
+	return s[:i]
+}
+
+func (p *journalParser) registerStyle(style *CommodityStyle) {
+	if p.noStyle {
+		return
+	}
+	existing, ok := p.journal.Commodities[style.Symbol]
+	if !ok {
+		p.journal.Commodities[style.Symbol] = style
+		return
+	}
+	if style.Precision > existing.Precision {
+		existing.Precision = style.Precision
+	}
+	if style.Thousands {
+		existing.Thousands = true
+	}
+}
+
+func (p *journalParser) parsePrice(name string, lineNo int, rest string) {
+	dateText, rest := splitWord(rest)
+	date, err := p.parseDate(dateText)
+	if err != nil {
+		p.errorf(name, lineNo, "%v", err)
+		return
+	}
+	// An optional time of day follows the date.
+	if word, after := splitWord(rest); strings.Count(word, ":") >= 1 && len(word) <= 8 && word[0] >= '0' && word[0] <= '9' {
+		rest = after
+	}
+	symbol := readCommodity(rest)
+	if symbol == "" {
+		p.errorf(name, lineNo, "missing commodity in price directive")
+		return
+	}
+	// Rates usually have more decimals than the commodity is shown with.
+	p.noStyle = true
+	price, ok := p.parseAmountText(name, lineNo, rest[len(symbol):])
+	p.noStyle = false
+	if !ok {
+		return
+	}
+	p.journal.Prices = append(p.journal.Prices, &PriceDirective{
+		Date:      date,
+		Commodity: strings.Trim(symbol, `"`),
+		Price:     price,
+		Span:      Span{name, lineNo, lineNo},
+	})
+}
+
+func (p *journalParser) finishEntry(name string, e *entry, endLine int) {
+	switch {
+	case e.tx != nil:
+		e.tx.Span.EndLine = endLine
+		p.applyAutomated(e.tx)
+		p.balanceTransaction(e.tx)
+		p.journal.Transactions = append(p.journal.Transactions, e.tx)
+	case e.automated != nil:
+		e.automated.Span.EndLine = endLine
+		p.journal.Automated = append(p.journal.Automated, e.automated)
+	case e.periodic != nil:
+		e.periodic.Span.EndLine = endLine
+		p.journal.Periodic = append(p.journal.Periodic, e.periodic)
+	}
+}
+
+// applyAutomated adds the postings of every automated transaction defined
+// so far whose predicate matches one of the transaction's postings. An
+// amount without commodity is a multiplier of the matched posting's amount.
+func (p *journalParser) applyAutomated(tx *Transaction) {
+	original := tx.Postings
+	for _, auto := range p.journal.Automated {
+		for _, matched := range original {
+			if matched.Amount == nil || !auto.Query.Match(tx, matched) {
+				continue
+			}
+			for _, template := range auto.Postings {
+				generated := *template
+				generated.Generated = true
+				generated.Line = auto.Span.StartLine
+				if template.Amount != nil {
+					a := *template.Amount
+					if a.Currency == "" {
+						a = Amount{Currency: matched.Amount.Currency, Value: a.Value * matched.Amount.Value}
+					}
+					generated.Amount = &a
+				}
+				tx.Postings = append(tx.Postings, &generated)
+				if !generated.Virtual {
+					p.useAccount(generated.Account)
+				}
+			}
+		}
+	}
+}
+
+func postingWeight(posting *Posting) Amount {
+	if posting.Cost != nil {
+		return *posting.Cost
+	}
+	return *posting.Amount
+}
+
+// balanceTransaction infers elided amounts and balance assignments, checks
+// balance assertions and reports transactions that do not balance.
+func (p *journalParser) balanceTransaction(tx *Transaction) {
+	line := tx.Span.StartLine
+	name := tx.Span.File
+
+	// Balance assignments: "Account  = $100" sets the amount to whatever
+	// brings the account to that balance.
+	for _, posting := range tx.Postings {
+		if posting.Amount == nil && posting.Assertion != nil {
+			current := p.balances[posting.Account][posting.Assertion.Currency]
+			posting.Amount = &Amount{Currency: posting.Assertion.Currency, Value: posting.Assertion.Value - current}
+			posting.Inferred = true
+		}
+	}
+
+	sum := Balance{}
+	var elided *Posting
+	for _, posting := range tx.Postings {
+		if posting.Virtual && !posting.Balanced {
+			if posting.Amount == nil {
+				posting.Amount = &Amount{}
+				posting.Inferred = true
+			}
+			continue
+		}
+		if posting.Amount == nil {
+			if elided != nil {
+				p.errorf(name, posting.Line, "only one posting with null amount allowed per transaction")
+				posting.Amount = &Amount{}
+				continue
+			}
+			elided = posting
+			continue
+		}
+		sum.Add(postingWeight(posting))
+	}
+
+	if elided != nil {
+		elided.Inferred = true
+		commodities := []string{}
+		for _, c := range sum.Commodities() {
+			if math.Abs(sum[c]) > p.journal.tolerance(c) {
+				commodities = append(commodities, c)
+			}
+		}
+		if len(commodities) == 0 {
+			elided.Amount = &Amount{}
+		}
+		for i, c := range commodities {
+			a := &Amount{Currency: c, Value: -sum[c]}
+			if i == 0 {
+				elided.Amount = a
+				continue
+			}
+			extra := *elided
+			extra.Amount = a
+			tx.Postings = append(tx.Postings, &extra)
+		}
+	} else if !p.journal.IsZero(sum) {
+		residual := []string{}
+		for _, c := range sum.Commodities() {
+			if math.Abs(sum[c]) > p.journal.tolerance(c) {
+				residual = append(residual, c)
+			}
+		}
+		if len(residual) == 2 && !hasCost(tx) {
+			// Two commodities without an explicit price: the first one was
+			// exchanged for the second at whatever rate balances them.
+			from, to := residual[0], residual[1]
+			for _, posting := range tx.Postings {
+				if posting.Amount.Currency == from && !(posting.Virtual && !posting.Balanced) {
+					posting.Cost = &Amount{Currency: to, Value: -sum[to] * posting.Amount.Value / sum[from]}
+				}
+			}
+		} else {
+			parts := []string{}
+			for _, c := range residual {
+				parts = append(parts, p.journal.FormatAmount(Amount{Currency: c, Value: sum[c]}))
+			}
+			p.errorf(name, line, "transaction does not balance: %s", strings.Join(parts, ", "))
+		}
+	}
+
+	for _, posting := range tx.Postings {
+		b := p.balances[posting.Account]
+		if b == nil {
+			b = Balance{}
+			p.balances[posting.Account] = b
+		}
+		b.Add(*posting.Amount)
+		if posting.Assertion != nil && !posting.Inferred {
+			actual := b[posting.Assertion.Currency]
+			if math.Abs(actual-posting.Assertion.Value) > p.journal.tolerance(posting.Assertion.Currency) {
+				p.errorf(name, posting.Line, "balance assertion failed for %s: expected %s, got %s",
+					posting.Account,
+					p.journal.FormatAmount(*posting.Assertion),
+					p.journal.FormatAmount(Amount{Currency: posting.Assertion.Currency, Value: actual}))
+			}
+		}
+	}
+}
+
+func hasCost(tx *Transaction) bool {
+	for _, posting := range tx.Postings {
+		if posting.Cost != nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const sampleJournal = `; household ledger
+account Assets:Bancos:BROU
+commodity US$
+    format US$ 1,000.00
+
+2026/10/01 * (42) UTE  ; :cuentas:
+    Expenses:Cuentas:UTE      $ 1,500.00
+    Assets:Bancos:BROU
+
+2026/10/02 Cambio
+    Assets:Bancos:Itau        US$ 100.00 @ $ 40.00
+    Assets:Bancos:BROU        $ -4,000.00
+
+apply account Personal
+2026/10/03 Cultocafe
+    ; Receipt: yes
+    Expenses:Cafe             $ 250
+    Assets:Cash
+end apply account
+
+2026/10/04 Mixto
+    Expenses:Viaje            US$ 10.00
+    Expenses:Cafe             $ 100.00
+    Assets:Cash
+
+comment
+2026/10/05 ignored
+    Expenses:Nothing   $ 1
+end comment
+`
+
+func TestParseJournal(t *testing.T) {
+	j := ParseJournal("", sampleJournal)
+	if len(j.Errors) > 0 {
+		t.Fatalf("unexpected errors: %v", j.Errors)
+	}
+	if len(j.Transactions) != 4 {
+		t.Fatalf("expected 4 transactions, got %d", len(j.Transactions))
+	}
+
+	ute := j.Transactions[0]
+	if ute.State != "*" || ute.Code != "42" || ute.Payee != "UTE" {
+		t.Errorf("bad header: %+v", ute)
+	}
+	if _, ok := ute.Tags["cuentas"]; !ok {
+		t.Errorf("expected cuentas tag, got %v", ute.Tags)
+	}
+	if ute.Span.StartLine != 6 || ute.Span.EndLine != 8 {
+		t.Errorf("bad span %+v", ute.Span)
+	}
+	elided := ute.Postings[1]
+	if !elided.Inferred || elided.Amount.Value != -1500 || elided.Amount.Currency != "$" {
+		t.Errorf("bad inferred posting %+v", elided.Amount)
+	}
+
+	cambio := j.Transactions[1]
+	if cost := cambio.Postings[0].Cost; cost == nil || cost.Value != 4000 || cost.Currency != "$" {
+		t.Errorf("bad cost %+v", cost)
+	}
+
+	cafe := j.Transactions[2]
+	if cafe.Postings[0].Account != "Personal:Expenses:Cafe" {
+		t.Errorf("apply account not applied: %v", cafe.Postings[0].Account)
+	}
+	if cafe.Tags["Receipt"] != "yes" {
+		t.Errorf("expected metadata, got %v", cafe.Tags)
+	}
+
+	mixto := j.Transactions[3]
+	if len(mixto.Postings) != 4 {
+		t.Fatalf("expected elided posting split per commodity, got %d postings", len(mixto.Postings))
+	}
+
+	if !j.DeclaredAccounts["Assets:Bancos:BROU"] || !j.DeclaredCommodities["US$"] {
+		t.Errorf("missing declarations")
+	}
+	if got := j.FormatAmount(Amount{Currency: "$", Value: -4000}); got != "$ -4,000.00" {
+		t.Errorf("FormatAmount = %q", got)
+	}
+}
+
+func TestParseJournalErrors(t *testing.T) {
+	j := ParseJournal("", `2026/10/01 Unbalanced
+    Expenses:Food    $ 10
+    Assets:Cash      $ -9
+
+2026/10/02 Two nulls
+    Expenses:Food
+    Assets:Cash
+
+2026/10/03 Assertion
+    Assets:Cash      $ 0 = $ 5
+`)
+	lines := []int{}
+	for _, e := range j.Errors {
+		lines = append(lines, e.Line)
+	}
+	if len(lines) != 3 || lines[0] != 1 || lines[1] != 7 || lines[2] != 10 {
+		t.Errorf("unexpected errors: %v", j.Errors)
+	}
+}
+
+func TestParseJournalIncludeAndAutomated(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "prices.ledger"), []byte("P 2026/10/01 US$ $ 40.50\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	main := filepath.Join(dir, "main.ledger")
+	err = os.WriteFile(main, []byte(`include prices.ledger
+
+= /^Expenses:Comida/
+    (Budget:Comida)    -1
+
+2026/10/01 Tienda Inglesa
+    Expenses:Comida    $ 100
+    Assets:Cash
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j := ParseJournalFile(main)
+	if len(j.Errors) > 0 {
+		t.Fatalf("unexpected errors: %v", j.Errors)
+	}
+	if len(j.Prices) != 1 || j.Prices[0].Commodity != "US$" || j.Prices[0].Price.Value != 40.5 {
+		t.Errorf("bad prices %+v", j.Prices)
+	}
+	postings := j.Transactions[0].Postings
+	if len(postings) != 3 || !postings[2].Generated || postings[2].Amount.Value != -100 {
+		t.Errorf("automated posting not generated: %+v", postings)
+	}
+}
+
+func TestParseJournalApplyIncludeAndAliases(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "casa.ledger"), []byte(`10/02 Cafe
+    Expenses:Cafe    $ 100
+    Cash
+
+apply account Left
+end apply account
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	main := filepath.Join(dir, "main.ledger")
+	err = os.WriteFile(main, []byte(`alias Cash=Caja
+alias Caja=Assets:Caja
+alias Assets:Caja=Assets:Efectivo
+year 2025
+apply account Casa
+apply year 2026
+include casa.ledger
+end apply year
+end apply account
+
+10/03 Otro
+    Expenses:Cafe    $ 1
+    Cash
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j := ParseJournalFile(main)
+	if len(j.Errors) > 0 {
+		t.Fatalf("unexpected errors: %v", j.Errors)
+	}
+	if len(j.Transactions) != 2 {
+		t.Fatalf("expected 2 transactions, got %v", len(j.Transactions))
+	}
+	included, after := j.Transactions[0], j.Transactions[1]
+	if included.Postings[0].Account != "Casa:Expenses:Cafe" || included.Postings[1].Account != "Casa:Assets:Efectivo" || included.Date.Year() != 2026 {
+		t.Errorf("apply not active in the included file: %v %v %v", included.Postings[0].Account, included.Postings[1].Account, included.Date)
+	}
+	if after.Postings[0].Account != "Expenses:Cafe" || after.Postings[1].Account != "Assets:Efectivo" || after.Date.Year() != 2025 {
+		t.Errorf("apply leaked after its end: %v %v %v", after.Postings[0].Account, after.Postings[1].Account, after.Date)
+	}
+}
+
+func TestValidateJournal(t *testing.T) {
+	content := `commodity $
+account Assets:Cash
+account Expenses:Food
+
+2024/01/01 Lunch
+  Expenses:Food  $ 10
+  Assets:Cash  $ -9
+
+2024/01/02 Dinner
+  Expenses:Restaurant  10 EUR
+  Assets:Cash
+`
+	journal := ParseJournal("/tmp/test.ledger", content)
+	errors := ValidateJournal(journal, "/tmp/test.ledger", ValidationOptions{})
+	if len(errors) != 2 || errors[0].Line != 5 || errors[1].Line != 10 || !strings.Contains(errors[1].Message, "EUR") {
+		t.Errorf("unexpected errors: %v", errors)
+	}
+	errors = ValidateJournal(journal, "/tmp/test.ledger", ValidationOptions{DeclaredAccounts: true})
+	if len(errors) != 3 || !strings.Contains(errors[2].Message, "Expenses:Restaurant") {
+		t.Errorf("unexpected errors with declared accounts: %v", errors)
+	}
+}
+
+func TestFormatEntry(t *testing.T) {
+	journal := ParseJournal("test.ledger", sampleJournal)
+	tx := NewTransaction{
+		Date:    "2026-10-06",
+		Payee:   "Tienda Inglesa",
+		Comment: "weekly groceries",
+		Postings: []NewPosting{
+			{Account: "Expenses:Supermercado", Amount: "$1234.5"},
+			{Account: "Expenses:Cafe", Amount: "$ 80", Comment: "coffee"},
+			{Account: "Assets:Cash"},
+			{},
+		},
+	}
+	entry, err := FormatEntry(journal, tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `2026/10/06 Tienda Inglesa
+    ; weekly groceries
+    Expenses:Supermercado    $ 1,234.50
+    Expenses:Cafe               $ 80.00  ; coffee
+    Assets:Cash
+`
+	if entry != expected {
+		t.Errorf("entry:\n%v\nexpected:\n%v", entry, expected)
+	}
+
+	tx.Postings[2].Amount = "$ -1000"
+	if _, err := FormatEntry(journal, tx); err == nil || !strings.Contains(err.Error(), "balance") {
+		t.Errorf("expected a balance error, got %v", err)
+	}
+
+	tx.Comment = ""
+	tx.Postings = []NewPosting{{Account: "Expenses:Cafe", Amount: "$ 10.555"}, {Account: "Assets:Cash"}}
+	if entry, err := FormatEntry(journal, tx); err != nil || !strings.Contains(entry, "$ 10.555\n") {
+		t.Errorf("decimals not kept as typed: %v %v", entry, err)
+	}
+	for _, payee := range []string{"Cafe ; note", "* Cafe", "!Cafe", "(123) Cafe", ";foo", "Cafe\t;note"} {
+		tx.Payee = payee
+		if _, err := FormatEntry(journal, tx); err == nil {
+			t.Errorf("payee %q accepted", payee)
+		}
+	}
+}
+
+func TestInsertEntry(t *testing.T) {
+	file := `; header
+commodity $
+
+; October
+2026/10/01 A
+    Expenses:A    $ 1
+    Assets:Cash
+
+2026/10/03 C
+    Expenses:C    $ 3
+    Assets:Cash
+; trailing comment
+`
+	entry := "2026/10/02 B\n    Expenses:B    $ 2\n    Assets:Cash\n"
+	expected := `; header
+commodity $
+
+; October
+2026/10/01 A
+    Expenses:A    $ 1
+    Assets:Cash
+
+2026/10/02 B
+    Expenses:B    $ 2
+    Assets:Cash
+
+2026/10/03 C
+    Expenses:C    $ 3
+    Assets:Cash
+; trailing comment
+`
+	if result := InsertEntry("test.ledger", file, entry); result != expected {
+		t.Errorf("inserted in the middle:\n%v", result)
+	}
+
+	early := "2026/09/30 Z\n    Expenses:Z    $ 2\n    Assets:Cash\n"
+	expected = strings.Replace(file, "; October\n", early+"\n; October\n", 1)
+	if result := InsertEntry("test.ledger", file, early); result != expected {
+		t.Errorf("inserted before the first transaction:\n%v", result)
+	}
+
+	late := "2026/10/04 D\n    Expenses:D    $ 2\n    Assets:Cash\n"
+	expected = strings.Replace(file, "    Assets:Cash\n; trailing", "    Assets:Cash\n\n"+late+"\n; trailing", 1)
+	if result := InsertEntry("test.ledger", file, late); result != expected {
+		t.Errorf("inserted after the last transaction:\n%v", result)
+	}
+
+	applied := "apply account Personal\n2026/10/01 A\n    Expenses:A    $ 1\n    Assets:Cash\nend apply account\n"
+	if result := InsertEntry("test.ledger", applied, late); result != appendEntry(applied, late) {
+		t.Errorf("inserted inside apply account:\n%v", result)
+	}
+
+	// Anything else than a single transaction goes at the end.
+	for _, text := range []string{
+		"account Expenses:B\n" + entry,
+		entry + "P 2026/10/02 US$ $ 40\n",
+		entry + "; B\n",
+		"alias B=Expenses:B\n2026/10/02 B\n    B    $ 2\n    Assets:Cash\n",
+	} {
+		if result := InsertEntry("test.ledger", file, text); result != appendEntry(file, text) {
+			t.Errorf("inserted %q in the middle:\n%v", text, result)
+		}
+	}
+}
+
+func TestChangeSummary(t *testing.T) {
+	old := ParseJournal("/tmp/test.ledger", sampleJournal)
+	edited := strings.Replace(sampleJournal, "$ 250", "$ 260", 1)
+	edited = strings.Replace(edited, "2026/10/04 Mixto", "2026/10/04 Mixto  ; moved", 1)
+	edited += "\n2026/10/06 Antel\n    Expenses:Antel    $ 100\n    Assets:Cash\n"
+	edited += "\n2026/10/08 Spotify\n    Expenses:Spotify    $ 200\n    Assets:Cash\n"
+	changes := DiffJournals(old, ParseJournal("/tmp/test.ledger", edited))
+	expected := "Add 2 transactions (2026-10-06..2026-10-08): Antel, Spotify; edit 2 transactions (2026-10-03..2026-10-04): Cultocafe, Mixto"
+	if summary := ChangeSummary(changes); summary != expected {
+		t.Errorf("summary %q, expected %q", summary, expected)
+	}
+	if message := CommitMessage("Monthly bills", changes[:1]); message != "Monthly bills\n\nEdit transaction 2026-10-03 Cultocafe" {
+		t.Errorf("unexpected message %q", message)
+	}
+}
@@ -2,26 +2,71 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/mattn/go-shellwords"
 	"io/ioutil"
-	"net/smtp"
 	"os"
 	"os/exec"
 	"path"
-	"regexp"
-	"strings"
 )
 
 type LedgerDef struct {
 	Url    string
 	Path   string
-	Users  []string
+	Users  []string          // full editors
+	Roles  map[string]string // email to "read", "append" or "edit"
 	Notify []LedgerNotify
+
+	// RequireDeclaredAccounts rejects saves posting to accounts without an
+	// account directive.
+	RequireDeclaredAccounts bool
+
+	SyncInterval  string // how often to pull, as in "5m"
+	WebhookSecret string // authenticates calls to /{ledger}/sync
+
+	// Budget is the monthly budget of accounts, e.g. "Expenses:Comida":
+	// "$ 20,000". It overrides the periodic transactions of the journal.
+	Budget map[string]string
+
+	PricesFile string // where prices are written, "prices.ledger" by default
+
+	// BankAccounts maps the accounts of uploaded statements to ledger
+	// accounts.
+	BankAccounts []BankAccount
+
+	// CSVProfiles describe the CSV statements of banks, besides those saved
+	// from the reconcile page.
+	CSVProfiles []CSVProfile
+
+	// Dashboard are the totals shown on /{ledger}/dashboard. If empty, they
+	// are read from dashboard.json next to the ledger file.
+	Dashboard []DashboardWidget
 }
 
-type LedgerNotify struct {
-	Target string
-	Regex  string
+// Role is what a user may do with a ledger. Each role includes the ones
+// before it.
+type Role int
+
+const (
+	RoleNone   Role = iota
+	RoleRead        // view the ledger and run queries
+	RoleAppend      // add transactions and reconcile statements
+	RoleEdit        // overwrite the whole file
+)
+
+var roleNames = map[string]Role{
+	"read":   RoleRead,
+	"append": RoleAppend,
+	"edit":   RoleEdit,
+}
+
+func (role Role) String() string {
+	for name, r := range roleNames {
+		if r == role {
+			return name
+		}
+	}
+	return "none"
 }
 
 var ledgers map[string]LedgerDef
@@ -42,6 +87,11 @@ func InitLedgers() {
 	root, _ := os.Getwd()
 
 	for name, def := range ledgers {
+		for email, role := range def.Roles {
+			if _, ok := roleNames[role]; !ok {
+				Log("Unknown role %q for %v in ledger %v", role, email, name)
+			}
+		}
 		dir := path.Join(root, "repos", name)
 		_, err = os.Stat(dir)
 		if os.IsNotExist(err) {
@@ -58,9 +108,18 @@ func LedgerPath(ledger string) string {
 	return path.Join(root, "repos", ledger, ledgers[ledger].Path)
 }
 
-func UpdateLedger(ledger string) {
-	ledger_path := path.Dir(LedgerPath(ledger))
-	Run(ledger_path, "git", "pull", "origin", "master")
+// UpdateLedger pulls the ledger's repository and refreshes its snapshot.
+func UpdateLedger(ledger string) error {
+	repo := LedgerRepo(ledger)
+	return repo.Do(func() error {
+		err := repo.Pull()
+		syncError := ""
+		if err != nil {
+			syncError = err.Error()
+		}
+		refreshSnapshot(repo, syncError)
+		return err
+	})
 }
 
 func ReadLedger(ledger string) string {
@@ -71,40 +130,171 @@ func ReadLedger(ledger string) string {
 	return string(bytes)
 }
 
-func WriteLedger(ledger string, file string, author string) {
-	ledger_path := LedgerPath(ledger)
-	ledger_dir := path.Dir(ledger_path)
-	Run(ledger_dir, "git", "pull", "origin", "master")
-	err := ioutil.WriteFile(ledger_path, []byte(file), os.ModePerm)
-	if err != nil {
-		Log("Error %v", err)
-		return
-	}
-	Run(ledger_dir, "git", "add", ledgers[ledger].Path)
-	Run(ledger_dir, "git", "commit", "-m", "webledger", "--author", author)
-	Run(ledger_dir, "git", "push", "origin", "master")
+// WriteLedger replaces the ledger file, commits and pushes it. The commit
+// message describes the changed transactions after the optional message.
+func WriteLedger(ledger string, file string, author string, message string) error {
+	repo := LedgerRepo(ledger)
+	return repo.Do(func() error {
+		if err := repo.Pull(); err != nil {
+			return err
+		}
+		return commitLedger(repo, file, author, message)
+	})
+}
 
-	diff := Run(ledger_dir, "git", "diff", "HEAD^", "-U0")
-	for _, notify := range ledgers[ledger].Notify {
-		re := regexp.MustCompile(notify.Regex)
-		if re.MatchString(diff) {
-			Log("Notify match, send mail to %v", notify.Target)
-			SendNotifyMail(ledger, diff, notify.Target)
+// EditLedger is WriteLedger for an edit of the file as it was at revision
+// base. Changes committed since are merged in, or a ConflictError is
+// returned if they conflict.
+func EditLedger(ledger string, base string, file string, author string, message string) error {
+	repo := LedgerRepo(ledger)
+	return repo.Do(func() error {
+		if err := repo.Pull(); err != nil {
+			return err
 		}
-	}
+		if errors := ConflictMarkerErrors(repo.Path(), file); len(errors) > 0 {
+			return &ValidationError{Errors: errors}
+		}
+		head := repo.Revision()
+		if base != "" && base != head {
+			merged, clean := repo.Merge(base, file)
+			if !clean {
+				return &ConflictError{Ledger: ledger, Base: base, Head: head, Diff: repo.Changes(base, head), Merged: merged}
+			}
+			file = merged
+		}
+		return commitLedger(repo, file, author, message)
+	})
+}
+
+// AppendLedger adds text at the end of the ledger file, separated by a
+// blank line.
+func AppendLedger(ledger string, text string, author string, message string) error {
+	repo := LedgerRepo(ledger)
+	return repo.Do(func() error {
+		if err := repo.Pull(); err != nil {
+			return err
+		}
+		file, err := repo.Read()
+		if err != nil {
+			return err
+		}
+		return commitLedger(repo, appendEntry(file, text), author, message)
+	})
+}
+
+// InsertLedger adds a transaction entry to the ledger file in date order,
+// as described in InsertEntry.
+func InsertLedger(ledger string, entry string, author string, message string) error {
+	repo := LedgerRepo(ledger)
+	return repo.Do(func() error {
+		if err := repo.Pull(); err != nil {
+			return err
+		}
+		file, err := repo.Read()
+		if err != nil {
+			return err
+		}
+		return commitLedger(repo, InsertEntry(repo.Path(), file, entry), author, message)
+	})
 }
 
-func SendNotifyMail(ledger string, text string, target string) {
-	msg := `From: ledgers@server.max.uy
-To: ` + target + `
-Subject: Ledger notification from ` + ledger + `
+// RevertLedger undoes the changes a commit made to the ledger file, merged
+// with the changes made since, and commits the result. It returns a
+// ConflictError if later changes touch the same lines.
+func RevertLedger(ledger string, commit Commit, author string) error {
+	repo := LedgerRepo(ledger)
+	return repo.Do(func() error {
+		if err := repo.Pull(); err != nil {
+			return err
+		}
+		after, err := repo.FileAt(commit.Hash)
+		if err != nil {
+			return err
+		}
+		before, err := repo.FileAt(commit.Hash + "^")
+		if err != nil {
+			return err
+		}
+		current, err := repo.Read()
+		if err != nil {
+			return err
+		}
+		reverted, clean, err := mergeText(after, before, current)
+		if err != nil {
+			return err
+		}
+		if !clean {
+			head := repo.Revision()
+			return &ConflictError{Ledger: ledger, Base: commit.Hash, Head: head, Diff: repo.Changes(commit.Hash, head)}
+		}
+		message := fmt.Sprintf("Revert %v %q", commit.Short(), commit.Subject)
+		return commitLedger(repo, reverted, author, message)
+	})
+}
 
-` + text
+// LedgerRevision returns the commit the ledger's working tree is at.
+func LedgerRevision(ledger string) string {
+	repo := LedgerRepo(ledger)
+	var revision string
+	repo.Do(func() error {
+		revision = repo.Revision()
+		return nil
+	})
+	return revision
+}
 
-	err := smtp.SendMail("localhost:25", nil, "ledgers@server.max.uy", []string{target}, []byte(msg))
+// commitLedger validates, writes, commits and pushes the ledger file, along
+// with the other files given, already written, and sends the notifications
+// matching the change. Only errors the new files add to the current ones
+// reject it. It runs inside Repo.Do.
+func commitLedger(repo *Repo, file string, author string, message string, files ...string) error {
+	current, err := repo.Read()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// The other files are already written, so the current journal reads
+	// them as last committed.
+	lastCommitted := map[string]string{}
+	for _, name := range files {
+		if lastCommitted[path.Join(repo.dir, name)], err = repo.ReadFileAt("HEAD", name); err != nil {
+			return err
+		}
+	}
+	journal := ParseJournal(repo.Path(), file)
+	currentJournal := parseJournalWith(repo.Path(), current, lastCommitted)
+	options := ValidationOptions{DeclaredAccounts: ledgers[repo.ledger].RequireDeclaredAccounts}
+	errors := NewErrors(ValidateJournal(journal, repo.Path(), options), file, ValidateJournal(currentJournal, repo.Path(), options), current)
+	for _, name := range files {
+		filePath := path.Join(repo.dir, name)
+		text, _ := repo.ReadFile(name)
+		errors = append(errors, NewErrors(ValidateJournal(journal, filePath, options), text, ValidateJournal(currentJournal, filePath, options), lastCommitted[filePath])...)
+	}
+	if len(errors) > 0 {
+		return &ValidationError{Errors: errors}
+	}
+	changes := DiffJournals(currentJournal, journal)
+	message = CommitMessage(message, changes)
+	head := repo.Revision()
+	committed := false
+	err = repo.Write(file)
+	if err == nil {
+		committed, err = repo.Commit(message, author, files...)
+	}
+	if err == nil {
+		err = repo.Push()
+	}
 	if err != nil {
-		Log("Error sending mail: %v", err)
+		// Otherwise the change would go out with the next save.
+		repo.Restore(head, append([]string{repo.file}, files...)...)
 	}
+	refreshSnapshot(repo, "")
+	if err != nil || !committed {
+		return err
+	}
+
+	diff, _ := gitOutput(repo.dir, "diff", "HEAD^", "-U0")
+	go NotifyChange(repo.ledger, journal, changes, author, message, diff)
+	return nil
 }
 
 func Run(dir string, name string, arg ...string) string {
@@ -119,14 +309,32 @@ func Run(dir string, name string, arg ...string) string {
 	return string(out)
 }
 
+// LedgerExec runs a ledger query such as "bal assets" with the built-in
+// report engine. Queries it does not support are passed to the ledger
+// binary if one is installed.
 func LedgerExec(ledger string, query string) string {
 	parsed_query, err := shellwords.Parse(query)
 	if err != nil {
 		Log("Error %v", err)
 		return err.Error()
 	}
-	params := append([]string{"-f", LedgerPath(ledger)}, parsed_query...)
 	Log("ledger %v", query)
+	result, err := RunReport(LedgerJournal(ledger), parsed_query)
+	if err == errUnsupportedReport {
+		return ledgerBinaryExec(ledger, parsed_query)
+	}
+	if err != nil {
+		Log("Error %v", err)
+		return err.Error()
+	}
+	return result
+}
+
+func ledgerBinaryExec(ledger string, parsed_query []string) string {
+	if _, err := exec.LookPath("ledger"); err != nil {
+		return "Unsupported query and ledger is not installed"
+	}
+	params := append([]string{"-f", LedgerPath(ledger)}, parsed_query...)
 	result, err := exec.Command("ledger", params...).CombinedOutput()
 	if err != nil {
 		Log("Error %v", err)
@@ -134,28 +342,25 @@ func LedgerExec(ledger string, query string) string {
 	return string(result)
 }
 
+// LedgerAccounts lists the accounts declared or used in a ledger, in order
+// of appearance.
 func LedgerAccounts(ledger string) []string {
-	re := regexp.MustCompile("(?m)^[ \\t]+(\\w.*?)([ \\t]{2}.*?)?$")
-	matches := re.FindAllStringSubmatch(ReadLedger(ledger), -1)
-	accounts := []string{}
-	set := map[string]bool{}
-	for _, match := range matches {
-		account := strings.TrimSpace(match[1])
-		if !set[account] {
-			accounts = append(accounts, account)
-			set[account] = true
-		}
-	}
-	return accounts
+	return LedgerJournal(ledger).Accounts
 }
 
-func AuthLedger(ledger string, email string) bool {
+// LedgerRole returns the role of a user in a ledger. Users listed in Users
+// are editors; Roles can grant less.
+func LedgerRole(ledger string, email string) Role {
 	for _, user := range ledgers[ledger].Users {
 		if user == email {
-			return true
+			return RoleEdit
 		}
 	}
-	return false
+	return roleNames[ledgers[ledger].Roles[email]]
+}
+
+func AuthLedger(ledger string, email string) bool {
+	return LedgerRole(ledger, email) >= RoleRead
 }
 
 func AuthLedgers(email string) []string {
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMergeText(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	base := "2024/01/01 A\n  a  1\n  b\n\n2024/01/02 B\n  a  2\n  b\n"
+	ours := "2024/01/01 A\n  a  10\n  b\n\n2024/01/02 B\n  a  2\n  b\n"
+	theirs := "2024/01/01 A\n  a  1\n  b\n\n2024/01/02 B\n  a  2\n  b\n\n2024/01/03 C\n  a  3\n  b\n"
+
+	merged, clean, err := mergeText(base, ours, theirs)
+	if err != nil || !clean {
+		t.Fatalf("mergeText failed: %v %v", clean, err)
+	}
+	expected := "2024/01/01 A\n  a  10\n  b\n\n2024/01/02 B\n  a  2\n  b\n\n2024/01/03 C\n  a  3\n  b\n"
+	if merged != expected {
+		t.Errorf("merged:\n%v\nexpected:\n%v", merged, expected)
+	}
+
+	conflicting := "2024/01/01 A\n  a  5\n  b\n\n2024/01/02 B\n  a  2\n  b\n"
+	if _, clean, err := mergeText(base, ours, conflicting); err != nil || clean {
+		t.Errorf("expected a conflict, got clean=%v err=%v", clean, err)
+	}
+}
+
+func TestEditLedger(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	root := t.TempDir()
+	git := func(dir string, arg ...string) {
+		cmd := exec.Command("git", arg...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", arg, err, out)
+		}
+	}
+	git(root, "init", "--bare", "-b", "master", "remote.git")
+	git(root, "clone", "remote.git", "work")
+	work := root + "/work"
+	git(work, "config", "user.email", "test@example.com")
+	git(work, "config", "user.name", "test")
+	git(work, "commit", "--allow-empty", "-m", "init")
+	git(work, "push", "origin", "master")
+
+	saved := ledgers
+	defer func() { ledgers = saved; delete(repos, "test"); delete(snapshots, "test") }()
+	ledgers = map[string]LedgerDef{"test": {}}
+	repos["test"] = &Repo{ledger: "test", dir: work, file: "main.ledger"}
+	author := "webledger <test@example.com>"
+
+	base := "2024/01/01 A\n  a  1\n  b\n\n2024/01/02 B\n  a  2\n  b\n"
+	if err := WriteLedger("test", base, author, ""); err != nil {
+		t.Fatal(err)
+	}
+	revision := LedgerRevision("test")
+	if subject, _ := gitOutput(work, "log", "-1", "--format=%s"); subject != "Add 2 transactions (2024-01-01..2024-01-02): A, B\n" {
+		t.Errorf("unexpected commit message %q", subject)
+	}
+
+	first := "2024/01/01 A\n  a  10\n  b\n\n2024/01/02 B\n  a  2\n  b\n"
+	if err := EditLedger("test", revision, first, author, ""); err != nil {
+		t.Fatal(err)
+	}
+	second := "2024/01/01 A\n  a  1\n  b\n\n2024/01/02 B\n  a  20\n  b\n"
+	if err := EditLedger("test", revision, second, author, "Fix B"); err != nil {
+		t.Fatal(err)
+	}
+	expected := "2024/01/01 A\n  a  10\n  b\n\n2024/01/02 B\n  a  20\n  b\n"
+	if file, _ := repos["test"].Read(); file != expected {
+		t.Errorf("merged file:\n%v\nexpected:\n%v", file, expected)
+	}
+	if snapshot := LedgerSnapshot("test"); snapshot.File != expected || snapshot.Revision != LedgerRevision("test") {
+		t.Errorf("snapshot not refreshed after save: %v %q", snapshot.Revision, snapshot.File)
+	}
+
+	repo := repos["test"]
+	commits, err := repo.History("", 10)
+	if err != nil || len(commits) != 3 {
+		t.Fatalf("expected 3 commits, got %v %v", commits, err)
+	}
+	if commits[0].Subject != "Fix B" || commits[0].Body != "Edit transaction 2024-01-02 B" {
+		t.Errorf("unexpected message %q %q", commits[0].Subject, commits[0].Body)
+	}
+	changes, err := CommitChanges(repo, commits[0])
+	if err != nil || len(changes) != 1 || changes[0].Kind != "edit" || changes[0].Payee != "B" {
+		t.Errorf("unexpected changes %v %v", changes, err)
+	}
+	if err := RevertLedger("test", commits[0], author); err != nil {
+		t.Fatal(err)
+	}
+	if file, _ := repo.Read(); file != first {
+		t.Errorf("reverted file:\n%v\nexpected:\n%v", file, first)
+	}
+
+	conflicting := "2024/01/01 A\n  a  5\n  b\n\n2024/01/02 B\n  a  2\n  b\n"
+	err = EditLedger("test", revision, conflicting, author, "")
+	conflict, ok := err.(*ConflictError)
+	if !ok || conflict.Diff == "" || !strings.Contains(conflict.Merged, "<<<<<<< yours\n") {
+		t.Fatalf("expected a conflict with a diff and markers, got %v", err)
+	}
+	if err := EditLedger("test", conflict.Head, conflict.Merged, author, ""); err == nil {
+		t.Errorf("saved a file with conflict markers")
+	}
+	if err := EditLedger("test", revision, conflicting, author, ""); err == nil {
+		t.Errorf("saved the conflicting edit again")
+	}
+
+	err = EditLedger("test", LedgerRevision("test"), "2024/01/04 D\n  a  1\n  b  1\n", author, "")
+	if invalid, ok := err.(*ValidationError); !ok || invalid.Errors[0].Line != 1 {
+		t.Errorf("expected a validation error on line 1, got %v", err)
+	}
+
+	// A file that already has an error still takes changes that do not add
+	// others.
+	valid, _ := repo.Read()
+	broken := "2024/01/04 D\n  a  1\n  b  1\n\n" + valid
+	if err := os.WriteFile(work+"/main.ledger", []byte(broken), 0600); err != nil {
+		t.Fatal(err)
+	}
+	git(work, "commit", "-am", "broken")
+	git(work, "push", "origin", "master")
+	if err := AppendLedger("test", "2024/01/05 E\n  a  5\n  b", author, ""); err != nil {
+		t.Errorf("append to a file with an error rejected: %v", err)
+	}
+	err = AppendLedger("test", "2024/01/06 F\n  a  1\n  b  1", author, "")
+	if invalid, ok := err.(*ValidationError); !ok || len(invalid.Errors) != 1 {
+		t.Errorf("expected the new error only, got %v", err)
+	}
+	if err := WriteLedger("test", valid, author, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	price := &PriceDirective{Date: time.Date(2024, 1, 5, 0, 0, 0, 0, time.UTC), Commodity: "US$", Price: Amount{Currency: "$", Value: 40.5}}
+	if err := AddPrices("test", []*PriceDirective{price}, author, ""); err != nil {
+		t.Fatal(err)
+	}
+	if prices, _ := repo.ReadFile("prices.ledger"); prices != "P 2024/01/05 US$ $40.5\n" {
+		t.Errorf("unexpected prices file %q", prices)
+	}
+	if file, _ := repo.Read(); !strings.HasPrefix(file, "include prices.ledger\n\n") || len(LedgerJournal("test").Prices) != 1 {
+		t.Errorf("prices file not included:\n%v", file)
+	}
+	brokenPrice := &PriceDirective{Date: price.Date, Commodity: "US$\nfoo bar", Price: price.Price}
+	if err := AddPrices("test", []*PriceDirective{brokenPrice}, author, ""); err == nil {
+		t.Errorf("price breaking the prices file accepted")
+	}
+	if prices, _ := repo.ReadFile("prices.ledger"); prices != "P 2024/01/05 US$ $40.5\n" {
+		t.Errorf("prices file not restored: %q", prices)
+	}
+
+	profile := CSVProfile{Name: "Bank", Columns: CSVColumns{Date: "1", Amount: "2"}}
+	if err := SaveCSVProfile("test", profile, author); err != nil {
+		t.Fatal(err)
+	}
+	if profiles := CSVProfiles("test"); len(profiles) != 1 || profiles[0].Columns.Amount != "2" {
+		t.Errorf("unexpected profiles %+v", profiles)
+	}
+
+	// A rejected push leaves the tree as it was.
+	before, _ := repo.Read()
+	revision = LedgerRevision("test")
+	hook := root + "/remote.git/hooks/pre-receive"
+	if err := os.WriteFile(hook, []byte("#!/bin/sh\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := AppendLedger("test", "2024/01/03 C\n  a  3\n  b", author, ""); err == nil {
+		t.Errorf("expected a push error")
+	}
+	if file, _ := repo.Read(); file != before || LedgerRevision("test") != revision {
+		t.Errorf("failed append not undone: %v\n%v", LedgerRevision("test"), file)
+	}
+	ledgers["test"] = LedgerDef{PricesFile: "rejected.ledger"}
+	if err := AddPrices("test", []*PriceDirective{price}, author, ""); err == nil {
+		t.Errorf("expected a push error")
+	}
+	if _, err := os.Stat(work + "/rejected.ledger"); !os.IsNotExist(err) {
+		t.Errorf("new prices file left after a failed save: %v", err)
+	}
+	if file, _ := repo.Read(); file != before {
+		t.Errorf("include of the prices file left after a failed save:\n%v", file)
+	}
+	ledgers["test"] = LedgerDef{}
+	os.Remove(hook)
+
+	git(work, "remote", "set-url", "origin", root+"/missing.git")
+	err = AppendLedger("test", "2024/01/03 C\n  a  3\n  b", author, "")
+	if gitErr, ok := err.(*GitError); !ok || gitErr.Op != "pull" {
+		t.Errorf("expected a pull error, got %v", err)
+	}
+}
+
+func TestRefreshSnapshotIncludeGlob(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, content string) {
+		if err := os.WriteFile(dir+"/"+name, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("main.ledger", "include *.journal\n")
+	write("a.journal", "2024/01/01 A\n  a  1\n  b\n")
+	defer delete(snapshots, "glob")
+	repo := &Repo{ledger: "glob", dir: dir, file: "main.ledger"}
+
+	refreshSnapshot(repo, "")
+	if n := len(snapshots["glob"].Journal.Transactions); n != 1 {
+		t.Fatalf("expected 1 transaction, got %v", n)
+	}
+	// A new file matching the include is read without other changes.
+	write("b.journal", "2024/01/02 B\n  a  2\n  b\n")
+	refreshSnapshot(repo, "")
+	if n := len(snapshots["glob"].Journal.Transactions); n != 2 {
+		t.Errorf("new included file not loaded, got %v transactions", n)
+	}
+}
@@ -1,28 +1,17 @@
 package main
 
 import (
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
-	"encoding/json"
+	"flag"
 	"fmt"
 	"github.com/gorilla/mux"
 	"net/http"
-	"net/url"
 	"strings"
 	"time"
-	"context"
 	"io/ioutil"
 	"bytes"
 	"os"
 )
 
-type CookieData struct {
-	Token oauth2.Token
-	Email string
-}
-
-var validCookies []CookieData = []CookieData{}
-
 // isLocalEnvironment checks if we're running in a local development environment
 func isLocalEnvironment() bool {
 	// Check for environment variable first
@@ -47,33 +36,18 @@ func isLocalEnvironment() bool {
 	return false
 }
 
-var oauthconfig *oauth2.Config
 var RootPath string
 
-const oauthGoogleUrlAPI = "https://www.googleapis.com/oauth2/v2/userinfo?access_token="
-
 func initConfig() {
 	if isLocalEnvironment() {
 		// Local development settings
 		RootPath = ""
-		oauthconfig = &oauth2.Config{
-			ClientID:     ClientId,
-			ClientSecret: ClientSecret,
-			Scopes:       []string{"https://www.googleapis.com/auth/userinfo.email"},
-			Endpoint:     google.Endpoint,
-			RedirectURL:  "http://localhost:8082/oauthcallback",
-		}
+		BaseURL = "http://localhost:8082"
 		Log("Running in LOCAL mode")
 	} else {
 		// Production settings
 		RootPath = "/ledger"
-		oauthconfig = &oauth2.Config{
-			ClientID:     ClientId,
-			ClientSecret: ClientSecret,
-			Scopes:       []string{"https://www.googleapis.com/auth/userinfo.email"},
-			Endpoint:     google.Endpoint,
-			RedirectURL:  "https://max.uy/ledger/oauthcallback",
-		}
+		BaseURL = "https://max.uy/ledger"
 		Log("Running in PRODUCTION mode")
 	}
 }
@@ -83,32 +57,10 @@ func Log(message string, a ...interface{}) {
 	fmt.Printf("%v %v\n", time.Now().Format(time.Stamp), message)
 }
 
-func GetCookie(r *http.Request) CookieData {
-	cookie, err := r.Cookie("auth")
-	var data CookieData
-	if err == nil {
-		value, _ := url.QueryUnescape(cookie.Value)
-		json.Unmarshal([]byte(value), &data)
-	} else {
-		Log("GetCookie error %v", err)
-	}
-	return data
-}
-
-func SetCookie(w http.ResponseWriter, token oauth2.Token, email string) {
-	cookie := CookieData{token, email}
-	b, _ := json.Marshal(cookie)
-	value := string(b)
-	c := http.Cookie{Name: "auth", Value: url.QueryEscape(value)}
-	c.Path = RootPath
-	http.SetCookie(w, &c)
-	validCookies = append(validCookies, cookie)
-}
-
 func handleWithTemplateAndData(template string, fillData func(map[string]interface{})) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ledger := mux.Vars(r)["ledger"]
-		email := GetCookie(r).Email
+		email := GetSession(r).Email
 		data := map[string]interface{}{
 			"ledger":  ledger,
 			"ledgers": AuthLedgers(email),
@@ -116,12 +68,20 @@ func handleWithTemplateAndData(template string, fillData func(map[string]interfa
 			"email":   email,
 			"root":    RootPath,
 			"cookies": r.Header.Get("Cookie"),
+			"csrf":    GetSession(r).CSRFToken,
 		}
 		if len(ledger) > 0 {
-			UpdateLedger(ledger)
-			data["accounts"] = LedgerAccounts(ledger)
-			data["ledgerFile"] = ReadLedger(ledger)
-			data["balance"] = LedgerExec(ledger, "bal assets")
+			role := LedgerRole(ledger, email)
+			data["canEdit"] = role >= RoleEdit
+			data["canAppend"] = role >= RoleAppend
+			snapshot := LedgerSnapshot(ledger)
+			if snapshot.SyncError != "" {
+				data["gitError"] = snapshot.SyncError
+			}
+			data["revision"] = snapshot.Revision
+			data["accounts"] = snapshot.Journal.Accounts
+			data["ledgerFile"] = snapshot.File
+			data["balance"] = snapshot.Balance
 		}
 		fillData(data)
 		if template == "query" {
@@ -151,32 +111,10 @@ func isBalQuery(query string) bool {
 	return false
 }
 
-func monthlyData(data map[string]interface{}) {
-	ledger := data["ledger"].(string)
-	
-	now := time.Now()
-	this_month := now.Format("Jan")
-	this_year := now.Format("2006")
-	last_year := now.AddDate(-1, 0, 0).Format("2006")
-
-	data["yearly_expense"] = LedgerExec(ledger, "bal expenses and not retiro and not bono -e '" + this_month + " " + this_year + "' -b '" + this_month + " " + last_year + "' -X US$ -H --depth 1  -F '%T'")
-	data["monthly_expense"] =  LedgerExec(ledger, "bal expenses and not retiro and not bono -e '" + this_month + " " + this_year + "' -b '" + this_month + " " + last_year + "' -X US$ -H --depth 1  -F '%(T/12)'")
-
-	last_month := now.AddDate(0, -1, 0).Format("Jan 2006")
-	data["last_month"] = last_month
-	data["last_month_income"] = LedgerExec(ledger, "bal income -p '" + last_month + "' -X US$ -H --depth 1  -F '%(-T)'")
-
-	last_last_month := now.AddDate(0, -2, 0).Format("Jan 2006")
-	data["last_last_month"] = last_last_month
-	data["last_last_month_income"] = LedgerExec(ledger, "bal income -p '" + last_last_month + "' -X US$ -H --depth 1  -F '%(-T)'")
-
-	data["bank_balance"] = LedgerExec(ledger, "bal assets:bancos -X US$ -H --depth 1  -F '%T'")
-}
-
 func handleRaw(w http.ResponseWriter, r *http.Request) {
 	ledger := mux.Vars(r)["ledger"]
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	w.Write([]byte(ReadLedger(ledger)))
+	w.Write([]byte(LedgerSnapshot(ledger).File))
 }
 
 func handleQueryText(w http.ResponseWriter, r *http.Request) {
@@ -187,36 +125,33 @@ func handleQueryText(w http.ResponseWriter, r *http.Request) {
 
 func handleLogin(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		cookie := GetCookie(r)
-		if len(cookie.Email) == 0 {
-			http.Redirect(w, r, oauthconfig.AuthCodeURL("randomtoken", oauth2.AccessTypeOffline, oauth2.ApprovalForce), http.StatusFound)
+		session := GetSession(r)
+		if len(session.Email) == 0 {
+			redirectToLogin(w, r)
 			return
 		}
-		
-		// Refresh token if expired or about to expire
-		if time.Until(cookie.Token.Expiry) < 5*time.Minute {
-			Log("Token expired or expiring soon, refreshing...")
-			tokenSource := oauthconfig.TokenSource(context.Background(), &cookie.Token)
-			newToken, err := tokenSource.Token()
-			if err != nil {
-				Log("Token refresh failed: %v", err)
-				http.Redirect(w, r, oauthconfig.AuthCodeURL("randomtoken", oauth2.AccessTypeOffline, oauth2.ApprovalForce), http.StatusFound)
-				return
-			}
-			SetCookie(w, *newToken, cookie.Email)
-			cookie.Token = *newToken
-			Log("Token refreshed successfully")
+		if session.CSRFToken == "" {
+			// Sessions created before CSRF tokens existed.
+			session.CSRFToken = randomToken()
+			sessions.Update(session)
 		}
 		
-		// Verify email still matches
-		if getEmail(cookie.Token) != cookie.Email {
-			Log("Email mismatch, redirecting to login")
-			http.Redirect(w, r, oauthconfig.AuthCodeURL("randomtoken", oauth2.AccessTypeOffline, oauth2.ApprovalForce), http.StatusFound)
+		// A failed token refresh means access was revoked, so the session ends.
+		token, err := authProvider.Refresh(session.Token)
+		if err != nil {
+			Log("Token refresh failed: %v", err)
+			sessions.Delete(session.ID)
+			ClearSessionCookie(w)
+			redirectToLogin(w, r)
 			return
 		}
+		if token.AccessToken != session.Token.AccessToken {
+			session.Token = token
+			sessions.Update(session)
+		}
 		
 		ledger := mux.Vars(r)["ledger"]
-		if len(ledger) > 0 && !AuthLedger(ledger, cookie.Email) {
+		if len(ledger) > 0 && !AuthLedger(ledger, session.Email) {
 			w.WriteHeader(http.StatusUnauthorized)
 			w.Write([]byte("Unauthorized"))
 		} else {
@@ -225,6 +160,19 @@ func handleLogin(handler func(http.ResponseWriter, *http.Request)) func(http.Res
 	}
 }
 
+// requireRole rejects users whose role in the request's ledger is below role.
+// It runs inside handleLogin, which has already checked read access.
+func requireRole(role Role, handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ledger := mux.Vars(r)["ledger"]
+		if LedgerRole(ledger, GetSession(r).Email) < role {
+			http.Error(w, "Forbidden: requires "+role.String()+" access", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
+
 func editLedger(w http.ResponseWriter, r *http.Request) {
 	Log("Edit ledger")
 	ledger := mux.Vars(r)["ledger"]
@@ -232,93 +180,126 @@ func editLedger(w http.ResponseWriter, r *http.Request) {
 	if len(file) == 0 || file[len(file)-1] != '\n' {
 		file += "\n"
 	}
-	strings.Replace(file, "\r\n", "\n", -1)
-
-	WriteLedger(ledger, file, "webledger <"+GetCookie(r).Email+">")
+	file = strings.Replace(file, "\r\n", "\n", -1)
+
+	// The form carries the revision it was loaded from. If someone else
+	// saved since, their changes are merged or the edit is sent back
+	// merged with conflict markers, based on the current revision, which
+	// cannot be saved until the markers are resolved.
+	err := EditLedger(ledger, r.FormValue("revision"), file, "webledger <"+GetSession(r).Email+">", r.FormValue("message"))
+	if conflict, ok := err.(*ConflictError); ok {
+		Log("Edit of %v conflicts with changes since %v", ledger, conflict.Base)
+		w.WriteHeader(http.StatusConflict)
+		handleWithTemplateAndData("edit", func(data map[string]interface{}) {
+			data["ledgerFile"] = conflict.Merged
+			data["revision"] = conflict.Head
+			data["message"] = r.FormValue("message")
+			data["conflict"] = conflict.Diff
+		})(w, r)
+		return
+	}
+	// Other failures keep the revision the edit is based on.
+	if invalid, ok := err.(*ValidationError); ok {
+		Log("Rejected invalid edit of %v", ledger)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		handleWithTemplateAndData("edit", func(data map[string]interface{}) {
+			data["ledgerFile"] = file
+			data["revision"] = r.FormValue("revision")
+			data["message"] = r.FormValue("message")
+			data["validationErrors"] = invalid.Errors
+		})(w, r)
+		return
+	}
+	if err != nil {
+		Log("Error saving %v: %v", ledger, err)
+		w.WriteHeader(gitErrorStatus(err))
+		handleWithTemplateAndData("edit", func(data map[string]interface{}) {
+			data["ledgerFile"] = file
+			data["revision"] = r.FormValue("revision")
+			data["message"] = r.FormValue("message")
+			data["gitError"] = err.Error()
+		})(w, r)
+		return
+	}
 	handleWithTemplate("edit")(w, r)
 }
 
 func handleAppend(w http.ResponseWriter, r *http.Request) {
 	Log("Append")
 	ledger := mux.Vars(r)["ledger"]
-	file := ReadLedger(ledger)
-
-	strings.Replace(file, "\r\n", "\n", -1)
-	for len(file) < 2 || file[len(file)-1] != '\n' || file[len(file)-2] != '\n' {
-		file += "\n"
+	author := "webledger <" + GetSession(r).Email + ">"
+	var err error
+	if r.FormValue("order") == "date" {
+		err = InsertLedger(ledger, r.FormValue("append"), author, r.FormValue("message"))
+	} else {
+		err = AppendLedger(ledger, r.FormValue("append"), author, r.FormValue("message"))
 	}
-	file += strings.TrimSpace(r.FormValue("append"))
-
-	if len(file) == 0 || file[len(file)-1] != '\n' {
-		file += "\n"
+	if err != nil {
+		Log("Error appending to %v: %v", ledger, err)
+		http.Error(w, err.Error(), gitErrorStatus(err))
+		return
 	}
-
-	WriteLedger(ledger, file, "webledger <"+GetCookie(r).Email+">")
 	handleRaw(w, r)
 }
 
-func getEmail(token oauth2.Token) string {
-	for _, c := range validCookies {
-		if c.Token.AccessToken == token.AccessToken {
-			return c.Email
-		}
+// gitErrorStatus is the HTTP status for an error saving a ledger: a failed
+// pull or push is the remote's fault, an invalid ledger the client's and
+// anything else is ours.
+func gitErrorStatus(err error) int {
+	if _, ok := err.(*ValidationError); ok {
+		return http.StatusUnprocessableEntity
 	}
-
-	response, err := http.Get(oauthGoogleUrlAPI + token.AccessToken)
-	if err != nil {
-		return ""
+	if gitErr, ok := err.(*GitError); ok && gitErr.Op != "commit" {
+		return http.StatusBadGateway
 	}
-	defer response.Body.Close()
-	contents, err := ioutil.ReadAll(response.Body)
-	if err != nil {
-		Log("Error getting email: %v", err)
-		return ""
+	return http.StatusInternalServerError
+}
+
+// authCallback completes a login started by redirectToLogin: the OAuth
+// redirect back from the identity provider, or the login form post.
+func authCallback(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" && !validLoginCSRF(w, r) {
+		Log("Login CSRF token mismatch")
+		http.Error(w, "Invalid or missing CSRF token, please try again", http.StatusForbidden)
+		return
 	}
-	if (contents == nil) {
-		Log("Error getting email: contents is nil")
-		return ""
+	if !validOAuthState(w, r) {
+		Log("OAuth state mismatch")
+		http.Error(w, "Invalid login state, please try again", http.StatusBadRequest)
+		return
 	}
-	var result map[string]interface{}
-	json.Unmarshal([]byte(contents), &result)
-	if (result == nil || result["email"] == nil) {
-		Log("Error getting email: result is nil")
-		return ""
+	email, token, err := authProvider.Callback(r)
+	if err != nil {
+		Log("Login failed: %v", err)
+		authProvider.LoginFailed(w, r, err)
+		return
 	}
-	return result["email"].(string);
-}
-
-func oauthCallback(w http.ResponseWriter, r *http.Request) {
-	code := r.FormValue("code")
-	tok, _ := oauthconfig.Exchange(context.Background(), code)
-	SetCookie(w, *tok, getEmail(*tok))
+	SetSessionCookie(w, sessions.Create(email, token))
 	http.Redirect(w, r, RootPath, http.StatusFound)
 }
 
 func logout(w http.ResponseWriter, r *http.Request) {
-	c := http.Cookie{Name: "auth", Value: ""}
-	http.SetCookie(w, &c)
+	if session := GetSession(r); session.ID != "" {
+		sessions.Delete(session.ID)
+	}
+	ClearSessionCookie(w)
 	w.Write([]byte("Logout"))
 }
 
 func handleReconcile(w http.ResponseWriter, r *http.Request) {
 	ledger := mux.Vars(r)["ledger"]
-	email := GetCookie(r).Email
-	
-	// Get bank accounts from ledger (accounts starting with Assets:Bank)
-	allAccounts := LedgerAccounts(ledger)
-	bankAccounts := []string{}
-	for _, acc := range allAccounts {
-		if strings.HasPrefix(acc, "Assets:Bank") {
-			bankAccounts = append(bankAccounts, acc)
-		}
-	}
+	email := GetSession(r).Email
 	
 	data := map[string]interface{}{
 		"ledger":       ledger,
 		"ledgers":      AuthLedgers(email),
 		"email":        email,
 		"root":         RootPath,
-		"bankAccounts": bankAccounts,
+		"csrf":         GetSession(r).CSRFToken,
+		"canEdit":      LedgerRole(ledger, email) >= RoleEdit,
+		"canAppend":    true,
+		"bankAccounts": ReconcileAccounts(ledger),
+		"csvProfiles":  CSVProfiles(ledger),
 	}
 	RenderTemplate(w, "reconcile", data)
 }
@@ -335,93 +316,55 @@ func handleReconcileUpload(w http.ResponseWriter, r *http.Request) {
 
 	bankAccount := r.FormValue("account")
 
-	// Check if user pasted HTML text
-	pasteText := r.FormValue("paste")
-	var statement *BankStatement
-	var statements []*BankStatement
-
-	if strings.TrimSpace(pasteText) != "" {
-		// Parse pasted Visa Itau Movimientos HTML
-		if bankAccount == "" {
-			bankAccount = "Assets:VisaItau"
-		}
-		statements, err = ParseVisaItauMovimientos(pasteText)
+	// The statement is either pasted, like Itau's Movimientos Actuales page,
+	// or an uploaded file. Its format is detected from its content.
+	content := []byte(r.FormValue("paste"))
+	if len(bytes.TrimSpace(content)) == 0 {
+		file, _, err := r.FormFile("statement")
 		if err != nil {
-			http.Error(w, "Error parsing pasted text: "+err.Error(), http.StatusInternalServerError)
+			http.Error(w, "Error retrieving file: "+err.Error(), http.StatusBadRequest)
 			return
 		}
-		if len(statements) > 0 {
-			statement = statements[0]
+		defer file.Close()
+		if content, err = ioutil.ReadAll(file); err != nil {
+			http.Error(w, "Error reading file: "+err.Error(), http.StatusInternalServerError)
+			return
 		}
+	}
+
+	var statements []*BankStatement
+	format := ""
+	if name := r.FormValue("profile"); name != "" {
+		profile := findCSVProfile(CSVProfiles(ledger), name)
+		if profile == nil {
+			http.Error(w, "Unknown CSV profile "+name, http.StatusBadRequest)
+			return
+		}
+		statements, err = profile.Parse(content)
+		format = "CSV profile " + profile.Name
 	} else {
-	// File upload path
-	file, header, err := r.FormFile("statement")
-	if err != nil {
-		http.Error(w, "Error retrieving file: "+err.Error(), http.StatusBadRequest)
-		return
+		statements, format, err = ParseStatement(content)
 	}
-	defer file.Close()
-	
-	// Read file into memory
-	fileBytes, err := ioutil.ReadAll(file)
 	if err != nil {
-		http.Error(w, "Error reading file: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Error parsing statement: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	
-	// Detect bank from filename or form parameter
-	if bankAccount == "" {
-		bankAccount = DetectBankFromFilename(header.Filename)
-	}
-	if bankAccount == "" {
-		http.Error(w, "Could not detect bank account. Please select manually.", http.StatusBadRequest)
-		return
-	}
-	
-	// Parse bank statement
-	fileExtension := strings.ToLower(header.Filename[strings.LastIndex(header.Filename, ".")+1:])
-	
-	if fileExtension == "xls" || fileExtension == "xlsx" {
-		reader := bytes.NewReader(fileBytes)
-		
-		if strings.Contains(bankAccount, "BROU") {
-			statement, err = ParseBrouStatement(reader)
-		} else if strings.Contains(bankAccount, "Itau") {
-			statement, err = ParseItauStatement(reader)
+	Log("Read %v statement with %d parts", format, len(statements))
+	statement := statements[0]
+	for _, stmt := range statements {
+		if bankAccount != "" {
+			stmt.SetAccount(bankAccount)
 		} else {
-			http.Error(w, "Unknown bank account type", http.StatusBadRequest)
-			return
-		}
-		
-		if err != nil {
-			http.Error(w, "Error parsing statement: "+err.Error(), http.StatusInternalServerError)
-			return
+			stmt.SetAccount(StatementAccount(ledgers[ledger].BankAccounts, stmt))
 		}
-		statements = []*BankStatement{statement}
-	} else if fileExtension == "csv" {
-		reader := bytes.NewReader(fileBytes)
-		statement, err = ParseBankStatementCSV(reader, bankAccount)
-		if err != nil {
-			http.Error(w, "Error parsing CSV: "+err.Error(), http.StatusInternalServerError)
+		if stmt.Account == "" {
+			http.Error(w, "Could not detect bank account. Please select manually.", http.StatusBadRequest)
 			return
 		}
-		statements = []*BankStatement{statement}
-	} else if fileExtension == "pdf" {
-		// PDF files - currently only Visa Itau credit card statements
-		reader := bytes.NewReader(fileBytes)
-		statements, err = ParseVisaItauStatement(reader, int64(len(fileBytes)))
-		if err != nil {
-			http.Error(w, "Error parsing PDF: "+err.Error(), http.StatusInternalServerError)
-			return
-		}
-		if len(statements) > 0 {
-			statement = statements[0] // Use first statement for backwards compatibility
-		}
-	} else {
-		http.Error(w, "Unsupported file format. Please upload .xls, .csv, or .pdf", http.StatusBadRequest)
-		return
 	}
-	} // end file upload else block
+	if bankAccount == "" {
+		bankAccount = statementAccounts(statements)
+	}
 	
 	// If we have multiple statements (e.g., Pesos and Dollars from Visa), render a combined result
 	if len(statements) > 1 {
@@ -482,17 +425,29 @@ func handleReconcileUpload(w http.ResponseWriter, r *http.Request) {
 			TotalBankCredits:    totalBankCredits,
 		}
 
-		// Query ledger balances at start and end of period
-		ledgerStartBalances := QueryLedgerAccountBalances(ledger, bankAccount, minDate)
-		ledgerEndBalances := QueryLedgerAccountBalances(ledger, bankAccount, maxDate.AddDate(0, 0, 1))
+		// Query ledger balances at start and end of period, of every account
+		// the statements map to
+		var ledgerStartBalances, ledgerEndBalances []Amount
+		queried := map[string]bool{}
+		for _, stmt := range statements {
+			if queried[stmt.Account] {
+				continue
+			}
+			queried[stmt.Account] = true
+			ledgerStartBalances = append(ledgerStartBalances, QueryLedgerAccountBalances(ledger, stmt.Account, minDate)...)
+			ledgerEndBalances = append(ledgerEndBalances, QueryLedgerAccountBalances(ledger, stmt.Account, maxDate.AddDate(0, 0, 1))...)
+		}
 
-		email := GetCookie(r).Email
+		email := GetSession(r).Email
 		data := map[string]interface{}{
 			"ledger":              ledger,
 			"ledgers":             AuthLedgers(email),
 			"accounts":            LedgerAccounts(ledger),
 			"email":               email,
 			"root":                RootPath,
+			"csrf":                GetSession(r).CSRFToken,
+			"canEdit":             LedgerRole(ledger, email) >= RoleEdit,
+			"canAppend":           true,
 			"result":              combinedResult,
 			"bankAccount":         bankAccount,
 			"suggestedEntries":    GenerateLedgerEntries(allUnmatchedBank),
@@ -519,13 +474,16 @@ func handleReconcileUpload(w http.ResponseWriter, r *http.Request) {
 	ledgerEndBalances := QueryLedgerAccountBalances(ledger, bankAccount, statement.EndDate.AddDate(0, 0, 1))
 
 	// Prepare data for template
-	email := GetCookie(r).Email
+	email := GetSession(r).Email
 	data := map[string]interface{}{
 		"ledger":              ledger,
 		"ledgers":             AuthLedgers(email),
 		"accounts":            LedgerAccounts(ledger),
 		"email":               email,
 		"root":                RootPath,
+		"csrf":                GetSession(r).CSRFToken,
+		"canEdit":             LedgerRole(ledger, email) >= RoleEdit,
+		"canAppend":           true,
 		"result":              result,
 		"bankAccount":         bankAccount,
 		"suggestedEntries":    GenerateLedgerEntries(result.UnmatchedBank),
@@ -537,9 +495,23 @@ func handleReconcileUpload(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	hashPassword := flag.Bool("hash-password", false, "read a password from standard input and print its hash for auth.json")
+	flag.Parse()
+	if *hashPassword {
+		if err := printPasswordHash(os.Stdin); err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	initConfig()
-	InitLedgers()
+	InitSessions()
 	InitTemplates()
+	InitAuth()
+	InitLedgers()
+	InitNotify()
+	StartSync()
 
 	ledgers_regex := ""
 	for l, _ := range Ledgers() {
@@ -551,18 +523,35 @@ func main() {
 
 	router := mux.NewRouter()
 	router.HandleFunc("/", handleLogin(handleWithTemplate("index"))).Methods("GET")
-	router.HandleFunc("/oauthcallback", oauthCallback).Methods("GET")
+	router.HandleFunc("/oauthcallback", authCallback).Methods("GET")
+	router.HandleFunc("/login", authCallback).Methods("POST")
 	router.HandleFunc("/logout", logout).Methods("GET")
 	router.HandleFunc("/{ledger:"+ledgers_regex+"}", handleLogin(handleWithTemplate("edit"))).Methods("GET")
-	router.HandleFunc("/{ledger:"+ledgers_regex+"}", handleLogin(editLedger)).Methods("POST")
+	router.HandleFunc("/{ledger:"+ledgers_regex+"}", handleLogin(requireRole(RoleEdit, checkCSRF(editLedger)))).Methods("POST")
 	router.HandleFunc("/{ledger:"+ledgers_regex+"}/query", handleLogin(handleWithTemplate("query"))).Methods("GET")
 	router.HandleFunc("/{ledger:"+ledgers_regex+"}/query_text", handleLogin(handleQueryText)).Methods("GET")
+	router.HandleFunc("/{ledger:"+ledgers_regex+"}/query_json", handleLogin(handleQueryJSON)).Methods("GET")
 	router.HandleFunc("/{ledger:"+ledgers_regex+"}/app_auth", handleLogin(handleWithTemplate("app_auth"))).Methods("GET")
 	router.HandleFunc("/{ledger:"+ledgers_regex+"}/raw", handleLogin(handleRaw)).Methods("GET")
-	router.HandleFunc("/{ledger:"+ledgers_regex+"}/append", handleLogin(handleAppend)).Methods("POST")
-	router.HandleFunc("/{ledger:"+ledgers_regex+"}/monthly", handleLogin(handleWithTemplateAndData("monthly", monthlyData))).Methods("GET")
-	router.HandleFunc("/{ledger:"+ledgers_regex+"}/reconcile", handleLogin(handleReconcile)).Methods("GET")
-	router.HandleFunc("/{ledger:"+ledgers_regex+"}/reconcile", handleLogin(handleReconcileUpload)).Methods("POST")
+	router.HandleFunc("/{ledger:"+ledgers_regex+"}/append", handleLogin(requireRole(RoleAppend, checkCSRF(handleAppend)))).Methods("POST")
+	router.HandleFunc("/{ledger:"+ledgers_regex+"}/new", handleLogin(requireRole(RoleAppend, handleWithTemplateAndData("new", newTransactionData)))).Methods("GET")
+	router.HandleFunc("/{ledger:"+ledgers_regex+"}/new", handleLogin(requireRole(RoleAppend, checkCSRF(handleNewTransaction)))).Methods("POST")
+	router.HandleFunc("/{ledger:"+ledgers_regex+"}/transactions", handleLogin(requireRole(RoleAppend, checkCSRF(handleNewTransactionJSON)))).Methods("POST")
+	router.HandleFunc("/{ledger:"+ledgers_regex+"}/history", handleLogin(handleWithTemplateAndData("history", historyData))).Methods("GET")
+	router.HandleFunc("/{ledger:"+ledgers_regex+"}/history/{commit:[0-9a-f]{7,64}}", handleLogin(handleCommit)).Methods("GET")
+	router.HandleFunc("/{ledger:"+ledgers_regex+"}/history/{commit:[0-9a-f]{7,64}}/revert", handleLogin(requireRole(RoleEdit, checkCSRF(handleRevert)))).Methods("POST")
+	router.HandleFunc("/{ledger:"+ledgers_regex+"}/sync", handleSyncHook).Methods("POST")
+	router.HandleFunc("/{ledger:"+ledgers_regex+"}/dashboard", handleLogin(handleWithTemplateAndData("dashboard", dashboardData))).Methods("GET")
+	router.HandleFunc("/{ledger:"+ledgers_regex+"}/monthly", handleLogin(handleWithTemplateAndData("dashboard", dashboardData))).Methods("GET")
+	router.HandleFunc("/{ledger:"+ledgers_regex+"}/reports", handleLogin(handleReports)).Methods("GET")
+	router.HandleFunc("/{ledger:"+ledgers_regex+"}/reports_json", handleLogin(handleReportsJSON)).Methods("GET")
+	router.HandleFunc("/{ledger:"+ledgers_regex+"}/prices", handleLogin(handleWithTemplateAndData("prices", pricesData))).Methods("GET")
+	router.HandleFunc("/{ledger:"+ledgers_regex+"}/prices", handleLogin(requireRole(RoleAppend, checkCSRF(handleAddPrice)))).Methods("POST")
+	router.HandleFunc("/{ledger:"+ledgers_regex+"}/budget", handleLogin(handleBudget)).Methods("GET")
+	router.HandleFunc("/{ledger:"+ledgers_regex+"}/reconcile", handleLogin(requireRole(RoleAppend, handleReconcile))).Methods("GET")
+	router.HandleFunc("/{ledger:"+ledgers_regex+"}/reconcile", handleLogin(requireRole(RoleAppend, checkCSRF(handleReconcileUpload)))).Methods("POST")
+	router.HandleFunc("/{ledger:"+ledgers_regex+"}/csv_profiles", handleLogin(requireRole(RoleAppend, handleCSVProfiles))).Methods("GET")
+	router.HandleFunc("/{ledger:"+ledgers_regex+"}/csv_profiles", handleLogin(requireRole(RoleAppend, checkCSRF(handleCSVProfile)))).Methods("POST")
 	router.Handle("/{path:.*}", http.FileServer(http.Dir("public")))
 	http.Handle("/", router)
 	http.ListenAndServe(":8082", nil)
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// LedgerNotify is a notification rule of a ledger. Every criterion that is
+// set must match; the criteria on postings are checked against the
+// transactions added or edited by a change, and only the matching ones are
+// included in the summary.
+type LedgerNotify struct {
+	Kind   string // "smtp" (the default), "webhook", "file" or "log"
+	Target string // email address, URL or file path, depending on Kind
+
+	Regex     string // matches the raw diff of the change
+	Account   string // regex matching the account of a posting
+	Payee     string // regex matching the payee
+	MinAmount string // smallest absolute amount of a (matching) posting, like "US$ 100"; others are converted at the transaction date
+	Author    string // regex matching the author of the change
+}
+
+// NotifyConfig is read from notify.json and configures the SMTP notifier.
+type NotifyConfig struct {
+	SMTP SMTPConfig
+}
+
+type SMTPConfig struct {
+	Host     string // host:port
+	Username string // for PLAIN authentication, if set
+	Password string
+	From     string
+}
+
+var notifyConfig = NotifyConfig{SMTP: SMTPConfig{Host: "localhost:25", From: "ledgers@server.max.uy"}}
+
+// InitNotify reads notify.json, if present.
+func InitNotify() {
+	file, err := os.Open("notify.json")
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	if err := json.NewDecoder(file).Decode(&notifyConfig); err != nil {
+		Log("Error reading notify.json: %v", err)
+	}
+}
+
+// Notification is a change to a ledger that matched a rule.
+type Notification struct {
+	Ledger       string
+	Author       string
+	Message      string
+	Transactions []string // text of the matched transactions
+	Diff         string
+}
+
+// Subject is a one line summary for the notification.
+func (n *Notification) Subject() string {
+	return fmt.Sprintf("[%v] %v", n.Ledger, strings.SplitN(n.Message, "\n", 2)[0])
+}
+
+// Text is the plain text body of the notification.
+func (n *Notification) Text() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%v changed the %v ledger:\n%v\n\n", n.Author, n.Ledger, n.Message)
+	if len(n.Transactions) > 0 {
+		b.WriteString(strings.Join(n.Transactions, "\n"))
+	} else {
+		b.WriteString(n.Diff)
+	}
+	return b.String()
+}
+
+var notificationTemplate = template.Must(template.New("notification").Parse(`<p>{{ .Author }} changed the <strong>{{ .Ledger }}</strong> ledger:</p>
+<p>{{ .Message }}</p>
+{{ range .Transactions }}<pre>{{ . }}</pre>
+{{ else }}<pre>{{ .Diff }}</pre>
+{{ end }}`))
+
+// HTML is the HTML body of the notification.
+func (n *Notification) HTML() string {
+	var b bytes.Buffer
+	if err := notificationTemplate.Execute(&b, n); err != nil {
+		Log("Error formatting notification: %v", err)
+	}
+	return b.String()
+}
+
+// Notifier delivers notifications somewhere.
+type Notifier interface {
+	Notify(n *Notification) error
+}
+
+// NewNotifier returns the notifier of a rule.
+func NewNotifier(rule LedgerNotify) (Notifier, error) {
+	switch rule.Kind {
+	case "", "smtp", "email":
+		return &smtpNotifier{config: notifyConfig.SMTP, to: rule.Target}, nil
+	case "webhook":
+		return &webhookNotifier{url: rule.Target}, nil
+	case "file":
+		return &fileNotifier{path: rule.Target}, nil
+	case "log":
+		return &logNotifier{}, nil
+	}
+	return nil, fmt.Errorf("unknown notifier %q", rule.Kind)
+}
+
+type smtpNotifier struct {
+	config SMTPConfig
+	to     string
+}
+
+func (s *smtpNotifier) Notify(n *Notification) error {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", n.Text()},
+		{"text/html; charset=utf-8", n.HTML()},
+	} {
+		w, err := writer.CreatePart(textproto.MIMEHeader{"Content-Type": {part.contentType}})
+		if err != nil {
+			return err
+		}
+		w.Write([]byte(part.content))
+	}
+	writer.Close()
+
+	msg := "From: " + s.config.From + "\r\n" +
+		"To: " + s.to + "\r\n" +
+		"Subject: " + n.Subject() + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/alternative; boundary=" + writer.Boundary() + "\r\n\r\n" +
+		body.String()
+
+	var auth smtp.Auth
+	if s.config.Username != "" {
+		host := strings.Split(s.config.Host, ":")[0]
+		auth = smtp.PlainAuth("", s.config.Username, s.config.Password, host)
+	}
+	return smtp.SendMail(s.config.Host, auth, s.config.From, []string{s.to}, []byte(msg))
+}
+
+// webhookNotifier posts the notification as JSON.
+type webhookNotifier struct {
+	url string
+}
+
+func (wh *webhookNotifier) Notify(n *Notification) error {
+	payload, err := json.Marshal(map[string]interface{}{
+		"ledger":       n.Ledger,
+		"author":       n.Author,
+		"message":      n.Message,
+		"subject":      n.Subject(),
+		"text":         n.Text(),
+		"html":         n.HTML(),
+		"transactions": n.Transactions,
+	})
+	if err != nil {
+		return err
+	}
+	client := http.Client{Timeout: 30 * time.Second}
+	response, err := client.Post(wh.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %v", response.Status)
+	}
+	return nil
+}
+
+// fileNotifier appends the text of notifications to a file.
+type fileNotifier struct {
+	path string
+}
+
+func (f *fileNotifier) Notify(n *Notification) error {
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = fmt.Fprintf(file, "%v %v\n%v\n\n", time.Now().Format(time.RFC3339), n.Subject(), n.Text())
+	return err
+}
+
+type logNotifier struct{}
+
+func (l *logNotifier) Notify(n *Notification) error {
+	Log("Notification %v\n%v", n.Subject(), n.Text())
+	return nil
+}
+
+// MatchNotify applies a rule to a change. It returns the matching
+// transactions, and false if the rule does not match. Posting amounts are
+// compared with MinAmount in its commodity, with prices.
+func MatchNotify(rule LedgerNotify, changes []TransactionChange, author string, diff string, prices *PriceHistory) ([]*Transaction, bool) {
+	matches := func(expr string, s string) bool {
+		if expr == "" {
+			return true
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			Log("Invalid notify regex %q: %v", expr, err)
+			return false
+		}
+		return re.MatchString(s)
+	}
+	if rule.Regex != "" && !matches(rule.Regex, diff) || !matches(rule.Author, author) {
+		return nil, false
+	}
+	if rule.Account == "" && rule.Payee == "" && rule.MinAmount == "" {
+		return nil, true
+	}
+	var min Amount
+	if rule.MinAmount != "" {
+		parsed, err := ParseAmount(rule.MinAmount)
+		if err != nil {
+			Log("Invalid notify MinAmount %q: %v", rule.MinAmount, err)
+			return nil, false
+		}
+		min = parsed
+	}
+
+	matched := []*Transaction{}
+	for _, change := range changes {
+		tx := change.New
+		if tx == nil || !matches(rule.Payee, tx.Payee) {
+			continue
+		}
+		for _, posting := range tx.Postings {
+			if !matches(rule.Account, posting.Account) {
+				continue
+			}
+			if rule.MinAmount != "" {
+				if posting.Amount == nil {
+					continue
+				}
+				amount := prices.Convert(*posting.Amount, min.Currency, tx.Date)
+				if amount.Currency != min.Currency || math.Abs(amount.Value) < math.Abs(min.Value) {
+					continue
+				}
+			}
+			matched = append(matched, tx)
+			break
+		}
+	}
+	return matched, len(matched) > 0
+}
+
+// NotifyChange sends the notifications of the rules of a ledger matching a
+// change. journal is the new version of the ledger.
+func NotifyChange(ledger string, journal *Journal, changes []TransactionChange, author string, message string, diff string) {
+	prices := NewPriceHistory(journal)
+	for _, rule := range ledgers[ledger].Notify {
+		txs, ok := MatchNotify(rule, changes, author, diff, prices)
+		if !ok {
+			continue
+		}
+		notifier, err := NewNotifier(rule)
+		if err != nil {
+			Log("Error in notify rule of %v: %v", ledger, err)
+			continue
+		}
+		n := &Notification{Ledger: ledger, Author: author, Message: message, Diff: diff}
+		for _, tx := range txs {
+			n.Transactions = append(n.Transactions, journal.Text(tx.Span))
+		}
+		Log("Notify match, sending %v notification to %v", rule.Kind, rule.Target)
+		if err := notifier.Notify(n); err != nil {
+			Log("Error sending notification: %v", err)
+		}
+	}
+}
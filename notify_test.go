@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNotify(t *testing.T) {
+	old := ParseJournal("/tmp/test.ledger", sampleJournal)
+	edited := sampleJournal + "\n2026/10/06 Antel\n    Expenses:Cuentas:Antel    $ 2,000\n    Assets:Cash\n"
+	edited += "\n2026/10/07 Cafe\n    Expenses:Cafe    $ 80\n    Assets:Cash\n"
+	edited += "\nP 2026/10/01 US$ $ 40\n\n2026/10/08 Amazon\n    Expenses:Compras    US$ 30\n    Assets:Dolares\n"
+	journal := ParseJournal("/tmp/test.ledger", edited)
+	changes := DiffJournals(old, journal)
+
+	rules := []struct {
+		rule     LedgerNotify
+		expected []string
+	}{
+		{LedgerNotify{Account: "^Expenses:Cuentas"}, []string{"Antel"}},
+		{LedgerNotify{MinAmount: "$ 1,000"}, []string{"Antel", "Amazon"}},
+		{LedgerNotify{MinAmount: "US$ 40"}, []string{"Antel"}},
+		{LedgerNotify{MinAmount: "EUR 10"}, nil},
+		{LedgerNotify{Payee: "^Cafe"}, []string{"Cafe"}},
+		{LedgerNotify{Account: "Expenses", MinAmount: "$ 50"}, []string{"Antel", "Cafe", "Amazon"}},
+		{LedgerNotify{Author: "someone@else"}, nil},
+		{LedgerNotify{Regex: "Antel"}, []string{}},
+	}
+	for _, r := range rules {
+		txs, ok := MatchNotify(r.rule, changes, "webledger <max@example.com>", "+2026/10/06 Antel", NewPriceHistory(journal))
+		if ok != (r.expected != nil) {
+			t.Errorf("rule %+v matched %v", r.rule, ok)
+			continue
+		}
+		payees := []string{}
+		for _, tx := range txs {
+			payees = append(payees, tx.Payee)
+		}
+		if ok && strings.Join(payees, ",") != strings.Join(r.expected, ",") {
+			t.Errorf("rule %+v matched %v, expected %v", r.rule, payees, r.expected)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "notifications.log")
+	saved := ledgers
+	defer func() { ledgers = saved }()
+	ledgers = map[string]LedgerDef{"casa": {Notify: []LedgerNotify{{Kind: "file", Target: path, MinAmount: "$ 1,000"}}}}
+	NotifyChange("casa", journal, changes, "webledger <max@example.com>", "Add 2 transactions", "")
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "[casa] Add 2 transactions") || !strings.Contains(string(content), "Expenses:Cuentas:Antel") || strings.Contains(string(content), "Expenses:Cafe") || !strings.Contains(string(content), "Amazon") {
+		t.Errorf("unexpected notification:\n%s", content)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ofxElement is an element of an OFX document. Aggregates have children;
+// the other elements have a value.
+type ofxElement struct {
+	Name     string
+	Value    string
+	Children []*ofxElement
+}
+
+// Find returns the first descendant with a name, or nil.
+func (e *ofxElement) Find(name string) *ofxElement {
+	for _, c := range e.Children {
+		if c.Name == name {
+			return c
+		}
+		if found := c.Find(name); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// FindAll returns the descendants with a name, not looking inside them.
+func (e *ofxElement) FindAll(name string) []*ofxElement {
+	found := []*ofxElement{}
+	for _, c := range e.Children {
+		if c.Name == name {
+			found = append(found, c)
+		} else {
+			found = append(found, c.FindAll(name)...)
+		}
+	}
+	return found
+}
+
+// Text returns the value of the first descendant with a name, or "".
+func (e *ofxElement) Text(name string) string {
+	if found := e.Find(name); found != nil {
+		return found.Value
+	}
+	return ""
+}
+
+var ofxTagRegex = regexp.MustCompile(`<(/?)([A-Za-z0-9.]+)[^>]*>`)
+
+// parseOFXDocument reads the OFX element of a file. OFX 1.x files are SGML,
+// where elements with a value have no end tag, and OFX 2.x files are XML;
+// both are read the same way: an element followed by text has a value, and
+// an end tag closes the innermost open aggregate with its name.
+func parseOFXDocument(data []byte) (*ofxElement, error) {
+	if !utf8.Valid(data) {
+		// OFX 1.x files are usually in Windows-1252.
+		data = latin1ToUTF8(data)
+	}
+	text := string(data)
+	start := strings.Index(strings.ToUpper(text), "<OFX>")
+	if start < 0 {
+		return nil, fmt.Errorf("no OFX element found")
+	}
+	text = text[start:]
+
+	root := &ofxElement{}
+	stack := []*ofxElement{root}
+	matches := ofxTagRegex.FindAllStringSubmatchIndex(text, -1)
+	for i, m := range matches {
+		name := strings.ToUpper(text[m[4]:m[5]])
+		next := len(text)
+		if i+1 < len(matches) {
+			next = matches[i+1][0]
+		}
+		if m[3] > m[2] {
+			for j := len(stack) - 1; j > 0; j-- {
+				if stack[j].Name == name {
+					stack = stack[:j]
+					break
+				}
+			}
+			continue
+		}
+		element := &ofxElement{Name: name}
+		parent := stack[len(stack)-1]
+		parent.Children = append(parent.Children, element)
+		if value := strings.TrimSpace(text[m[1]:next]); value != "" {
+			element.Value = html.UnescapeString(value)
+		} else if i+1 < len(matches) && strings.ToUpper(text[matches[i+1][4]:matches[i+1][5]]) == name && matches[i+1][3] > matches[i+1][2] {
+			continue // an empty element, like <MEMO></MEMO>
+		} else {
+			stack = append(stack, element)
+		}
+	}
+	ofx := root.Find("OFX")
+	if ofx == nil {
+		return nil, fmt.Errorf("no OFX element found")
+	}
+	return ofx, nil
+}
+
+// ofxCurrencies are the ledger commodities of OFX currency codes; other
+// codes are used as they are.
+var ofxCurrencies = map[string]string{
+	"UYU": "$",
+	"USD": "US$",
+}
+
+// ParseOFX parses an OFX or QFX file, returning a statement per bank or
+// credit card account in it. FITIDs are kept as references and the ledger
+// balance is the end balance. The statements do not have a ledger account;
+// their Bank is "OFX" and Number the account ID, to map them with
+// LedgerDef.BankAccounts.
+func ParseOFX(reader io.Reader) ([]*BankStatement, error) {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	ofx, err := parseOFXDocument(data)
+	if err != nil {
+		return nil, err
+	}
+
+	statements := []*BankStatement{}
+	responses := append(ofx.FindAll("STMTRS"), ofx.FindAll("CCSTMTRS")...)
+	for _, response := range responses {
+		currency := strings.ToUpper(response.Text("CURDEF"))
+		if symbol, ok := ofxCurrencies[currency]; ok {
+			currency = symbol
+		}
+		statement := &BankStatement{
+			Bank:         "OFX",
+			Number:       response.Text("ACCTID"),
+			Currency:     currency,
+			Transactions: []BankTransaction{},
+		}
+		for _, trn := range response.FindAll("STMTTRN") {
+			date, err := parseOFXDate(trn.Text("DTPOSTED"))
+			if err != nil {
+				return nil, fmt.Errorf("transaction %v: %v", trn.Text("FITID"), err)
+			}
+			amount, err := parseOFXAmount(trn.Text("TRNAMT"))
+			if err != nil {
+				return nil, fmt.Errorf("transaction %v: %v", trn.Text("FITID"), err)
+			}
+			description := trn.Text("NAME")
+			if memo := trn.Text("MEMO"); memo != "" && memo != description {
+				description = strings.TrimSpace(description + " " + memo)
+			}
+			transaction := BankTransaction{
+				Date:        date,
+				Description: description,
+				Reference:   trn.Text("FITID"),
+				Currency:    currency,
+			}
+			if amount < 0 {
+				transaction.Debit = -amount
+			} else {
+				transaction.Credit = amount
+			}
+			statement.Transactions = append(statement.Transactions, transaction)
+		}
+		if len(statement.Transactions) == 0 {
+			continue
+		}
+		setPeriodFromTransactions(statement)
+		if list := response.Find("BANKTRANLIST"); list != nil {
+			if date, err := parseOFXDate(list.Text("DTSTART")); err == nil {
+				statement.StartDate = date
+			}
+			if date, err := parseOFXDate(list.Text("DTEND")); err == nil {
+				statement.EndDate = date
+			}
+		}
+		if balance := response.Find("LEDGERBAL"); balance != nil {
+			if amount, err := parseOFXAmount(balance.Text("BALAMT")); err == nil {
+				statement.EndBalances = []Amount{{Currency: currency, Value: amount}}
+			}
+		}
+		statements = append(statements, statement)
+	}
+	if len(statements) == 0 {
+		return nil, fmt.Errorf("no transactions found in OFX file")
+	}
+	return statements, nil
+}
+
+// parseOFXDate parses an OFX date, like 20261015 or
+// 20261015120000.000[-3:UYT], ignoring the time.
+func parseOFXDate(s string) (time.Time, error) {
+	if len(s) < 8 {
+		return time.Time{}, fmt.Errorf("invalid date %q", s)
+	}
+	return time.Parse("20060102", s[:8])
+}
+
+// parseOFXAmount parses an OFX amount, whose decimal separator may be a
+// comma.
+func parseOFXAmount(s string) (float64, error) {
+	s = strings.ReplaceAll(strings.TrimSpace(s), ",", ".")
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+	return value, nil
+}
+
+// ofxParser reads OFX 1.x and 2.x files, also known as QFX.
+type ofxParser struct{}
+
+func (ofxParser) Name() string { return "OFX" }
+
+func (ofxParser) Sniff(data []byte) float64 {
+	head := bytes.ToUpper(data[:min(len(data), 4096)])
+	switch {
+	case bytes.Contains(head, []byte("OFXHEADER")) && bytes.Contains(head, []byte("<OFX>")):
+		return 0.95
+	case bytes.Contains(head, []byte("<OFX>")):
+		return 0.7
+	}
+	return 0
+}
+
+func (ofxParser) Parse(data []byte) ([]*BankStatement, error) {
+	return ParseOFX(bytes.NewReader(data))
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// defaultPricesFile is where prices are written when the ledger definition
+// does not name a PricesFile.
+const defaultPricesFile = "prices.ledger"
+
+// pricesShown is how many prices the prices page lists.
+const pricesShown = 100
+
+// PricesFile returns the prices file of a ledger, relative to the directory
+// of the ledger file.
+func PricesFile(ledger string) string {
+	if file := ledgers[ledger].PricesFile; file != "" {
+		return path.Clean(file)
+	}
+	return defaultPricesFile
+}
+
+// FormatPrice prints a price directive, with all the decimals of the rate.
+func FormatPrice(journal *Journal, price *PriceDirective) string {
+	style, ok := journal.Commodities[price.Price.Currency]
+	if !ok {
+		style = &CommodityStyle{Symbol: price.Price.Currency, Prefix: true, Spaced: len(price.Price.Currency) > 1}
+	}
+	number := strconv.FormatFloat(price.Price.Value, 'f', -1, 64)
+	space := ""
+	if style.Spaced {
+		space = " "
+	}
+	amount := number + space + price.Price.Currency
+	if style.Prefix {
+		amount = price.Price.Currency + space + number
+	}
+	commodity := price.Commodity
+	if readCommodity(commodity) != commodity {
+		commodity = `"` + commodity + `"`
+	}
+	return fmt.Sprintf("P %v %v %v", price.Date.Format("2006/01/02"), commodity, amount)
+}
+
+// MergePrices adds price directives to the content of a prices file. A
+// price for a date, commodity and currency already in the file replaces the
+// existing line; the others are appended in date order. It returns the new
+// content and how many lines were added or changed.
+func MergePrices(journal *Journal, name string, content string, prices []*PriceDirective) (string, int) {
+	key := func(p *PriceDirective) string {
+		return p.Date.Format("2006-01-02") + " " + p.Commodity + " " + p.Price.Currency
+	}
+	lines := strings.Split(content, "\n")
+	existing := map[string]int{}
+	for _, p := range ParseJournal(name, content).Prices {
+		existing[key(p)] = p.Span.StartLine - 1
+	}
+
+	sorted := append([]*PriceDirective{}, prices...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Date.Before(sorted[j].Date) })
+	changed := 0
+	added := []string{}
+	for _, p := range sorted {
+		line := FormatPrice(journal, p)
+		if i, ok := existing[key(p)]; ok {
+			if lines[i] != line {
+				lines[i] = line
+				changed++
+			}
+			continue
+		}
+		existing[key(p)] = -1
+		added = append(added, line)
+		changed++
+	}
+	content = strings.Join(lines, "\n")
+	if len(added) > 0 {
+		if content != "" && !strings.HasSuffix(content, "\n") {
+			content += "\n"
+		}
+		content += strings.Join(added, "\n") + "\n"
+	}
+	return content, changed
+}
+
+// includesFile reports whether a journal includes a file.
+func includesFile(journal *Journal, file string) bool {
+	for _, f := range journal.Files {
+		if path.Clean(f) == path.Clean(file) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddPrices writes price directives to the prices file of a ledger, adding
+// an include of it at the top of the ledger file if needed, and commits
+// both.
+func AddPrices(ledger string, prices []*PriceDirective, author string, message string) error {
+	repo := LedgerRepo(ledger)
+	name := PricesFile(ledger)
+	return repo.Do(func() error {
+		if err := repo.Pull(); err != nil {
+			return err
+		}
+		file, err := repo.Read()
+		if err != nil {
+			return err
+		}
+		old, err := repo.ReadFile(name)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		journal := ParseJournal(repo.Path(), file)
+		content, changed := MergePrices(journal, path.Join(repo.dir, name), old, prices)
+		if changed == 0 {
+			return nil
+		}
+		if !includesFile(journal, path.Join(repo.dir, name)) {
+			file = "include " + name + "\n\n" + file
+		}
+		if strings.TrimSpace(message) == "" {
+			message = fmt.Sprintf("Add %d prices", changed)
+			if len(prices) == 1 {
+				message = "Add price " + FormatPrice(journal, prices[0])
+			}
+		}
+		// On errors the prices file goes back to the last commit, or is
+		// removed if it is new.
+		head := repo.Revision()
+		err = repo.WriteFile(name, content)
+		if err == nil {
+			err = commitLedger(repo, file, author, message, name)
+		}
+		if err != nil {
+			repo.Restore(head, name)
+		}
+		return err
+	})
+}
+
+// priceCSVDateLayouts are the date formats accepted in price CSV files.
+var priceCSVDateLayouts = []string{"2006-01-02", "2006/01/02", "02/01/2006", "02-01-2006", "02.01.2006", "2/1/2006", "2006-01-02 15:04:05"}
+
+var (
+	priceCSVDateColumn = regexp.MustCompile(`(?i)^(fecha|date|d[ií]a|day)$`)
+	priceCSVRateColumn = regexp.MustCompile(`(?i)^(venta|sell|rate|tasa|cotizaci[oó]n|price|precio|close|cierre|valor|value)$`)
+)
+
+// ParsePriceCSV reads daily quotes of commodity in currency, e.g. of US$
+// in $, from a CSV file. The delimiter may be a comma, semicolon or tab.
+// The date and rate columns are found by their header (Fecha, Date, Venta,
+// Rate, Close...), or else are the first and last columns. Rates may use a
+// decimal comma. Rows without a date, like titles or footers, are skipped.
+func ParsePriceCSV(r io.Reader, commodity string, currency string) ([]*PriceDirective, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	head := string(data[:min(len(data), 1024)])
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	reader.Comma = sniffCSVDelimiter(head)
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	dateColumn, rateColumn := 0, -1
+	prices := []*PriceDirective{}
+	for _, record := range records {
+		for i := range record {
+			record[i] = strings.TrimSpace(record[i])
+		}
+		if len(prices) == 0 {
+			header := false
+			for i, field := range record {
+				if priceCSVDateColumn.MatchString(field) {
+					dateColumn, header = i, true
+				} else if priceCSVRateColumn.MatchString(field) && rateColumn < 0 {
+					rateColumn, header = i, true
+				}
+			}
+			if header {
+				continue
+			}
+		}
+		column := rateColumn
+		if column < 0 {
+			column = len(record) - 1
+		}
+		if dateColumn >= len(record) || column >= len(record) || column == dateColumn {
+			continue
+		}
+		date, ok := parseCSVDate(record[dateColumn])
+		if !ok {
+			continue
+		}
+		rate, err := parseCSVNumber(record[column])
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("invalid rate %q on %v", record[column], record[dateColumn])
+		}
+		prices = append(prices, &PriceDirective{Date: date, Commodity: commodity, Price: Amount{Currency: currency, Value: rate}})
+	}
+	if len(prices) == 0 {
+		return nil, fmt.Errorf("no quotes found")
+	}
+	return prices, nil
+}
+
+// sniffCSVDelimiter returns the most common of the usual CSV delimiters in
+// the beginning of a file.
+func sniffCSVDelimiter(head string) rune {
+	comma := ','
+	for _, delimiter := range []rune{';', '\t'} {
+		if strings.Count(head, string(delimiter)) > strings.Count(head, string(comma)) {
+			comma = delimiter
+		}
+	}
+	return comma
+}
+
+func parseCSVDate(s string) (time.Time, bool) {
+	for _, layout := range priceCSVDateLayouts {
+		if date, err := time.Parse(layout, s); err == nil {
+			return date, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// parseCSVNumber parses "40.123", "40,123" or "1.040,50": the last of the
+// separators is the decimal one. Quotes are rarely written with thousands
+// separators only, so "1,040" is read as 1.04.
+func parseCSVNumber(s string) (float64, error) {
+	s = strings.ReplaceAll(s, " ", "")
+	if strings.LastIndex(s, ",") > strings.LastIndex(s, ".") {
+		s = strings.ReplaceAll(s, ".", "")
+		s = strings.Replace(s, ",", ".", 1)
+	} else {
+		s = strings.ReplaceAll(s, ",", "")
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// recentPrices returns the latest prices of a journal, newest first.
+func recentPrices(journal *Journal) []*PriceDirective {
+	prices := append([]*PriceDirective{}, journal.Prices...)
+	sort.SliceStable(prices, func(i, j int) bool { return prices[i].Date.After(prices[j].Date) })
+	if len(prices) > pricesShown {
+		prices = prices[:pricesShown]
+	}
+	return prices
+}
+
+// pricesData fills the prices page.
+func pricesData(data map[string]interface{}) {
+	ledger := data["ledger"].(string)
+	journal := LedgerJournal(ledger)
+	lines := []string{}
+	for _, p := range recentPrices(journal) {
+		lines = append(lines, FormatPrice(journal, p))
+	}
+	data["prices"] = lines
+	data["pricesFile"] = PricesFile(ledger)
+	data["today"] = time.Now().Format("2006-01-02")
+}
+
+// handleAddPrice adds a price entered in the form, or the quotes of an
+// uploaded CSV file.
+func handleAddPrice(w http.ResponseWriter, r *http.Request) {
+	ledger := mux.Vars(r)["ledger"]
+	prices, err := pricesFromForm(r)
+	if err == nil {
+		err = AddPrices(ledger, prices, "webledger <"+GetSession(r).Email+">", r.FormValue("message"))
+	}
+	if err != nil {
+		Log("Error adding prices to %v: %v", ledger, err)
+		if _, ok := err.(*EntryError); ok {
+			w.WriteHeader(http.StatusBadRequest)
+		} else {
+			w.WriteHeader(gitErrorStatus(err))
+		}
+	}
+	handleWithTemplateAndData("prices", func(data map[string]interface{}) {
+		pricesData(data)
+		if err != nil {
+			data["error"] = err.Error()
+		} else {
+			data["added"] = len(prices)
+		}
+	})(w, r)
+}
+
+// pricesFromForm reads either an uploaded CSV file of quotes of commodity
+// in currency, or a single price: date, commodity and price, e.g. "$ 40.12".
+func pricesFromForm(r *http.Request) ([]*PriceDirective, error) {
+	if err := r.ParseMultipartForm(10 << 20); err != nil && err != http.ErrNotMultipart {
+		return nil, entryErrorf("%v", err)
+	}
+	commodity := strings.TrimSpace(r.FormValue("commodity"))
+	if commodity == "" {
+		return nil, entryErrorf("the commodity is required")
+	}
+	if strings.ContainsAny(commodity+r.FormValue("currency"), "\"\r\n") {
+		return nil, entryErrorf("the commodity and currency cannot contain quotes or line breaks")
+	}
+	if file, _, err := r.FormFile("file"); err == nil {
+		defer file.Close()
+		currency := strings.TrimSpace(r.FormValue("currency"))
+		if currency == "" || currency == commodity {
+			return nil, entryErrorf("the currency of the quotes is required")
+		}
+		prices, err := ParsePriceCSV(file, commodity, currency)
+		if err != nil {
+			return nil, entryErrorf("%v", err)
+		}
+		return prices, nil
+	}
+	date, err := parseEntryDate(r.FormValue("date"))
+	if err != nil {
+		return nil, err
+	}
+	price, err := ParseAmount(r.FormValue("price"))
+	if err != nil {
+		return nil, entryErrorf("%v", err)
+	}
+	if price.Value <= 0 || price.Currency == "" || price.Currency == commodity {
+		return nil, entryErrorf("the price must be a positive amount in another commodity")
+	}
+	return []*PriceDirective{{Date: date, Commodity: commodity, Price: price}}, nil
+}
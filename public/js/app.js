@@ -5,6 +5,7 @@ $(document).ready(function(){
   $('.full-file').each(function(){
     var ta = this;
     var editor = CodeMirror.fromTextArea(ta, {
+      readOnly: $(ta).prop('readonly'),
       extraKeys: {
         "Ctrl-Space": "autocomplete",
       }
@@ -17,11 +18,24 @@ $(document).ready(function(){
       editor.focus();
       editor.setCursor({line: editor.lineCount()});
     }
+    $('.validation-errors li').each(function(i){
+      var line = $(this).data('line') - 1;
+      editor.addLineClass(line, 'background', 'error-line');
+      $(this).click(function(){
+        editor.setCursor({line: line});
+        editor.focus();
+      });
+      if(i == 0){
+        editor.setCursor({line: line});
+      }
+    });
   });
 
+  // Rows are numbered after the ones the page comes with, in order.
+  var nextIndex = $('.lines > div').length;
   var copyTemplate = function(){
     if($('.template').length > 0){
-      var html = $('.template').html().replace(/placeholder/g, (new Date()).getTime());
+      var html = $('.template').html().replace(/__index__/g, nextIndex++);
       var $el = $('<div>'+html+'</div>');
       $('.lines').append($el);
     }
@@ -1,7 +1,8 @@
-// Renders the indented output of a ledger `bal` query as a collapsible tree.
-// The raw report text is read from #balTreeRaw; each line's amount is already
-// ledger's rolled-up subtotal, so we just reconstruct the hierarchy from the
-// indentation and display it. See mockups/bal_tree.html for the prototype.
+// Renders a ledger `bal` query as a collapsible tree. The tree is fetched
+// from the structured query_json endpoint named by #balTree's data-url; if
+// that is missing or fails, it is reconstructed from the indentation of the
+// raw report text in #balTreeRaw. Each amount is already the rolled-up
+// subtotal. See mockups/bal_tree.html for the prototype.
 (function () {
   "use strict";
 
@@ -62,6 +63,21 @@
     return { roots: roots, maxDepth: maxDepth };
   }
 
+  function fromJson(result) {
+    var maxDepth = 0;
+    function convert(node, depth) {
+      if (depth > maxDepth) maxDepth = depth;
+      return {
+        name: node.name,
+        amounts: node.amounts.map(function (a) { return { cur: a.commodity, val: a.amount }; }),
+        children: node.children.map(function (c) { return convert(c, depth + 1); }),
+        depth: depth
+      };
+    }
+    var roots = (result.accounts || []).map(function (n) { return convert(n, 0); });
+    return { roots: roots, maxDepth: maxDepth };
+  }
+
   function fmtVal(val) {
     return val.toLocaleString("en-US", { minimumFractionDigits: 2, maximumFractionDigits: 2 });
   }
@@ -154,7 +170,15 @@
     indicatorEl = document.getElementById("balDepthIndicator");
     var rawEl = document.getElementById("balTreeRaw");
     if (!treeEl || !rawEl) return;
-    var parsed = parseBal(rawEl.textContent);
+    var url = treeEl.getAttribute("data-url");
+    if (!url || !window.fetch) { render(parseBal(rawEl.textContent)); return; }
+    fetch(url, { credentials: "same-origin" })
+      .then(function (res) { if (!res.ok) throw new Error(res.status); return res.json(); })
+      .then(function (result) { render(fromJson(result)); })
+      .catch(function () { render(parseBal(rawEl.textContent)); });
+  }
+
+  function render(parsed) {
     maxDepth = parsed.maxDepth;
     for (var i = 0; i < parsed.roots.length; i++) treeEl.appendChild(renderNode(parsed.roots[i]));
     balTree.expandAll(); // fully expanded by default
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/mattn/go-shellwords"
+)
+
+// PostingQuery is a compiled ledger-style report query such as
+// "expenses and not retiro" or "@cultocafe or %receipt". Adjacent terms are
+// joined by "or", like ledger does, and "not" binds tighter than "and",
+// which binds tighter than "or".
+type PostingQuery interface {
+	Match(tx *Transaction, p *Posting) bool
+}
+
+type queryAnd struct{ left, right PostingQuery }
+type queryOr struct{ left, right PostingQuery }
+type queryNot struct{ inner PostingQuery }
+type queryAll struct{}
+
+type queryTerm struct {
+	field string // "account", "payee", "note", "code", "tag" or "commodity"
+	re    *regexp.Regexp
+	tag   string
+}
+
+func (q queryAnd) Match(tx *Transaction, p *Posting) bool {
+	return q.left.Match(tx, p) && q.right.Match(tx, p)
+}
+
+func (q queryOr) Match(tx *Transaction, p *Posting) bool {
+	return q.left.Match(tx, p) || q.right.Match(tx, p)
+}
+
+func (q queryNot) Match(tx *Transaction, p *Posting) bool {
+	return !q.inner.Match(tx, p)
+}
+
+func (queryAll) Match(tx *Transaction, p *Posting) bool {
+	return true
+}
+
+func (q queryTerm) Match(tx *Transaction, p *Posting) bool {
+	switch q.field {
+	case "account":
+		return q.re.MatchString(p.Account)
+	case "payee":
+		return q.re.MatchString(tx.Payee)
+	case "note":
+		return q.re.MatchString(tx.Note) || q.re.MatchString(p.Comment)
+	case "code":
+		return q.re.MatchString(tx.Code)
+	case "commodity":
+		return p.Amount != nil && q.re.MatchString(p.Amount.Currency)
+	case "tag":
+		value, ok := p.Tags[q.tag]
+		if !ok {
+			value, ok = tx.Tags[q.tag]
+		}
+		return ok && (q.re == nil || q.re.MatchString(value))
+	}
+	return false
+}
+
+// ParsePostingQuery compiles a query string. An empty query matches every
+// posting.
+func ParsePostingQuery(query string) (PostingQuery, error) {
+	words, err := shellwords.Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	return CompilePostingQuery(words)
+}
+
+// CompilePostingQuery compiles a query that has already been split into
+// words, as happens when it is part of a longer report command line.
+func CompilePostingQuery(words []string) (PostingQuery, error) {
+	tokens := []string{}
+	for _, word := range words {
+		// Parentheses may be glued to the words they group.
+		for strings.HasPrefix(word, "(") && len(word) > 1 {
+			tokens = append(tokens, "(")
+			word = word[1:]
+		}
+		closing := 0
+		for strings.HasSuffix(word, ")") && len(word) > 1 {
+			closing++
+			word = word[:len(word)-1]
+		}
+		tokens = append(tokens, word)
+		for ; closing > 0; closing-- {
+			tokens = append(tokens, ")")
+		}
+	}
+	if len(tokens) == 0 {
+		return queryAll{}, nil
+	}
+	parser := &queryParser{tokens: tokens}
+	q, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if parser.pos < len(parser.tokens) {
+		return nil, fmt.Errorf("unexpected %q in query", parser.tokens[parser.pos])
+	}
+	return q, nil
+}
+
+type queryParser struct {
+	tokens []string
+	pos    int
+}
+
+func (qp *queryParser) peek() string {
+	if qp.pos < len(qp.tokens) {
+		return qp.tokens[qp.pos]
+	}
+	return ""
+}
+
+func (qp *queryParser) next() string {
+	token := qp.peek()
+	qp.pos++
+	return token
+}
+
+func (qp *queryParser) parseOr() (PostingQuery, error) {
+	left, err := qp.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for qp.pos < len(qp.tokens) && qp.peek() != ")" {
+		if qp.peek() == "or" || qp.peek() == "|" {
+			qp.next()
+		}
+		right, err := qp.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = queryOr{left, right}
+	}
+	return left, nil
+}
+
+func (qp *queryParser) parseAnd() (PostingQuery, error) {
+	left, err := qp.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for qp.peek() == "and" || qp.peek() == "&" {
+		qp.next()
+		right, err := qp.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = queryAnd{left, right}
+	}
+	return left, nil
+}
+
+func (qp *queryParser) parseUnary() (PostingQuery, error) {
+	token := qp.next()
+	switch token {
+	case "":
+		return nil, fmt.Errorf("unexpected end of query")
+	case "not", "!":
+		inner, err := qp.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return queryNot{inner}, nil
+	case "(":
+		inner, err := qp.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if qp.next() != ")" {
+			return nil, fmt.Errorf("missing ) in query")
+		}
+		return inner, nil
+	case "expr":
+		// "expr account =~ /food/" is how automated transactions often
+		// spell a plain account match.
+		return qp.parseUnary()
+	case "account", "payee", "desc", "note", "code", "comm", "commodity", "tag":
+		if qp.peek() == "=~" {
+			qp.next()
+		}
+		return qp.parseTerm(token, qp.next())
+	}
+	switch {
+	case strings.HasPrefix(token, "@"):
+		return qp.parseTerm("payee", token[1:])
+	case strings.HasPrefix(token, "%"):
+		return qp.parseTerm("tag", token[1:])
+	case strings.HasPrefix(token, "=") && len(token) > 1:
+		return qp.parseTerm("note", token[1:])
+	}
+	return qp.parseTerm("account", token)
+}
+
+func (qp *queryParser) parseTerm(field string, pattern string) (PostingQuery, error) {
+	switch field {
+	case "desc":
+		field = "payee"
+	case "comm":
+		field = "commodity"
+	}
+	term := queryTerm{field: field}
+	if field == "tag" {
+		if i := strings.Index(pattern, "="); i >= 0 {
+			term.tag = pattern[:i]
+			pattern = pattern[i+1:]
+		} else {
+			term.tag = pattern
+			return term, nil
+		}
+	}
+	if len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		pattern = pattern[1 : len(pattern)-1]
+	}
+	if field == "commodity" {
+		pattern = "^" + regexp.QuoteMeta(pattern) + "$"
+	}
+	re, err := regexp.Compile("(?i)" + pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+	}
+	term.re = re
+	return term, nil
+}
@@ -54,6 +54,77 @@ func LoadAccountMappings() {
 	accountMappings = &AccountMappingsConfig{}
 }
 
+// BankAccount maps the statements of a bank account to a ledger account.
+// Number and Currency are optional; the mapping matching most of them is
+// used, so that e.g. the pesos and dollars accounts of a bank can map to
+// different ledger accounts.
+type BankAccount struct {
+	Bank     string // "BROU", "Itau", "VisaItau" or "OFX"
+	Number   string // account number, or its last digits
+	Currency string // "$" or "US$"
+	Account  string // ledger account, e.g. "Assets:Bancos:BROU:Pesos"
+}
+
+// StatementAccount returns the ledger account a statement maps to, or its
+// own account if none matches.
+func StatementAccount(accounts []BankAccount, statement *BankStatement) string {
+	digits := func(s string) string {
+		return strings.Map(func(r rune) rune {
+			if r >= '0' && r <= '9' {
+				return r
+			}
+			return -1
+		}, s)
+	}
+	account, best := statement.Account, 0
+	for _, m := range accounts {
+		if !strings.EqualFold(m.Bank, statement.Bank) {
+			continue
+		}
+		score := 1
+		if m.Number != "" {
+			number := digits(statement.Number)
+			if number == "" || !strings.HasSuffix(number, digits(m.Number)) {
+				continue
+			}
+			score += 2
+		}
+		if m.Currency != "" {
+			if m.Currency != statement.Currency {
+				continue
+			}
+			score++
+		}
+		if score > best {
+			account, best = m.Account, score
+		}
+	}
+	return account
+}
+
+// ReconcileAccounts lists the accounts offered for reconciliation: the
+// mapped ones, then the ledger's asset and liability accounts.
+func ReconcileAccounts(ledger string) []string {
+	accounts := []string{}
+	seen := map[string]bool{}
+	add := func(account string) {
+		if !seen[account] {
+			seen[account] = true
+			accounts = append(accounts, account)
+		}
+	}
+	for _, m := range ledgers[ledger].BankAccounts {
+		add(m.Account)
+	}
+	for _, account := range LedgerAccounts(ledger) {
+		lower := strings.ToLower(account)
+		if strings.HasPrefix(lower, "assets") || strings.HasPrefix(lower, "liabilities") {
+			add(account)
+		}
+	}
+	return accounts
+}
+
 // normalizeWhitespace collapses multiple whitespaces to a single space
 func normalizeWhitespace(s string) string {
 	// Use regexp to replace multiple whitespace with single space
@@ -90,93 +161,44 @@ func GetAccountForDescription(description string, isExpense bool) string {
 // It returns a slice of Amount, one per commodity found.
 // The date is exclusive (balance as of end of previous day).
 func QueryLedgerAccountBalances(ledgerName string, account string, endDate time.Time) []Amount {
-	dateStr := endDate.Format("2006-01-02")
-	query := fmt.Sprintf(`bal '%s' -e '%s' -F '%%T\n'`, account, dateStr)
-	output := strings.TrimSpace(LedgerExec(ledgerName, query))
-	if output == "" {
+	query, err := CompilePostingQuery([]string{account})
+	if err != nil {
+		Log("Error %v", err)
 		return nil
 	}
+	journal := LedgerJournal(ledgerName)
+	report := BalanceReportFor(journal, ReportOptions{Query: query, End: endDate})
 
 	var balances []Amount
-	amountRegex := regexp.MustCompile(`^\s*((?:US)?\$)\s*([\-\d,\.]+)\s*$`)
-	for _, line := range strings.Split(output, "\n") {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
-		if m := amountRegex.FindStringSubmatch(line); m != nil {
-			currency := m[1]
-			valStr := strings.ReplaceAll(m[2], ",", "")
-			val := 0.0
-			fmt.Sscanf(valStr, "%f", &val)
-			balances = append(balances, Amount{Currency: currency, Value: val})
+	for _, currency := range report.Total.Commodities() {
+		value := report.Total[currency]
+		if math.Abs(value) > journal.tolerance(currency) {
+			balances = append(balances, Amount{Currency: currency, Value: value})
 		}
 	}
 	return balances
 }
 
-// QueryLedgerTransactions queries ledger using CLI with optional commodity/currency filter
-// Uses format: reg <account> -l "commodity == '<currency>'" -F "%(format_date(date, \"%Y-%m-%d\")) %t\n"
+// QueryLedgerTransactions lists the postings to an account, optionally only those in
+// one commodity/currency
 func QueryLedgerTransactions(ledgerName string, account string, currency string) ([]LedgerTransaction, error) {
 	transactions := []LedgerTransaction{}
 	
-	// Build the query with commodity filter
-	// Note: We use %t for total amount and format_date for YYYY-MM-DD format
-	// Using single quotes around the -l and -F arguments to avoid shell escaping issues
-	var query string
-	if currency != "" {
-		// Inside single quotes, $ doesn't need escaping for shell, but ledger needs \$ for regex
-		query = fmt.Sprintf(`reg %s -l 'commodity == "\%s"' -F '%%(format_date(date, "%%Y-%%m-%%d")) %%t
-'`, account, currency)
-	} else {
-		query = fmt.Sprintf(`reg %s -F '%%(format_date(date, "%%Y-%%m-%%d")) %%t
-'`, account)
-	}
-	
-	output := LedgerExec(ledgerName, query)
-	if output == "" {
-		return transactions, nil
+	query, err := CompilePostingQuery([]string{account})
+	if err != nil {
+		return nil, err
 	}
+	journal := LedgerJournal(ledgerName)
+	rows := RegisterReportFor(journal, ReportOptions{Query: query, Commodity: currency})
 	
-	// Parse output: each line is "date amount"
-	// Example: 2025/01/15 $1,234.56
-	lines := strings.Split(strings.TrimSpace(output), "\n")
-	dateRegex := regexp.MustCompile(`^(\d{4}[/-]\d{1,2}[/-]\d{1,2})\s+(.+)$`)
-	
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
-		}
-		
-		matches := dateRegex.FindStringSubmatch(line)
-		if matches == nil {
-			continue
-		}
-		
-		dateStr := matches[1]
-		amountStr := strings.TrimSpace(matches[2])
-		
-		// Parse date
-		var date time.Time
-		var err error
-		for _, format := range []string{"2006/01/02", "2006-01-02"} {
-			date, err = time.Parse(format, dateStr)
-			if err == nil {
-				break
-			}
-		}
-		if err != nil {
-			continue
-		}
-		
-		// Parse amount
-		amount := parseLedgerAmount(amountStr)
-		
+	for _, row := range rows {
 		transaction := LedgerTransaction{
-			Date:    date,
-			Account: account,
-			Amount:  amount,
+			Date:        row.Date,
+			Description: row.Payee,
+			Account:     row.Account,
+			Amount:      row.Amount.Value,
+			LineNumber:  row.Transaction.Span.StartLine,
+			RawEntry:    journal.Text(row.Transaction.Span),
 		}
 		
 		transactions = append(transactions, transaction)
@@ -226,105 +248,32 @@ type ReconciliationResult struct {
 	TotalLedgerCredits  float64
 }
 
-// ParseLedgerTransactions extracts transactions from a ledger file for a specific account
-func ParseLedgerTransactions(ledgerContent string, account string) ([]LedgerTransaction, error) {
+// ParseLedgerTransactions extracts the postings to an account, or any of its
+// sub-accounts, from the content of the ledger file at path, which includes
+// are relative to
+func ParseLedgerTransactions(path string, ledgerContent string, account string) ([]LedgerTransaction, error) {
 	transactions := []LedgerTransaction{}
-	lines := strings.Split(ledgerContent, "\n")
+	journal := ParseJournal(path, ledgerContent)
 	
-	var currentDate time.Time
-	var currentDescription string
-	var entryStartLine int
-	var currentEntry strings.Builder
-	
-	dateRegex := regexp.MustCompile(`^(\d{4})[/-](\d{1,2})[/-](\d{1,2})(?:\s+(.*))?$`)
-	accountRegex := regexp.MustCompile(`^\s+(` + regexp.QuoteMeta(account) + `(?::\w+)?)\s+([\$US\-\d\.,\s]+)`)
-	
-	for lineNum, line := range lines {
-		currentEntry.WriteString(line)
-		currentEntry.WriteString("\n")
-		
-		// Check if this is a date line (start of new transaction)
-		if matches := dateRegex.FindStringSubmatch(line); matches != nil {
-			// Save previous entry if we were processing one
-			if !currentDate.IsZero() && currentDescription != "" {
-				// Process completed entry - already added accounts
-			}
-			
-			// Start new entry
-			currentEntry.Reset()
-			currentEntry.WriteString(line)
-			currentEntry.WriteString("\n")
-			entryStartLine = lineNum + 1
-			
-			year := matches[1]
-			month := matches[2]
-			day := matches[3]
-			desc := strings.TrimSpace(matches[4])
-			
-			dateStr := fmt.Sprintf("%s-%02s-%02s", year, month, day)
-			if parsedDate, err := time.Parse("2006-01-02", dateStr); err == nil {
-				currentDate = parsedDate
-				currentDescription = desc
-			}
-			continue
-		}
-		
-		// Check if this is an account line matching our account
-		if !currentDate.IsZero() {
-			if matches := accountRegex.FindStringSubmatch(line); matches != nil {
-				matchedAccount := matches[1]
-				amountStr := strings.TrimSpace(matches[2])
-				
-				// Parse the amount
-				amount := parseLedgerAmount(amountStr)
-				
-				transaction := LedgerTransaction{
-					Date:        currentDate,
-					Description: currentDescription,
-					Account:     matchedAccount,
-					Amount:      amount,
-					LineNumber:  entryStartLine,
-					RawEntry:    currentEntry.String(),
-				}
-				
-				transactions = append(transactions, transaction)
-			}
-		}
-		
-		// Reset on blank line
-		if strings.TrimSpace(line) == "" {
-			if !currentDate.IsZero() {
-				currentDate = time.Time{}
-				currentDescription = ""
-				currentEntry.Reset()
+	for _, tx := range journal.Transactions {
+		for _, posting := range tx.Postings {
+			if posting.Account != account && !strings.HasPrefix(posting.Account, account+":") {
+				continue
 			}
+			transactions = append(transactions, LedgerTransaction{
+				Date:        tx.Date,
+				Description: tx.Payee,
+				Account:     posting.Account,
+				Amount:      posting.Amount.Value,
+				LineNumber:  tx.Span.StartLine,
+				RawEntry:    journal.Text(tx.Span),
+			})
 		}
 	}
 	
 	return transactions, nil
 }
 
-// parseLedgerAmount parses an amount from a ledger entry
-// Ledger CLI outputs amounts in US format: comma as thousands separator, dot as decimal
-// Example: "$ 100,000.00" or "US$ -2,500.00"
-func parseLedgerAmount(amountStr string) float64 {
-	// Remove currency symbols
-	amountStr = strings.TrimSpace(amountStr)
-	amountStr = strings.ReplaceAll(amountStr, "$", "")
-	amountStr = strings.ReplaceAll(amountStr, "US", "")
-	amountStr = strings.ReplaceAll(amountStr, " ", "")
-	
-	// Ledger uses US format: comma for thousands, dot for decimal
-	// Simply remove all commas (they're thousand separators)
-	amountStr = strings.ReplaceAll(amountStr, ",", "")
-	
-	// Parse amount
-	var amount float64
-	fmt.Sscanf(amountStr, "%f", &amount)
-	
-	return amount
-}
-
 // ReconcileBankStatement performs reconciliation between bank statement and ledger
 func ReconcileBankStatement(statement *BankStatement, ledgerTransactions []LedgerTransaction) *ReconciliationResult {
 	result := &ReconciliationResult{
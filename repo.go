@@ -0,0 +1,309 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GitError is a git operation that failed on a ledger's repository. Op is
+// "pull", "commit" or "push".
+type GitError struct {
+	Ledger string
+	Op     string
+	Output string
+	Err    error
+}
+
+func (e *GitError) Error() string {
+	var message string
+	switch e.Op {
+	case "pull":
+		message = "Could not update " + e.Ledger + " from its remote repository"
+	case "commit":
+		message = "Could not commit the changes to " + e.Ledger
+	case "push":
+		message = "The changes to " + e.Ledger + " were not saved because they could not be pushed to its remote repository, please try again"
+	default:
+		message = "git " + e.Op + " failed for " + e.Ledger
+	}
+	return strings.TrimSpace(fmt.Sprintf("%v (%v)\n%v", message, e.Err, e.Output))
+}
+
+func (e *GitError) Unwrap() error {
+	return e.Err
+}
+
+// ConflictError is an edit of an old revision of a ledger that could not be
+// merged with the changes committed since.
+type ConflictError struct {
+	Ledger string
+	Base   string
+	Head   string
+	Diff   string // changes from Base to Head
+	Merged string // the edit merged with Head, with conflict markers
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("the edit of %v conflicts with changes made since %v", e.Ledger, e.Base)
+}
+
+// Repo is the git working tree of a ledger. Do runs operations on it one at
+// a time, so concurrent requests do not race on the same tree; the other
+// methods must only be called from inside Do.
+type Repo struct {
+	mu     sync.Mutex
+	ledger string
+	dir    string
+	file   string // ledger file, relative to dir
+}
+
+var repos = map[string]*Repo{}
+var reposMu sync.Mutex
+
+// LedgerRepo returns the repository of a ledger.
+func LedgerRepo(ledger string) *Repo {
+	reposMu.Lock()
+	defer reposMu.Unlock()
+	repo, ok := repos[ledger]
+	if !ok {
+		ledger_path := LedgerPath(ledger)
+		repo = &Repo{ledger: ledger, dir: path.Dir(ledger_path), file: path.Base(ledger_path)}
+		repos[ledger] = repo
+	}
+	return repo
+}
+
+// Do runs op after any other operation queued on the repository.
+func (repo *Repo) Do(op func() error) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+	return op()
+}
+
+// run runs a git command, returning a GitError for op if it fails.
+func (repo *Repo) run(op string, arg ...string) (string, error) {
+	Log("git %v", arg)
+	cmd := exec.Command("git", arg...)
+	cmd.Dir = repo.dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		Log("Error %v\n%s", err, out)
+		return string(out), &GitError{Ledger: repo.ledger, Op: op, Output: string(out), Err: err}
+	}
+	return string(out), nil
+}
+
+func (repo *Repo) Pull() error {
+	_, err := repo.run("pull", "pull", "origin", "master")
+	return err
+}
+
+// Commit commits the ledger file and the other given files of the
+// repository. It returns false if there was nothing to commit.
+func (repo *Repo) Commit(message string, author string, files ...string) (bool, error) {
+	if _, err := repo.run("commit", append([]string{"add", repo.file}, files...)...); err != nil {
+		return false, err
+	}
+	if _, err := gitOutput(repo.dir, "diff", "--cached", "--quiet"); err == nil {
+		return false, nil
+	}
+	_, err := repo.run("commit", "commit", "-m", message, "--author", author)
+	return err == nil, err
+}
+
+func (repo *Repo) Push() error {
+	_, err := repo.run("push", "push", "origin", "master")
+	return err
+}
+
+// Path returns the path of the ledger file.
+func (repo *Repo) Path() string {
+	return path.Join(repo.dir, repo.file)
+}
+
+func (repo *Repo) Read() (string, error) {
+	bytes, err := ioutil.ReadFile(repo.Path())
+	return string(bytes), err
+}
+
+func (repo *Repo) Write(file string) error {
+	return ioutil.WriteFile(repo.Path(), []byte(file), os.ModePerm)
+}
+
+// ReadFile reads another file of the repository, relative to the directory
+// of the ledger file.
+func (repo *Repo) ReadFile(name string) (string, error) {
+	bytes, err := ioutil.ReadFile(path.Join(repo.dir, name))
+	return string(bytes), err
+}
+
+// WriteFile writes another file of the repository.
+func (repo *Repo) WriteFile(name string, content string) error {
+	return ioutil.WriteFile(path.Join(repo.dir, name), []byte(content), os.ModePerm)
+}
+
+// Restore undoes a failed save: it moves the branch back to rev if a
+// commit was made since, and puts files back as they were at rev, removing
+// the ones that did not exist then.
+func (repo *Repo) Restore(rev string, files ...string) {
+	if repo.Revision() != rev {
+		repo.run("restore", "reset", "-q", rev)
+	}
+	for _, name := range files {
+		if _, err := gitOutput(repo.dir, "cat-file", "-e", rev+":./"+name); err == nil {
+			repo.run("restore", "checkout", rev, "--", name)
+		} else {
+			repo.run("restore", "rm", "-q", "--cached", "--ignore-unmatch", "--", name)
+			os.Remove(path.Join(repo.dir, name))
+		}
+	}
+}
+
+// Revision returns the commit the working tree is at.
+func (repo *Repo) Revision() string {
+	out, err := gitOutput(repo.dir, "rev-parse", "HEAD")
+	if err != nil {
+		Log("Error reading revision of %v: %v", repo.ledger, err)
+	}
+	return strings.TrimSpace(out)
+}
+
+// Changes returns the diff of the ledger file between two commits.
+func (repo *Repo) Changes(from string, to string) string {
+	out, err := gitOutput(repo.dir, "diff", from, to, "--", repo.file)
+	if err != nil {
+		Log("Error diffing %v: %v", repo.ledger, err)
+	}
+	return out
+}
+
+// Commit is a commit that changed a ledger file.
+type Commit struct {
+	Hash    string
+	Author  string
+	Email   string
+	Date    time.Time
+	Subject string
+	Body    string // the rest of the message, like the change summary after a user's message
+}
+
+// Short returns the abbreviated commit hash.
+func (c Commit) Short() string {
+	if len(c.Hash) > 8 {
+		return c.Hash[:8]
+	}
+	return c.Hash
+}
+
+// History returns the latest commits that changed the ledger file, newest
+// first, or the one commit rev if it is not empty.
+func (repo *Repo) History(rev string, limit int) ([]Commit, error) {
+	args := []string{"log", "--format=%H%x1f%an%x1f%ae%x1f%aI%x1f%s%x1f%b%x1e", "-n", strconv.Itoa(limit)}
+	if rev != "" {
+		args = append(args, "--no-walk", rev)
+	}
+	out, err := gitOutput(repo.dir, append(args, "--", repo.file)...)
+	if err != nil {
+		return nil, err
+	}
+	commits := []Commit{}
+	for _, record := range strings.Split(out, "\x1e") {
+		fields := strings.Split(strings.TrimSpace(record), "\x1f")
+		if len(fields) != 6 {
+			continue
+		}
+		date, _ := time.Parse(time.RFC3339, fields[3])
+		commits = append(commits, Commit{Hash: fields[0], Author: fields[1], Email: fields[2], Date: date, Subject: fields[4], Body: strings.TrimSpace(fields[5])})
+	}
+	return commits, nil
+}
+
+// FileAt returns the ledger file as of a commit. It is empty if the file
+// did not exist then, as before the first commit.
+func (repo *Repo) FileAt(rev string) (string, error) {
+	return repo.ReadFileAt(rev, repo.file)
+}
+
+// ReadFileAt reads another file of the repository as of a commit, like
+// FileAt.
+func (repo *Repo) ReadFileAt(rev string, name string) (string, error) {
+	if _, err := gitOutput(repo.dir, "rev-parse", "--verify", "--quiet", rev+"^{commit}"); err != nil {
+		return "", nil
+	}
+	out, err := gitOutput(repo.dir, "show", rev+":./"+name)
+	if err != nil && strings.Contains(err.Error(), "exist") {
+		return "", nil
+	}
+	return out, err
+}
+
+var revisionRegex = regexp.MustCompile("^[0-9a-f]{7,64}$")
+
+// Merge merges file, an edit of the ledger as it was at revision base, into
+// the current ledger file. It returns false if the edit conflicts with
+// changes committed since base.
+func (repo *Repo) Merge(base string, file string) (string, bool) {
+	if !revisionRegex.MatchString(base) {
+		return file, false
+	}
+	original, err := gitOutput(repo.dir, "show", base+":./"+repo.file)
+	if err != nil {
+		Log("Error reading %v at %v: %v", repo.ledger, base, err)
+		return file, false
+	}
+	current, err := repo.Read()
+	if err != nil {
+		Log("Error reading ledger %v: %v", repo.ledger, err)
+		return file, false
+	}
+	merged, clean, err := mergeText(original, file, current)
+	if err != nil {
+		Log("Error merging %v: %v", repo.ledger, err)
+		return file, false
+	}
+	return merged, clean
+}
+
+// mergeText three-way merges ours and theirs, two edits of base, with git
+// merge-file.
+func mergeText(base string, ours string, theirs string) (string, bool, error) {
+	dir, err := ioutil.TempDir("", "webledger-merge")
+	if err != nil {
+		return "", false, err
+	}
+	defer os.RemoveAll(dir)
+	files := []string{path.Join(dir, "ours"), path.Join(dir, "base"), path.Join(dir, "theirs")}
+	for i, text := range []string{ours, base, theirs} {
+		if err := ioutil.WriteFile(files[i], []byte(text), 0600); err != nil {
+			return "", false, err
+		}
+	}
+	out, err := exec.Command("git", "merge-file", "-p", "-L", "yours", "-L", "original", "-L", "saved", files[0], files[1], files[2]).Output()
+	if exit, ok := err.(*exec.ExitError); ok && exit.ExitCode() > 0 && exit.ExitCode() < 128 {
+		return string(out), false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return string(out), true, nil
+}
+
+// gitOutput runs a git command and returns its standard output, without
+// logging it like Run does.
+func gitOutput(dir string, arg ...string) (string, error) {
+	cmd := exec.Command("git", arg...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if exit, ok := err.(*exec.ExitError); ok {
+		err = fmt.Errorf("git %v: %v: %s", arg[0], err, strings.TrimSpace(string(exit.Stderr)))
+	}
+	return string(out), err
+}
@@ -0,0 +1,694 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errUnsupportedReport is returned for commands and options the built-in
+// engine does not implement. LedgerExec hands those to the ledger binary
+// when it is installed.
+var errUnsupportedReport = errors.New("unsupported report")
+
+// ReportOptions selects the postings of a report and how they are shown.
+// They mirror the ledger command line options of the same name.
+type ReportOptions struct {
+	Query      PostingQuery
+	Begin      time.Time // inclusive, zero for no limit
+	End        time.Time // exclusive, zero for no limit
+	Depth      int       // 0 for no limit
+	Exchange   string    // -X: commodity to convert amounts to
+	Historical bool      // -H: convert at the posting date
+	Flat       bool
+	Empty      bool
+	Real       bool
+	Cleared    bool
+	NoTotal    bool
+	Commodity  string // only postings in this commodity
+}
+
+// BalanceRow is one line of a balance report.
+type BalanceRow struct {
+	Account string // full account name
+	Name    string // name as displayed, relative to the parent row
+	Depth   int    // indentation level
+	Total   Balance
+}
+
+// BalanceReport is the result of a "bal" query.
+type BalanceReport struct {
+	Rows  []BalanceRow
+	Total Balance
+}
+
+// RegisterRow is one posting of a register report with the running total.
+type RegisterRow struct {
+	Transaction *Transaction
+	Posting     *Posting
+	Date        time.Time
+	Payee       string
+	Account     string
+	Amount      Amount
+	Total       Balance
+}
+
+// ParseReportCommand splits a ledger command line such as
+// "bal expenses -p 'Sep 2026' --depth 2" into the command and its options.
+func ParseReportCommand(args []string, now time.Time) (string, ReportOptions, error) {
+	opts := ReportOptions{}
+	if len(args) == 0 {
+		return "", opts, fmt.Errorf("empty query")
+	}
+	command := args[0]
+	terms := []string{}
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		value := ""
+		if strings.HasPrefix(arg, "--") {
+			if eq := strings.Index(arg, "="); eq >= 0 {
+				arg, value = arg[:eq], arg[eq+1:]
+			}
+		}
+		needValue := func() (string, error) {
+			if value != "" {
+				return value, nil
+			}
+			if i+1 >= len(args) {
+				return "", fmt.Errorf("missing value for %s", arg)
+			}
+			i++
+			return args[i], nil
+		}
+		var err error
+		switch arg {
+		case "-b", "--begin", "-e", "--end", "-p", "--period":
+			if value, err = needValue(); err != nil {
+				return "", opts, err
+			}
+			begin, end, err := ParsePeriod(value, now)
+			if err != nil {
+				return "", opts, err
+			}
+			switch arg {
+			case "-b", "--begin":
+				opts.Begin = begin
+			case "-e", "--end":
+				opts.End = begin
+			default:
+				opts.Begin, opts.End = begin, end
+			}
+		case "--depth":
+			if value, err = needValue(); err != nil {
+				return "", opts, err
+			}
+			if opts.Depth, err = strconv.Atoi(value); err != nil {
+				return "", opts, fmt.Errorf("invalid depth %q", value)
+			}
+		case "-X", "--exchange":
+			if opts.Exchange, err = needValue(); err != nil {
+				return "", opts, err
+			}
+		case "-H", "--historical":
+			opts.Historical = true
+		case "--flat":
+			opts.Flat = true
+		case "-E", "--empty":
+			opts.Empty = true
+		case "-R", "--real":
+			opts.Real = true
+		case "-C", "--cleared":
+			opts.Cleared = true
+		case "-n", "--no-total":
+			opts.NoTotal = true
+		default:
+			if strings.HasPrefix(arg, "-") && len(arg) > 1 {
+				return "", opts, errUnsupportedReport
+			}
+			terms = append(terms, args[i])
+		}
+	}
+	query, err := CompilePostingQuery(terms)
+	if err != nil {
+		return "", opts, err
+	}
+	opts.Query = query
+	return command, opts, nil
+}
+
+// RunReport runs a ledger-style command against a journal and returns its
+// output formatted like the ledger binary prints it.
+func RunReport(journal *Journal, args []string) (string, error) {
+	command, opts, err := ParseReportCommand(args, time.Now())
+	if err != nil {
+		return "", err
+	}
+	switch command {
+	case "bal", "balance", "b":
+		return FormatBalanceReport(journal, BalanceReportFor(journal, opts), opts), nil
+	case "reg", "register", "r":
+		return FormatRegisterReport(journal, RegisterReportFor(journal, opts)), nil
+	case "print", "p":
+		var b strings.Builder
+		for _, tx := range reportTransactions(journal, opts) {
+			if b.Len() > 0 {
+				b.WriteString("\n")
+			}
+			b.WriteString(journal.Text(tx.Span))
+		}
+		return b.String(), nil
+	case "accounts", "payees", "commodities":
+		set := map[string]bool{}
+		forEachReportPosting(journal, opts, func(tx *Transaction, p *Posting) {
+			switch command {
+			case "accounts":
+				set[p.Account] = true
+			case "payees":
+				set[tx.Payee] = true
+			default:
+				set[p.Amount.Currency] = true
+			}
+		})
+		list := []string{}
+		for item := range set {
+			list = append(list, item)
+		}
+		sort.Strings(list)
+		if len(list) == 0 {
+			return "", nil
+		}
+		return strings.Join(list, "\n") + "\n", nil
+	}
+	return "", errUnsupportedReport
+}
+
+// forEachReportPosting calls fn for every posting selected by the options.
+func forEachReportPosting(journal *Journal, opts ReportOptions, fn func(*Transaction, *Posting)) {
+	for _, tx := range journal.Transactions {
+		if !opts.Begin.IsZero() && tx.Date.Before(opts.Begin) {
+			continue
+		}
+		if !opts.End.IsZero() && !tx.Date.Before(opts.End) {
+			continue
+		}
+		if opts.Cleared && tx.State != "*" {
+			continue
+		}
+		for _, p := range tx.Postings {
+			if opts.Real && p.Virtual {
+				continue
+			}
+			if opts.Commodity != "" && p.Amount.Currency != opts.Commodity {
+				continue
+			}
+			if opts.Query != nil && !opts.Query.Match(tx, p) {
+				continue
+			}
+			fn(tx, p)
+		}
+	}
+}
+
+func reportTransactions(journal *Journal, opts ReportOptions) []*Transaction {
+	list := []*Transaction{}
+	forEachReportPosting(journal, opts, func(tx *Transaction, p *Posting) {
+		if len(list) == 0 || list[len(list)-1] != tx {
+			list = append(list, tx)
+		}
+	})
+	return list
+}
+
+// truncateAccount keeps the first depth components of an account name.
+func truncateAccount(account string, depth int) string {
+	if depth <= 0 {
+		return account
+	}
+	parts := strings.Split(account, ":")
+	if len(parts) > depth {
+		parts = parts[:depth]
+	}
+	return strings.Join(parts, ":")
+}
+
+type accountNode struct {
+	name     string
+	full     string
+	own      Balance
+	total    Balance
+	children map[string]*accountNode
+}
+
+func (n *accountNode) child(name string) *accountNode {
+	c, ok := n.children[name]
+	if !ok {
+		full := name
+		if n.full != "" {
+			full = n.full + ":" + name
+		}
+		c = &accountNode{name: name, full: full, own: Balance{}, total: Balance{}, children: map[string]*accountNode{}}
+		n.children[name] = c
+	}
+	return c
+}
+
+func (n *accountNode) sortedChildren() []*accountNode {
+	list := []*accountNode{}
+	for _, c := range n.children {
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	return list
+}
+
+// BalanceReportFor computes account totals for the postings selected by
+// the options.
+func BalanceReportFor(journal *Journal, opts ReportOptions) *BalanceReport {
+	prices := NewPriceHistory(journal)
+	root := &accountNode{own: Balance{}, total: Balance{}, children: map[string]*accountNode{}}
+	forEachReportPosting(journal, opts, func(tx *Transaction, p *Posting) {
+		amount := *p.Amount
+		if opts.Exchange != "" && opts.Historical {
+			amount = prices.Convert(amount, opts.Exchange, tx.Date)
+		}
+		node := root
+		for _, part := range strings.Split(truncateAccount(p.Account, opts.Depth), ":") {
+			node = node.child(part)
+		}
+		node.own.Add(amount)
+	})
+
+	if opts.Exchange != "" && !opts.Historical {
+		date := opts.End
+		if date.IsZero() {
+			date = time.Now()
+		}
+		var convert func(n *accountNode)
+		convert = func(n *accountNode) {
+			converted := Balance{}
+			for c, v := range n.own {
+				converted.Add(prices.Convert(Amount{Currency: c, Value: v}, opts.Exchange, date))
+			}
+			n.own = converted
+			for _, child := range n.children {
+				convert(child)
+			}
+		}
+		convert(root)
+	}
+
+	var sum func(n *accountNode)
+	sum = func(n *accountNode) {
+		n.total.AddBalance(n.own)
+		for _, child := range n.children {
+			sum(child)
+			n.total.AddBalance(child.total)
+		}
+	}
+	sum(root)
+
+	report := &BalanceReport{Total: root.total}
+	visible := func(n *accountNode) bool {
+		return opts.Empty || !journal.IsZero(n.total)
+	}
+
+	if opts.Flat {
+		var walk func(n *accountNode)
+		walk = func(n *accountNode) {
+			for _, c := range n.sortedChildren() {
+				if len(c.own) > 0 && (opts.Empty || !journal.IsZero(c.own)) {
+					report.Rows = append(report.Rows, BalanceRow{Account: c.full, Name: c.full, Total: c.own})
+				}
+				walk(c)
+			}
+		}
+		walk(root)
+		return report
+	}
+
+	var visit func(n *accountNode, depth int, prefix string)
+	visit = func(n *accountNode, depth int, prefix string) {
+		children := []*accountNode{}
+		for _, c := range n.sortedChildren() {
+			if visible(c) {
+				children = append(children, c)
+			}
+		}
+		// An account with no postings of its own and a single child is
+		// shown on one line with it, as "Assets:Bancos:BROU".
+		if len(children) == 1 && journal.IsZero(n.own) {
+			visit(children[0], depth, prefix+n.name+":")
+			return
+		}
+		report.Rows = append(report.Rows, BalanceRow{Account: n.full, Name: prefix + n.name, Depth: depth, Total: n.total})
+		for _, c := range children {
+			visit(c, depth+1, "")
+		}
+	}
+	for _, c := range root.sortedChildren() {
+		if visible(c) {
+			visit(c, 0, "")
+		}
+	}
+	return report
+}
+
+// RegisterReportFor lists the postings selected by the options in journal
+// order, with a running total.
+func RegisterReportFor(journal *Journal, opts ReportOptions) []RegisterRow {
+	prices := NewPriceHistory(journal)
+	rows := []RegisterRow{}
+	total := Balance{}
+	forEachReportPosting(journal, opts, func(tx *Transaction, p *Posting) {
+		amount := *p.Amount
+		if opts.Exchange != "" {
+			amount = prices.Convert(amount, opts.Exchange, tx.Date)
+		}
+		total.Add(amount)
+		running := Balance{}
+		running.AddBalance(total)
+		rows = append(rows, RegisterRow{
+			Transaction: tx,
+			Posting:     p,
+			Date:        tx.Date,
+			Payee:       tx.Payee,
+			Account:     truncateAccount(p.Account, opts.Depth),
+			Amount:      amount,
+			Total:       running,
+		})
+	})
+	return rows
+}
+
+// balanceLines formats every non-zero commodity of a balance, or "0".
+func balanceLines(journal *Journal, b Balance) []string {
+	lines := []string{}
+	for _, c := range b.Commodities() {
+		if math.Abs(b[c]) > journal.tolerance(c) {
+			lines = append(lines, journal.FormatAmount(Amount{Currency: c, Value: b[c]}))
+		}
+	}
+	if len(lines) == 0 {
+		lines = append(lines, "0")
+	}
+	return lines
+}
+
+// FormatBalance prints a balance on one line, e.g. "$ 100.00, US$ 5.00".
+func FormatBalance(journal *Journal, b Balance) string {
+	return strings.Join(balanceLines(journal, b), ", ")
+}
+
+// FormatBalanceReport prints a balance report like "ledger bal" does.
+func FormatBalanceReport(journal *Journal, report *BalanceReport, opts ReportOptions) string {
+	var out strings.Builder
+	for _, row := range report.Rows {
+		lines := balanceLines(journal, row.Total)
+		for i, line := range lines {
+			out.WriteString(fmt.Sprintf("%20s", line))
+			if i == len(lines)-1 {
+				out.WriteString("  " + strings.Repeat("  ", row.Depth) + row.Name)
+			}
+			out.WriteString("\n")
+		}
+	}
+	if len(report.Rows) > 1 && !opts.NoTotal {
+		out.WriteString(strings.Repeat("-", 20) + "\n")
+		for _, line := range balanceLines(journal, report.Total) {
+			out.WriteString(fmt.Sprintf("%20s\n", line))
+		}
+	}
+	return out.String()
+}
+
+func truncateColumn(s string, width int) string {
+	runes := []rune(s)
+	if len(runes) <= width {
+		return s
+	}
+	return string(runes[:width-2]) + ".."
+}
+
+// FormatRegisterReport prints a register report like "ledger reg" does.
+func FormatRegisterReport(journal *Journal, rows []RegisterRow) string {
+	var out strings.Builder
+	var last *Transaction
+	for _, row := range rows {
+		date, payee := "", ""
+		if row.Transaction != last {
+			date = row.Date.Format("2006/01/02")
+			payee = truncateColumn(row.Payee, 22)
+			last = row.Transaction
+		}
+		totals := balanceLines(journal, row.Total)
+		out.WriteString(fmt.Sprintf("%-10s %-22s %-22s %12s %12s\n",
+			date, payee, truncateColumn(row.Account, 22), journal.FormatAmount(row.Amount), totals[0]))
+		for _, total := range totals[1:] {
+			out.WriteString(fmt.Sprintf("%-10s %-22s %-22s %12s %12s\n", "", "", "", "", total))
+		}
+	}
+	return out.String()
+}
+
+var monthNames = map[string]time.Month{
+	"jan": time.January, "feb": time.February, "mar": time.March, "apr": time.April,
+	"may": time.May, "jun": time.June, "jul": time.July, "aug": time.August,
+	"sep": time.September, "oct": time.October, "nov": time.November, "dec": time.December,
+}
+
+// ParsePeriod turns a ledger period expression such as "2026/10/01",
+// "Oct 2026", "2026", "last month", "last 12 months", "2 months ago" or
+// "from Jan to Mar" into the interval
+// [begin, end) it covers. A zero time means no limit.
+func ParsePeriod(expr string, now time.Time) (time.Time, time.Time, error) {
+	words := strings.Fields(strings.ToLower(expr))
+	if len(words) > 0 && words[0] == "in" {
+		words = words[1:]
+	}
+	split := -1
+	for i, w := range words {
+		if w == "to" || w == "until" || w == "-" {
+			split = i
+		}
+	}
+	if len(words) > 0 && (words[0] == "from" || words[0] == "since") || split >= 0 {
+		var begin, end time.Time
+		from := words
+		if split >= 0 {
+			from = words[:split]
+			if len(words) > split+1 {
+				var err error
+				if end, _, err = parseDateInterval(words[split+1:], now); err != nil {
+					return begin, end, err
+				}
+			}
+		}
+		if len(from) > 0 && (from[0] == "from" || from[0] == "since") {
+			from = from[1:]
+		}
+		if len(from) > 0 {
+			var err error
+			if begin, _, err = parseDateInterval(from, now); err != nil {
+				return begin, end, err
+			}
+		}
+		return begin, end, nil
+	}
+	return parseDateInterval(words, now)
+}
+
+// parseDateInterval parses a single date expression into the day, month or
+// year it names.
+func parseDateInterval(words []string, now time.Time) (time.Time, time.Time, error) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	yearStart := time.Date(now.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+	bad := fmt.Errorf("invalid date %q", strings.Join(words, " "))
+
+	switch len(words) {
+	case 1:
+		switch words[0] {
+		case "today":
+			return today, today.AddDate(0, 0, 1), nil
+		case "yesterday":
+			return today.AddDate(0, 0, -1), today, nil
+		case "tomorrow":
+			return today.AddDate(0, 0, 1), today.AddDate(0, 0, 2), nil
+		}
+		if m, ok := monthNames[prefix3(words[0])]; ok {
+			begin := time.Date(now.Year(), m, 1, 0, 0, 0, 0, time.UTC)
+			return begin, begin.AddDate(0, 1, 0), nil
+		}
+		return parseNumericDate(words[0], now)
+	case 2:
+		offset := 0
+		switch words[0] {
+		case "this":
+		case "last":
+			offset = -1
+		case "next":
+			offset = 1
+		default:
+			// "Oct 2026" or "2026 Oct".
+			month, year := words[0], words[1]
+			if _, err := strconv.Atoi(month); err == nil {
+				month, year = year, month
+			}
+			m, ok := monthNames[prefix3(month)]
+			y, err := strconv.Atoi(year)
+			if !ok || err != nil {
+				return time.Time{}, time.Time{}, bad
+			}
+			begin := time.Date(y, m, 1, 0, 0, 0, 0, time.UTC)
+			return begin, begin.AddDate(0, 1, 0), nil
+		}
+		switch words[1] {
+		case "day":
+			begin := today.AddDate(0, 0, offset)
+			return begin, begin.AddDate(0, 0, 1), nil
+		case "week":
+			begin := today.AddDate(0, 0, -int(today.Weekday())+7*offset)
+			return begin, begin.AddDate(0, 0, 7), nil
+		case "month":
+			begin := monthStart.AddDate(0, offset, 0)
+			return begin, begin.AddDate(0, 1, 0), nil
+		case "year":
+			begin := yearStart.AddDate(offset, 0, 0)
+			return begin, begin.AddDate(1, 0, 0), nil
+		}
+	case 3:
+		// "last 12 months" are the twelve months before the current one, and
+		// "2 months ago" is the month before last.
+		n, err := strconv.Atoi(words[1])
+		if words[0] == "last" && err == nil && n > 0 {
+			begin, _, err := parseDateInterval([]string{"this", strings.TrimSuffix(words[2], "s")}, now)
+			if err != nil {
+				return time.Time{}, time.Time{}, bad
+			}
+			return shiftDate(begin, words[2], -n), begin, nil
+		}
+		n, err = strconv.Atoi(words[0])
+		if words[2] == "ago" && err == nil && n > 0 {
+			begin, end, err := parseDateInterval([]string{"this", strings.TrimSuffix(words[1], "s")}, now)
+			if err != nil {
+				return time.Time{}, time.Time{}, bad
+			}
+			return shiftDate(begin, words[1], -n), shiftDate(end, words[1], -n), nil
+		}
+	}
+	return time.Time{}, time.Time{}, bad
+}
+
+// shiftDate moves a date by n days, weeks, months or years.
+func shiftDate(date time.Time, unit string, n int) time.Time {
+	switch strings.TrimSuffix(unit, "s") {
+	case "day":
+		return date.AddDate(0, 0, n)
+	case "week":
+		return date.AddDate(0, 0, 7*n)
+	case "month":
+		return date.AddDate(0, n, 0)
+	}
+	return date.AddDate(n, 0, 0)
+}
+
+func prefix3(s string) string {
+	if len(s) > 3 {
+		return s[:3]
+	}
+	return s
+}
+
+func parseNumericDate(s string, now time.Time) (time.Time, time.Time, error) {
+	bad := fmt.Errorf("invalid date %q", s)
+	parts := strings.FieldsFunc(s, func(r rune) bool { return r == '/' || r == '-' || r == '.' })
+	nums := []int{}
+	for _, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return time.Time{}, time.Time{}, bad
+		}
+		nums = append(nums, n)
+	}
+	switch {
+	case len(nums) == 1 && nums[0] > 999:
+		begin := time.Date(nums[0], 1, 1, 0, 0, 0, 0, time.UTC)
+		return begin, begin.AddDate(1, 0, 0), nil
+	case len(nums) == 2 && nums[0] > 999:
+		begin := time.Date(nums[0], time.Month(nums[1]), 1, 0, 0, 0, 0, time.UTC)
+		return begin, begin.AddDate(0, 1, 0), nil
+	case len(nums) == 2:
+		begin := time.Date(now.Year(), time.Month(nums[0]), nums[1], 0, 0, 0, 0, time.UTC)
+		return begin, begin.AddDate(0, 0, 1), nil
+	case len(nums) == 3:
+		begin := time.Date(nums[0], time.Month(nums[1]), nums[2], 0, 0, 0, 0, time.UTC)
+		return begin, begin.AddDate(0, 0, 1), nil
+	}
+	return time.Time{}, time.Time{}, bad
+}
+
+type pricePoint struct {
+	date  time.Time
+	price float64
+}
+
+// PriceHistory answers "what was one unit of A worth in B on a date" from
+// the journal's P directives and the prices implied by posting costs.
+type PriceHistory struct {
+	prices map[[2]string][]pricePoint
+}
+
+// NewPriceHistory collects the prices known to a journal.
+func NewPriceHistory(journal *Journal) *PriceHistory {
+	h := &PriceHistory{prices: map[[2]string][]pricePoint{}}
+	for _, p := range journal.Prices {
+		h.add(p.Commodity, p.Price.Currency, p.Date, p.Price.Value)
+	}
+	for _, tx := range journal.Transactions {
+		for _, p := range tx.Postings {
+			if p.Cost != nil && p.Amount.Value != 0 && p.Cost.Currency != p.Amount.Currency {
+				h.add(p.Amount.Currency, p.Cost.Currency, tx.Date, math.Abs(p.Cost.Value/p.Amount.Value))
+			}
+		}
+	}
+	for key := range h.prices {
+		points := h.prices[key]
+		sort.SliceStable(points, func(i, j int) bool { return points[i].date.Before(points[j].date) })
+	}
+	return h
+}
+
+func (h *PriceHistory) add(from, to string, date time.Time, price float64) {
+	if price == 0 || from == to {
+		return
+	}
+	h.prices[[2]string{from, to}] = append(h.prices[[2]string{from, to}], pricePoint{date, price})
+	h.prices[[2]string{to, from}] = append(h.prices[[2]string{to, from}], pricePoint{date, 1 / price})
+}
+
+// Price returns the latest price of one unit of from in to, on or before
+// date.
+func (h *PriceHistory) Price(from, to string, date time.Time) (float64, bool) {
+	points := h.prices[[2]string{from, to}]
+	i := sort.Search(len(points), func(i int) bool { return points[i].date.After(date) })
+	if i == 0 {
+		return 0, false
+	}
+	return points[i-1].price, true
+}
+
+// Convert values an amount in another commodity. Amounts without a known
+// price are returned unchanged, as ledger does.
+func (h *PriceHistory) Convert(a Amount, to string, date time.Time) Amount {
+	if a.Currency == to {
+		return a
+	}
+	if price, ok := h.Price(a.Currency, to, date); ok {
+		return Amount{Currency: to, Value: a.Value * price}
+	}
+	return a
+}
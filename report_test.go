@@ -0,0 +1,203 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const reportJournal = `P 2026/09/01 US$ $ 40.00
+
+2026/09/05 Sueldo
+    Assets:Bancos:BROU        $ 80,000.00
+    Income:Sueldo
+
+2026/09/10 UTE
+    Expenses:Cuentas:UTE      $ 2,000.00
+    Assets:Bancos:BROU
+
+2026/10/01 Spotify
+    Expenses:Cuentas:Spotify  US$ 10.00
+    Assets:Bancos:Itau
+`
+
+func runTestReport(t *testing.T, query string) string {
+	out, err := RunReport(ParseJournal("", reportJournal), strings.Fields(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestBalanceReport(t *testing.T) {
+	got := runTestReport(t, "bal assets")
+	want := "" +
+		"         $ 78,000.00\n" +
+		"          US$ -10.00  Assets:Bancos\n" +
+		"         $ 78,000.00    BROU\n" +
+		"          US$ -10.00    Itau\n" +
+		"--------------------\n" +
+		"         $ 78,000.00\n" +
+		"          US$ -10.00\n"
+	if got != want {
+		t.Errorf("bal assets:\n%s\nwant:\n%s", got, want)
+	}
+
+	got = runTestReport(t, "bal expenses -p 2026/09 --depth 1")
+	if got != "          $ 2,000.00  Expenses\n" {
+		t.Errorf("bal with period and depth:\n%q", got)
+	}
+
+	got = runTestReport(t, "bal expenses -X $ -H")
+	if !strings.Contains(got, "$ 2,400.00  Expenses:Cuentas") {
+		t.Errorf("bal with exchange:\n%s", got)
+	}
+}
+
+func TestRegisterReport(t *testing.T) {
+	query, err := ParsePostingQuery("brou")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := RegisterReportFor(ParseJournal("", reportJournal), ReportOptions{Query: query})
+	if len(rows) != 2 || rows[1].Total["$"] != 78000 {
+		t.Errorf("unexpected register rows: %+v", rows)
+	}
+}
+
+func TestParsePeriod(t *testing.T) {
+	now := time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+	cases := map[string][2]string{
+		"Oct 2026":        {"2026-10-01", "2026-11-01"},
+		"2026":            {"2026-01-01", "2027-01-01"},
+		"2026/09/05":      {"2026-09-05", "2026-09-06"},
+		"last month":      {"2026-09-01", "2026-10-01"},
+		"from Jan to Mar": {"2026-01-01", "2026-03-01"},
+		"last 12 months":  {"2025-10-01", "2026-10-01"},
+		"2 months ago":    {"2026-08-01", "2026-09-01"},
+	}
+	for expr, want := range cases {
+		begin, end, err := ParsePeriod(expr, now)
+		if err != nil {
+			t.Errorf("%s: %v", expr, err)
+			continue
+		}
+		if begin.Format("2006-01-02") != want[0] || end.Format("2006-01-02") != want[1] {
+			t.Errorf("%s: got %v..%v", expr, begin, end)
+		}
+	}
+}
+
+func TestJSONQuery(t *testing.T) {
+	result, err := JSONQuery(ParseJournal("", reportJournal), "bal assets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Accounts) != 1 || result.Accounts[0].Name != "Assets:Bancos" || len(result.Accounts[0].Children) != 2 {
+		t.Fatalf("unexpected tree: %+v", result.Accounts)
+	}
+	brou := result.Accounts[0].Children[0]
+	if brou.Account != "Assets:Bancos:BROU" || brou.Amounts[0].Amount != 78000 || brou.Amounts[0].Formatted != "$ 78,000.00" {
+		t.Errorf("unexpected node: %+v", brou)
+	}
+}
+
+func TestBudgetReport(t *testing.T) {
+	journal := ParseJournal("", reportJournal+`
+~ Monthly
+    Expenses:Cuentas       $ 1,000.00
+    Assets:Bancos:BROU
+
+~ Yearly
+    Expenses:Viajes        US$ 1,200.00
+    Assets:Bancos:BROU
+`)
+	budgets := Budgets(journal, LedgerDef{Budget: map[string]string{"Expenses:Comida": "$ 5,000"}})
+	if len(budgets) != 3 || budgets["Expenses:Viajes"].Value != 100 || budgets["Expenses:Comida"].Value != 5000 {
+		t.Fatalf("unexpected budgets %v", budgets)
+	}
+
+	september := BudgetReport(journal, budgets, time.Date(2026, 9, 1, 0, 0, 0, 0, time.UTC))
+	cuentas := september.Rows[1]
+	if cuentas.Account != "Expenses:Cuentas" || cuentas.Actual.Value != 2000 || cuentas.Remaining.Value != -1000 || !cuentas.Over || cuentas.Percent != 200 {
+		t.Errorf("unexpected September row %+v", cuentas)
+	}
+
+	october := BudgetReport(journal, budgets, time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC))
+	if cuentas := october.Rows[1]; cuentas.Actual.Value != 400 || cuentas.Over || cuentas.Percent != 40 {
+		t.Errorf("expected the US$ 10 converted to $ 400, got %+v", cuentas)
+	}
+}
+
+func TestEvalWidget(t *testing.T) {
+	journal := ParseJournal("", reportJournal)
+	now := time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+	widget := DashboardWidget{Label: "Income in {period}", Query: "^income", Period: "last month", Exchange: "US$", Scale: -1}
+	if view := EvalWidget(journal, widget, now); view.Label != "Income in Sep 2026" || view.Value != "US$ 2000.00" || view.Error != "" {
+		t.Errorf("unexpected widget %+v", view)
+	}
+	widget = DashboardWidget{Label: "Expenses", Query: "^expenses", Period: "last 12 months"}
+	if view := EvalWidget(journal, widget, now); view.Value != "$ 2,000.00" {
+		t.Errorf("expected only September's expenses, got %+v", view)
+	}
+	if view := EvalWidget(journal, DashboardWidget{Query: "x", Period: "someday"}, now); view.Error == "" {
+		t.Errorf("expected an error for an invalid period")
+	}
+}
+
+func TestCharts(t *testing.T) {
+	charts := Charts(ParseJournal("", reportJournal), time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC), 2, "$")
+	if len(charts) != 3 || len(charts[0].Months) != 2 || charts[0].Months[0] != "2026-09" {
+		t.Fatalf("unexpected charts %+v", charts)
+	}
+	if income := charts[0].Series; len(income) != 1 || income[0].Values[0] != 80000 || income[0].Values[1] != 0 {
+		t.Errorf("unexpected income %+v", income)
+	}
+	if expenses := charts[1].Series; len(expenses) != 1 || expenses[0].Name != "Expenses:Cuentas" || expenses[0].Values[1] != 400 {
+		t.Errorf("expected Spotify converted to $ 400, got %+v", expenses)
+	}
+	networth := charts[2].Series
+	if len(networth) != 2 || networth[0].Commodity != "$" || networth[0].Values[1] != 78000 || networth[1].Values[0] != 0 || networth[1].Values[1] != -10 {
+		t.Errorf("unexpected net worth %+v", networth)
+	}
+	if views := ChartViews(charts[2]); len(views) != 2 || !strings.Contains(string(views[1].SVG), "<polyline") {
+		t.Errorf("expected a chart per commodity, got %+v", views)
+	}
+}
+
+func TestParsePriceCSV(t *testing.T) {
+	csv := "Cotizaciones del dólar\nFecha;Compra;Venta\n01/10/2026;39,800;40,250\n02/10/2026;39,900;40,3\n\nFuente: BCU\n"
+	prices, err := ParsePriceCSV(strings.NewReader(csv), "US$", "$")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prices) != 2 || prices[0].Date.Format("2006-01-02") != "2026-10-01" || prices[0].Price.Value != 40.25 || prices[1].Price.Value != 40.3 {
+		t.Errorf("unexpected prices %+v %+v", prices[0], prices[1])
+	}
+
+	prices, err = ParsePriceCSV(strings.NewReader("2026-10-03,40.1\n"), "US$", "$")
+	if err != nil || len(prices) != 1 || prices[0].Price.Value != 40.1 {
+		t.Errorf("unexpected prices without a header %v %v", prices, err)
+	}
+}
+
+func TestMergePrices(t *testing.T) {
+	journal := ParseJournal("", reportJournal)
+	content := "; rates\nP 2026/10/01 US$ $ 40\n"
+	prices := []*PriceDirective{
+		{Date: time.Date(2026, 10, 2, 0, 0, 0, 0, time.UTC), Commodity: "US$", Price: Amount{Currency: "$", Value: 40.3125}},
+		{Date: time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC), Commodity: "US$", Price: Amount{Currency: "$", Value: 40.25}},
+	}
+	merged, changed := MergePrices(journal, "prices.ledger", content, prices)
+	if expected := "; rates\nP 2026/10/01 US$ $ 40.25\nP 2026/10/02 US$ $ 40.3125\n"; merged != expected || changed != 2 {
+		t.Errorf("merged %d:\n%v", changed, merged)
+	}
+	if _, changed := MergePrices(journal, "prices.ledger", merged, prices); changed != 0 {
+		t.Errorf("expected no changes merging the same prices, got %d", changed)
+	}
+
+	parsed := ParseJournal("", merged+reportJournal)
+	if got := parsed.FormatAmount(Amount{Currency: "$", Value: 1}); got != "$ 1.00" {
+		t.Errorf("prices changed the style of $: %v", got)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const sessionCookieName = "auth"
+const sessionLifetime = 30 * 24 * time.Hour
+
+// Session is a logged in user. Only its ID travels in the cookie; everything
+// else stays on the server.
+type Session struct {
+	ID        string
+	Email     string
+	Token     oauth2.Token
+	CSRFToken string
+	Created   time.Time
+	Expires   time.Time
+}
+
+// SessionStore keeps sessions in memory and persists them to a JSON file so
+// they survive restarts.
+type SessionStore struct {
+	mu       sync.Mutex
+	path     string
+	key      []byte
+	sessions map[string]*Session
+}
+
+var sessions *SessionStore
+
+// InitSessions loads the session store and the cookie signing key from the
+// working directory.
+func InitSessions() {
+	sessions = NewSessionStore("sessions.json", sessionKey("session.key"))
+}
+
+// sessionKey returns the HMAC key for cookies. WEBLEDGER_SESSION_KEY takes
+// precedence; otherwise a random key is generated once and kept in keyPath.
+func sessionKey(keyPath string) []byte {
+	if env := os.Getenv("WEBLEDGER_SESSION_KEY"); env != "" {
+		return []byte(env)
+	}
+	if data, err := ioutil.ReadFile(keyPath); err == nil {
+		if key, err := hex.DecodeString(strings.TrimSpace(string(data))); err == nil && len(key) >= 32 {
+			return key
+		}
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	if err := ioutil.WriteFile(keyPath, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+		Log("Error saving session key: %v", err)
+	}
+	return key
+}
+
+// NewSessionStore loads the sessions saved in path, dropping expired ones.
+func NewSessionStore(path string, key []byte) *SessionStore {
+	s := &SessionStore{path: path, key: key, sessions: map[string]*Session{}}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			Log("Error reading sessions: %v", err)
+		}
+		return s
+	}
+	if err := json.Unmarshal(data, &s.sessions); err != nil {
+		Log("Error reading sessions: %v", err)
+		s.sessions = map[string]*Session{}
+	}
+	s.removeExpired()
+	return s
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (s *SessionStore) removeExpired() {
+	now := time.Now()
+	for id, session := range s.sessions {
+		if now.After(session.Expires) {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+// save writes the sessions to disk. The caller holds the lock.
+func (s *SessionStore) save() {
+	if s.path == "" {
+		return
+	}
+	data, err := json.Marshal(s.sessions)
+	if err != nil {
+		Log("Error saving sessions: %v", err)
+		return
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		Log("Error saving sessions: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		Log("Error saving sessions: %v", err)
+	}
+}
+
+// Create starts a new session for a user.
+func (s *SessionStore) Create(email string, token oauth2.Token) *Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	session := &Session{
+		ID:        randomToken(),
+		Email:     email,
+		Token:     token,
+		CSRFToken: randomToken(),
+		Created:   now,
+		Expires:   now.Add(sessionLifetime),
+	}
+	s.removeExpired()
+	s.sessions[session.ID] = session
+	s.save()
+	saved := *session
+	return &saved
+}
+
+// Get returns a copy of a session, or nil if it does not exist or expired.
+func (s *SessionStore) Get(id string) *Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[id]
+	if !ok || time.Now().After(session.Expires) {
+		return nil
+	}
+	saved := *session
+	return &saved
+}
+
+// Update stores changes made to a session returned by Get.
+func (s *SessionStore) Update(session *Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.sessions[session.ID]; !ok {
+		return
+	}
+	saved := *session
+	s.sessions[session.ID] = &saved
+	s.save()
+}
+
+// Delete revokes a session.
+func (s *SessionStore) Delete(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.sessions[id]; ok {
+		delete(s.sessions, id)
+		s.save()
+	}
+}
+
+func (s *SessionStore) sign(id string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// cookieValue is the session ID followed by its HMAC.
+func (s *SessionStore) cookieValue(id string) string {
+	return id + "." + s.sign(id)
+}
+
+// sessionID verifies a cookie value and returns the session ID in it.
+func (s *SessionStore) sessionID(value string) (string, bool) {
+	dot := strings.LastIndex(value, ".")
+	if dot < 0 {
+		return "", false
+	}
+	id, signature := value[:dot], value[dot+1:]
+	if !hmac.Equal([]byte(signature), []byte(s.sign(id))) {
+		return "", false
+	}
+	return id, true
+}
+
+// GetSession returns the session of the request. It never returns nil: a
+// request without a valid session gets an empty one.
+func GetSession(r *http.Request) *Session {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return &Session{}
+	}
+	id, ok := sessions.sessionID(cookie.Value)
+	if !ok {
+		Log("Invalid session cookie signature")
+		return &Session{}
+	}
+	session := sessions.Get(id)
+	if session == nil {
+		return &Session{}
+	}
+	return session
+}
+
+// SetSessionCookie sends the signed session cookie.
+func SetSessionCookie(w http.ResponseWriter, session *Session) {
+	c := http.Cookie{
+		Name:     sessionCookieName,
+		Value:    sessions.cookieValue(session.ID),
+		Path:     sessionCookiePath(),
+		Expires:  session.Expires,
+		HttpOnly: true,
+		Secure:   !isLocalEnvironment(),
+		SameSite: http.SameSiteLaxMode,
+	}
+	http.SetCookie(w, &c)
+}
+
+// ClearSessionCookie removes the session cookie from the browser.
+func ClearSessionCookie(w http.ResponseWriter) {
+	c := http.Cookie{Name: sessionCookieName, Value: "", Path: sessionCookiePath(), MaxAge: -1}
+	http.SetCookie(w, &c)
+}
+
+func sessionCookiePath() string {
+	if RootPath == "" {
+		return "/"
+	}
+	return RootPath
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestSessionStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	store := NewSessionStore(path, []byte("test key"))
+	session := store.Create("max@example.com", oauth2.Token{AccessToken: "secret"})
+
+	value := store.cookieValue(session.ID)
+	if id, ok := store.sessionID(value); !ok || id != session.ID {
+		t.Fatalf("signed cookie not accepted")
+	}
+	if _, ok := store.sessionID(session.ID + ".forged"); ok {
+		t.Errorf("forged signature accepted")
+	}
+
+	reloaded := NewSessionStore(path, []byte("test key"))
+	if got := reloaded.Get(session.ID); got == nil || got.Email != "max@example.com" {
+		t.Fatalf("session not persisted: %+v", got)
+	}
+	reloaded.Delete(session.ID)
+	if NewSessionStore(path, []byte("test key")).Get(session.ID) != nil {
+		t.Errorf("deleted session still present")
+	}
+}
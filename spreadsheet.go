@@ -0,0 +1,318 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/extrame/xls"
+)
+
+// SheetRow is a row of a spreadsheet, as the trimmed text of its cells.
+type SheetRow []string
+
+// Cell returns the text of a cell, or "" if the row does not have it.
+func (r SheetRow) Cell(i int) string {
+	if i < 0 || i >= len(r) {
+		return ""
+	}
+	return r[i]
+}
+
+// Sheet is a sheet of a spreadsheet. Rows are at their index; missing rows
+// are empty.
+type Sheet []SheetRow
+
+var zipMagic = []byte("PK\x03\x04")
+
+// ReadSpreadsheet reads the sheets of an Excel file, either a legacy BIFF
+// .xls file or an OOXML .xlsx one.
+func ReadSpreadsheet(data []byte) ([]Sheet, error) {
+	switch {
+	case bytes.HasPrefix(data, oleMagic):
+		return readXLS(data)
+	case bytes.HasPrefix(data, zipMagic):
+		return readXLSX(data)
+	}
+	return nil, fmt.Errorf("not an Excel file")
+}
+
+func readXLS(data []byte) (sheets []Sheet, err error) {
+	// The xls package panics on some malformed files.
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("error reading XLS file: %v", r)
+		}
+	}()
+	file, err := xls.OpenReader(bytes.NewReader(data), "utf-8")
+	if err != nil {
+		return nil, fmt.Errorf("error opening XLS file: %v", err)
+	}
+	for i := 0; i < file.NumSheets(); i++ {
+		ws := file.GetSheet(i)
+		if ws == nil {
+			continue
+		}
+		sheet := Sheet{}
+		for r := 0; r <= int(ws.MaxRow); r++ {
+			sheet = append(sheet, readXLSRow(ws, r))
+		}
+		sheets = append(sheets, sheet)
+	}
+	if len(sheets) == 0 {
+		return nil, fmt.Errorf("no sheets found in XLS file")
+	}
+	return sheets, nil
+}
+
+// readXLSRow reads a row of a sheet, or returns an empty row if the xls
+// package cannot.
+func readXLSRow(ws *xls.WorkSheet, r int) (row SheetRow) {
+	defer func() {
+		if recover() != nil {
+			row = nil
+		}
+	}()
+	xlsRow := ws.Row(r)
+	if xlsRow == nil {
+		return nil
+	}
+	for c := 0; c < xlsRow.LastCol(); c++ {
+		row = append(row, strings.TrimSpace(xlsRow.Col(c)))
+	}
+	return row
+}
+
+// xlsxMaxPart limits how much of a part of an XLSX file is read, against
+// zip bombs.
+const xlsxMaxPart = 50 << 20
+
+// The size of an Excel sheet. Files with rows or cells beyond it are
+// rejected, as the sheets are allocated up to their references.
+const (
+	xlsxMaxRows    = 1048576
+	xlsxMaxColumns = 16384
+)
+
+type xlsxWorkbook struct {
+	Sheets []struct {
+		Name  string     `xml:"name,attr"`
+		Attrs []xml.Attr `xml:",any,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+type xlsxRelationships struct {
+	Relationships []struct {
+		ID     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+// xlsxText is a string with optional rich text runs.
+type xlsxText struct {
+	T    string `xml:"t"`
+	Runs []struct {
+		T string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (t xlsxText) String() string {
+	s := t.T
+	for _, r := range t.Runs {
+		s += r.T
+	}
+	return s
+}
+
+type xlsxSharedStrings struct {
+	Items []xlsxText `xml:"si"`
+}
+
+type xlsxStyles struct {
+	NumFmts []struct {
+		ID   int    `xml:"numFmtId,attr"`
+		Code string `xml:"formatCode,attr"`
+	} `xml:"numFmts>numFmt"`
+	CellXfs []struct {
+		NumFmtID int `xml:"numFmtId,attr"`
+	} `xml:"cellXfs>xf"`
+}
+
+type xlsxWorksheet struct {
+	Rows []struct {
+		R     int `xml:"r,attr"`
+		Cells []struct {
+			R      string   `xml:"r,attr"`
+			T      string   `xml:"t,attr"`
+			S      int      `xml:"s,attr"`
+			V      string   `xml:"v"`
+			Inline xlsxText `xml:"is"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+// readXLSX reads the sheets of an OOXML workbook, in workbook order.
+// Numbers formatted as dates are returned as DD/MM/YYYY, like BIFF files
+// show them.
+func readXLSX(data []byte) ([]Sheet, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("error opening XLSX file: %v", err)
+	}
+	files := map[string]*zip.File{}
+	for _, f := range archive.File {
+		files[strings.ToLower(f.Name)] = f
+	}
+	part := func(name string, v interface{}) error {
+		f, ok := files[strings.ToLower(name)]
+		if !ok {
+			return fmt.Errorf("%v not found in XLSX file", name)
+		}
+		r, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		return xml.NewDecoder(io.LimitReader(r, xlsxMaxPart)).Decode(v)
+	}
+
+	var workbook xlsxWorkbook
+	if err := part("xl/workbook.xml", &workbook); err != nil {
+		return nil, err
+	}
+	var rels xlsxRelationships
+	if err := part("xl/_rels/workbook.xml.rels", &rels); err != nil {
+		return nil, err
+	}
+	targets := map[string]string{}
+	for _, rel := range rels.Relationships {
+		if strings.HasPrefix(rel.Target, "/") {
+			targets[rel.ID] = strings.TrimPrefix(rel.Target, "/")
+		} else {
+			targets[rel.ID] = path.Join("xl", rel.Target)
+		}
+	}
+	// Workbooks without text or styles do not have these parts.
+	var sharedStrings xlsxSharedStrings
+	part("xl/sharedStrings.xml", &sharedStrings)
+	var styles xlsxStyles
+	part("xl/styles.xml", &styles)
+	dateStyles := xlsxDateStyles(styles)
+
+	sheets := []Sheet{}
+	for _, s := range workbook.Sheets {
+		target := ""
+		for _, attr := range s.Attrs {
+			if attr.Name.Local == "id" {
+				target = targets[attr.Value]
+			}
+		}
+		var worksheet xlsxWorksheet
+		if err := part(target, &worksheet); err != nil {
+			return nil, fmt.Errorf("sheet %v: %v", s.Name, err)
+		}
+		sheet := Sheet{}
+		for _, row := range worksheet.Rows {
+			r := row.R - 1
+			if r < len(sheet) {
+				r = len(sheet) // rows without a number follow the previous one
+			}
+			if r >= xlsxMaxRows {
+				return nil, fmt.Errorf("sheet %v: row %d is beyond the last row of a sheet", s.Name, r+1)
+			}
+			for len(sheet) <= r {
+				sheet = append(sheet, nil)
+			}
+			cells := SheetRow{}
+			for _, cell := range row.Cells {
+				c := len(cells)
+				if col, ok := xlsxColumn(cell.R); ok && col >= c {
+					c = col
+				}
+				if c >= xlsxMaxColumns {
+					return nil, fmt.Errorf("sheet %v: cell %v is beyond the last column of a sheet", s.Name, cell.R)
+				}
+				for len(cells) <= c {
+					cells = append(cells, "")
+				}
+				value := cell.V
+				switch cell.T {
+				case "s":
+					if i, err := strconv.Atoi(cell.V); err == nil && i >= 0 && i < len(sharedStrings.Items) {
+						value = sharedStrings.Items[i].String()
+					}
+				case "inlineStr":
+					value = cell.Inline.String()
+				case "", "n":
+					if cell.S < len(dateStyles) && dateStyles[cell.S] {
+						if serial, err := strconv.ParseFloat(cell.V, 64); err == nil {
+							value = excelDate(serial).Format("02/01/2006")
+						}
+					}
+				}
+				cells[c] = strings.TrimSpace(value)
+			}
+			sheet[r] = cells
+		}
+		sheets = append(sheets, sheet)
+	}
+	if len(sheets) == 0 {
+		return nil, fmt.Errorf("no sheets found in XLSX file")
+	}
+	return sheets, nil
+}
+
+var xlsxCellRegex = regexp.MustCompile(`^([A-Z]+)\d+$`)
+
+// xlsxColumn returns the 0-based column of a cell reference like "C5".
+func xlsxColumn(ref string) (int, bool) {
+	m := xlsxCellRegex.FindStringSubmatch(strings.ToUpper(ref))
+	if m == nil {
+		return 0, false
+	}
+	col := 0
+	for _, letter := range m[1] {
+		col = col*26 + int(letter-'A') + 1
+		if col > xlsxMaxColumns {
+			return xlsxMaxColumns, true // beyond the sheet, without overflowing
+		}
+	}
+	return col - 1, true
+}
+
+var xlsxFormatLiteralRegex = regexp.MustCompile(`"[^"]*"|\[[^\]]*\]|\\.`)
+
+// xlsxDateStyles returns, for each cell style of a workbook, whether it
+// formats numbers as dates.
+func xlsxDateStyles(styles xlsxStyles) []bool {
+	codes := map[int]string{}
+	for _, f := range styles.NumFmts {
+		codes[f.ID] = f.Code
+	}
+	dates := make([]bool, len(styles.CellXfs))
+	for i, xf := range styles.CellXfs {
+		id := xf.NumFmtID
+		if code, ok := codes[id]; ok {
+			code = strings.ToLower(xlsxFormatLiteralRegex.ReplaceAllString(code, ""))
+			dates[i] = strings.ContainsAny(code, "dy")
+		} else {
+			// Built-in date formats.
+			dates[i] = (id >= 14 && id <= 17) || id == 22 || (id >= 27 && id <= 36) || (id >= 50 && id <= 58)
+		}
+	}
+	return dates
+}
+
+// excelDate converts an Excel serial date to a date.
+func excelDate(serial float64) time.Time {
+	// Excel counts days from December 30, 1899.
+	return time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC).AddDate(0, 0, int(math.Floor(serial)))
+}
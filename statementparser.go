@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// StatementParser reads the statements of one kind of file. Sniff looks at
+// the content of a file and returns how confident the parser is that it can
+// read it, from 0 (not at all) to 1 (certain).
+type StatementParser interface {
+	Name() string
+	Sniff(data []byte) float64
+	Parse(data []byte) ([]*BankStatement, error)
+}
+
+// statementParsers are tried by ParseStatement. Parsers for more banks are
+// added with RegisterStatementParser.
+var statementParsers = []StatementParser{
+	brouParser{},
+	itauParser{},
+	visaPDFParser{},
+	visaHTMLParser{},
+	ofxParser{},
+	csvStatementParser{},
+}
+
+// RegisterStatementParser adds a parser to the ones tried on uploads.
+func RegisterStatementParser(parser StatementParser) {
+	statementParsers = append(statementParsers, parser)
+}
+
+// ParseStatement reads a statement file with the parser most confident it
+// can read it, falling back to the less confident ones if it fails. It
+// returns the name of the parser used.
+func ParseStatement(data []byte) ([]*BankStatement, string, error) {
+	type candidate struct {
+		parser     StatementParser
+		confidence float64
+	}
+	candidates := []candidate{}
+	for _, parser := range statementParsers {
+		if confidence := parser.Sniff(data); confidence > 0 {
+			candidates = append(candidates, candidate{parser, confidence})
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, "", fmt.Errorf("unknown statement format")
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].confidence > candidates[j].confidence })
+
+	var firstErr error
+	for _, c := range candidates {
+		statements, err := c.parser.Parse(data)
+		if err == nil && len(statements) > 0 {
+			return statements, c.parser.Name(), nil
+		}
+		if err == nil {
+			err = fmt.Errorf("no transactions found")
+		}
+		Log("%v parser could not read the statement: %v", c.parser.Name(), err)
+		if firstErr == nil {
+			firstErr = fmt.Errorf("%v: %v", c.parser.Name(), err)
+		}
+	}
+	return nil, "", firstErr
+}
+
+// SetAccount sets the ledger account of a statement and its transactions.
+func (s *BankStatement) SetAccount(account string) {
+	s.Account = account
+	for i := range s.Transactions {
+		s.Transactions[i].Account = account
+	}
+}
+
+var oleMagic = []byte{0xd0, 0xcf, 0x11, 0xe0, 0xa1, 0xb1, 0x1a, 0xe1}
+
+// spreadsheetText returns the lowercased text of the first rows of every
+// sheet of an XLS or XLSX file, or "" if it is not one.
+func spreadsheetText(data []byte) string {
+	sheets, err := ReadSpreadsheet(data)
+	if err != nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, sheet := range sheets {
+		for _, row := range sheet[:min(len(sheet), 40)] {
+			b.WriteString(strings.ToLower(strings.Join(row, "\t")) + "\n")
+		}
+	}
+	return b.String()
+}
+
+// containsAny reports whether s contains any of the words.
+func containsAny(s string, words ...string) bool {
+	for _, word := range words {
+		if strings.Contains(s, word) {
+			return true
+		}
+	}
+	return false
+}
+
+type brouParser struct{}
+
+func (brouParser) Name() string { return "BROU" }
+
+func (brouParser) Sniff(data []byte) float64 {
+	text := spreadsheetText(data)
+	switch {
+	case text == "":
+		return 0
+	case containsAny(text, "brou", "república oriental", "republica oriental"):
+		return 0.9
+	case strings.Contains(text, "descripci") && containsAny(text, "débito", "debito"):
+		return 0.6
+	}
+	return 0.1
+}
+
+func (brouParser) Parse(data []byte) ([]*BankStatement, error) {
+	statement, err := ParseBrouStatement(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return []*BankStatement{statement}, nil
+}
+
+type itauParser struct{}
+
+func (itauParser) Name() string { return "Itau" }
+
+func (itauParser) Sniff(data []byte) float64 {
+	text := spreadsheetText(data)
+	switch {
+	case text == "":
+		return 0
+	case containsAny(text, "itau", "itaú"):
+		return 0.9
+	case strings.Contains(text, "concepto") && strings.Contains(text, "saldo"):
+		return 0.6
+	}
+	return 0.1
+}
+
+func (itauParser) Parse(data []byte) ([]*BankStatement, error) {
+	statement, err := ParseItauStatement(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return []*BankStatement{statement}, nil
+}
+
+// visaPDFParser reads Visa Itau credit card statements, the only PDF
+// statements we know.
+type visaPDFParser struct{}
+
+func (visaPDFParser) Name() string { return "Visa Itau PDF" }
+
+func (visaPDFParser) Sniff(data []byte) float64 {
+	if bytes.HasPrefix(data, []byte("%PDF-")) {
+		return 0.8
+	}
+	return 0
+}
+
+func (visaPDFParser) Parse(data []byte) ([]*BankStatement, error) {
+	return ParseVisaItauStatement(bytes.NewReader(data), int64(len(data)))
+}
+
+// visaHTMLParser reads the table of Itau's Movimientos Actuales page.
+type visaHTMLParser struct{}
+
+func (visaHTMLParser) Name() string { return "Visa Itau Movimientos" }
+
+func (visaHTMLParser) Sniff(data []byte) float64 {
+	text := strings.ToLower(string(data))
+	if !strings.Contains(text, "<tr><td") {
+		return 0
+	}
+	if containsAny(text, "dólares", "dolares", "pesos") {
+		return 0.8
+	}
+	return 0.4
+}
+
+func (visaHTMLParser) Parse(data []byte) ([]*BankStatement, error) {
+	return ParseVisaItauMovimientos(string(data))
+}
+
+// csvStatementParser reads generic CSV statements. They do not name their
+// account, which must be chosen on upload.
+type csvStatementParser struct{}
+
+func (csvStatementParser) Name() string { return "CSV" }
+
+func (csvStatementParser) Sniff(data []byte) float64 {
+	if !utf8.Valid(data) || bytes.IndexByte(data, 0) >= 0 || bytes.HasPrefix(bytes.TrimSpace(data), []byte("<")) {
+		return 0
+	}
+	header := strings.ToLower(strings.SplitN(string(data), "\n", 2)[0])
+	if !strings.Contains(header, ",") {
+		return 0
+	}
+	if containsAny(header, "fecha", "date") {
+		return 0.5
+	}
+	return 0.2
+}
+
+func (csvStatementParser) Parse(data []byte) ([]*BankStatement, error) {
+	statement, err := ParseBankStatementCSV(bytes.NewReader(data), "")
+	if err != nil {
+		return nil, err
+	}
+	return []*BankStatement{statement}, nil
+}
+
+// statementAccounts names the accounts of statements, e.g. for the title of
+// a reconciliation of the pesos and dollars parts of a card statement.
+func statementAccounts(statements []*BankStatement) string {
+	accounts := []string{}
+	seen := map[string]bool{}
+	for _, s := range statements {
+		if !seen[s.Account] {
+			seen[s.Account] = true
+			accounts = append(accounts, s.Account)
+		}
+	}
+	return strings.Join(accounts, ", ")
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const defaultSyncInterval = 5 * time.Minute
+
+// Snapshot is the state of a ledger as of its last sync or save. Handlers
+// read it instead of touching the repository, and must not modify it.
+type Snapshot struct {
+	Revision  string
+	Hash      string // of the ledger file, the files it includes and what its includes match
+	File      string
+	Journal   *Journal
+	Balance   string // the "bal assets" report shown next to the editor
+	Synced    time.Time
+	SyncError string // of the last pull, empty if it worked
+}
+
+var snapshots = map[string]*Snapshot{}
+var snapshotsMu sync.Mutex
+
+var syncTriggers = map[string]chan bool{}
+
+// LedgerSnapshot returns the current snapshot of a ledger, loading it the
+// first time.
+func LedgerSnapshot(ledger string) *Snapshot {
+	snapshotsMu.Lock()
+	snapshot := snapshots[ledger]
+	snapshotsMu.Unlock()
+	if snapshot != nil {
+		return snapshot
+	}
+	repo := LedgerRepo(ledger)
+	repo.Do(func() error {
+		refreshSnapshot(repo, "")
+		return nil
+	})
+	snapshotsMu.Lock()
+	defer snapshotsMu.Unlock()
+	return snapshots[ledger]
+}
+
+// LedgerJournal returns the parsed journal of the ledger's snapshot.
+func LedgerJournal(ledger string) *Journal {
+	return LedgerSnapshot(ledger).Journal
+}
+
+// refreshSnapshot replaces the snapshot of the repository's ledger if its
+// files changed since it was taken. It runs inside Repo.Do.
+func refreshSnapshot(repo *Repo, syncError string) {
+	snapshotsMu.Lock()
+	old := snapshots[repo.ledger]
+	snapshotsMu.Unlock()
+
+	files, includes := []string{repo.Path()}, []string{}
+	if old != nil {
+		files, includes = old.Journal.Files, old.Journal.Includes
+	}
+	snapshot := &Snapshot{Hash: hashFiles(files, includes), Synced: time.Now(), SyncError: syncError}
+	if old != nil && old.Hash == snapshot.Hash {
+		snapshot.File, snapshot.Journal, snapshot.Balance = old.File, old.Journal, old.Balance
+	} else {
+		Log("Loading ledger %v", repo.ledger)
+		snapshot.File, _ = repo.Read()
+		snapshot.Journal = ParseJournalFile(repo.Path())
+		snapshot.Hash = hashFiles(snapshot.Journal.Files, snapshot.Journal.Includes)
+		snapshot.Balance, _ = RunReport(snapshot.Journal, []string{"bal", "assets"})
+	}
+	snapshot.Revision = repo.Revision()
+
+	snapshotsMu.Lock()
+	snapshots[repo.ledger] = snapshot
+	snapshotsMu.Unlock()
+}
+
+// hashFiles hashes the contents of files, in order, and the files matching
+// the include patterns, so that a newly matched file changes the hash.
+func hashFiles(files []string, includes []string) string {
+	hash := sha256.New()
+	for _, name := range files {
+		bytes, _ := ioutil.ReadFile(name)
+		hash.Write([]byte(name + "\x00"))
+		hash.Write(bytes)
+		hash.Write([]byte{0})
+	}
+	for _, pattern := range includes {
+		matches, _ := filepath.Glob(pattern)
+		hash.Write([]byte(pattern + "\x00" + strings.Join(matches, "\x00") + "\x00"))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// StartSync starts pulling every ledger in the background, every
+// SyncInterval and whenever TriggerSync is called.
+func StartSync() {
+	for name, def := range ledgers {
+		interval := defaultSyncInterval
+		if def.SyncInterval != "" {
+			parsed, err := time.ParseDuration(def.SyncInterval)
+			if err != nil || parsed <= 0 {
+				Log("Invalid SyncInterval %q for ledger %v, using %v", def.SyncInterval, name, interval)
+			} else {
+				interval = parsed
+			}
+		}
+		trigger := make(chan bool, 1)
+		syncTriggers[name] = trigger
+		go syncLoop(name, interval, trigger)
+	}
+}
+
+func syncLoop(ledger string, interval time.Duration, trigger chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := UpdateLedger(ledger); err != nil {
+			Log("Error syncing %v: %v", ledger, err)
+		}
+		select {
+		case <-ticker.C:
+		case <-trigger:
+		}
+	}
+}
+
+// TriggerSync asks the sync loop of a ledger to pull now.
+func TriggerSync(ledger string) {
+	select {
+	case syncTriggers[ledger] <- true:
+	default:
+		// A sync is already pending.
+	}
+}
+
+// handleSyncHook is the webhook the ledger's git host calls on push. The
+// request must be signed with the ledger's WebhookSecret, GitHub style
+// (X-Hub-Signature-256) or carry it as a token (X-Gitlab-Token or
+// X-Webhook-Token).
+func handleSyncHook(w http.ResponseWriter, r *http.Request) {
+	ledger := mux.Vars(r)["ledger"]
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !validWebhook(ledgers[ledger].WebhookSecret, r, body) {
+		Log("Invalid webhook call for %v", ledger)
+		http.Error(w, "Invalid webhook signature", http.StatusForbidden)
+		return
+	}
+	Log("Webhook sync of %v", ledger)
+	TriggerSync(ledger)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func validWebhook(secret string, r *http.Request, body []byte) bool {
+	if secret == "" {
+		return false
+	}
+	if signature := r.Header.Get("X-Hub-Signature-256"); signature != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		return hmac.Equal([]byte(strings.ToLower(signature)), []byte(expected))
+	}
+	token := r.Header.Get("X-Gitlab-Token")
+	if token == "" {
+		token = r.Header.Get("X-Webhook-Token")
+	}
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ValidationError is a ledger file rejected by ValidateJournal.
+type ValidationError struct {
+	Errors []*ParseError
+}
+
+func (e *ValidationError) Error() string {
+	messages := []string{}
+	for _, err := range e.Errors {
+		messages = append(messages, err.Error())
+	}
+	return "the ledger has errors:\n" + strings.Join(messages, "\n")
+}
+
+// ValidationOptions selects the optional checks of ValidateJournal.
+type ValidationOptions struct {
+	// DeclaredAccounts rejects postings to accounts without an account
+	// directive.
+	DeclaredAccounts bool
+}
+
+// ValidateJournal returns the problems found in file, sorted by line:
+// parse errors, unbalanced transactions, commodities not declared when the
+// journal declares any, and optionally undeclared accounts. Only problems
+// in file itself are reported, not in the files it includes.
+func ValidateJournal(journal *Journal, file string, options ValidationOptions) []*ParseError {
+	errors := []*ParseError{}
+	for _, err := range journal.Errors {
+		if err.File == file {
+			errors = append(errors, err)
+		}
+	}
+
+	checkCommodities := len(journal.DeclaredCommodities) > 0
+	check := func(line int, account string, amounts ...*Amount) {
+		for _, amount := range amounts {
+			if checkCommodities && amount != nil && amount.Currency != "" && !journal.DeclaredCommodities[amount.Currency] {
+				errors = append(errors, &ParseError{File: file, Line: line, Message: fmt.Sprintf("unknown commodity %q", amount.Currency)})
+			}
+		}
+		if options.DeclaredAccounts && account != "" && !journal.DeclaredAccounts[account] {
+			errors = append(errors, &ParseError{File: file, Line: line, Message: fmt.Sprintf("undeclared account %q", account)})
+		}
+	}
+	checkPostings := func(span Span, postings []*Posting) {
+		if span.File != file {
+			return
+		}
+		for _, posting := range postings {
+			if !posting.Generated && !posting.Inferred {
+				check(posting.Line, posting.Account, posting.Amount, posting.Cost, posting.Assertion)
+			}
+		}
+	}
+	for _, tx := range journal.Transactions {
+		checkPostings(tx.Span, tx.Postings)
+	}
+	for _, tx := range journal.Automated {
+		checkPostings(tx.Span, tx.Postings)
+	}
+	for _, tx := range journal.Periodic {
+		checkPostings(tx.Span, tx.Postings)
+	}
+	for _, price := range journal.Prices {
+		if price.Span.File == file {
+			check(price.Span.StartLine, "", &Amount{Currency: price.Commodity}, &price.Price)
+		}
+	}
+
+	sort.SliceStable(errors, func(i, j int) bool { return errors[i].Line < errors[j].Line })
+	return errors
+}
+
+// NewErrors returns the errors of text that were not already in oldText.
+// Errors are matched by message and the content of their line, not by line
+// number, so that a file with errors can still be saved with other edits.
+func NewErrors(errors []*ParseError, text string, oldErrors []*ParseError, oldText string) []*ParseError {
+	key := func(err *ParseError, lines []string) string {
+		content := ""
+		if err.Line > 0 && err.Line <= len(lines) {
+			content = strings.TrimSpace(lines[err.Line-1])
+		}
+		return err.Message + "\x00" + content
+	}
+	old := map[string]int{}
+	oldLines := strings.Split(oldText, "\n")
+	for _, err := range oldErrors {
+		old[key(err, oldLines)]++
+	}
+	added := []*ParseError{}
+	lines := strings.Split(text, "\n")
+	for _, err := range errors {
+		if k := key(err, lines); old[k] > 0 {
+			old[k]--
+		} else {
+			added = append(added, err)
+		}
+	}
+	return added
+}
+
+// ConflictMarkerErrors returns an error for each conflict marker line left
+// in text, like the ones in ConflictError.Merged.
+func ConflictMarkerErrors(file string, text string) []*ParseError {
+	errors := []*ParseError{}
+	for i, line := range strings.Split(text, "\n") {
+		if strings.HasPrefix(line, "<<<<<<< ") || strings.HasPrefix(line, ">>>>>>> ") || strings.TrimRight(line, "\r") == "=======" {
+			errors = append(errors, &ParseError{File: file, Line: i + 1, Message: "unresolved conflict marker"})
+		}
+	}
+	return errors
+}